@@ -0,0 +1,211 @@
+package seqs
+
+import (
+	"math"
+	"time"
+)
+
+// DefaultMSS is the sender maximum segment size (SMSS) assumed when none is set.
+// See RFC 9293 section 3.7.1.
+const DefaultMSS = 536
+
+// CongestionControl implements a TCP congestion control algorithm which limits
+// the amount of unacknowledged data in flight to the congestion window (cwnd).
+// The ControlBlock detects loss, performs fast retransmit and fast recovery
+// as described in RFC 5681 and RFC 6582 and notifies the algorithm of these events.
+//
+// A CongestionControl implementation holds the state of a single connection
+// and must not be shared between ControlBlocks.
+type CongestionControl interface {
+	// Init resets the algorithm to its initial state for a sender maximum segment size.
+	Init(smss Size)
+	// Window returns the congestion window (cwnd).
+	Window() Size
+	// SlowStartThreshold returns the slow start threshold (ssthresh).
+	SlowStartThreshold() Size
+	// OnAck is called when acked octets of new data are acknowledged outside of fast recovery.
+	// now is the time the acknowledgement was received as set by [ControlBlock.SetTime].
+	OnAck(now time.Time, acked Size)
+	// OnLoss is called when loss is detected. flight is the amount of data outstanding
+	// when loss was detected. timeout is true when the loss was detected by expiration
+	// of the retransmission timer and false when detected by three duplicate ACKs.
+	OnLoss(flight Size, timeout bool)
+}
+
+var (
+	_ CongestionControl = (*Reno)(nil)
+	_ CongestionControl = (*Cubic)(nil)
+)
+
+// Reno implements the slow start and congestion avoidance algorithms of RFC 5681.
+// Combined with the ControlBlock's handling of partial acknowledgements during
+// fast recovery (RFC 6582) it behaves as NewReno.
+type Reno struct {
+	cwnd     Size
+	ssthresh Size
+	smss     Size
+	// acked counts octets acknowledged during congestion avoidance since last cwnd increase.
+	acked Size
+}
+
+// Init resets the algorithm to its initial state. See RFC 5681 section 3.1.
+func (r *Reno) Init(smss Size) {
+	*r = Reno{
+		cwnd:     initialWindow(smss),
+		ssthresh: math.MaxUint32,
+		smss:     smss,
+	}
+}
+
+// Window returns the congestion window.
+func (r *Reno) Window() Size { return r.cwnd }
+
+// SlowStartThreshold returns the slow start threshold.
+func (r *Reno) SlowStartThreshold() Size { return r.ssthresh }
+
+// OnAck increases the congestion window by at most SMSS per ACK during slow start
+// and by approximately SMSS per round trip during congestion avoidance.
+func (r *Reno) OnAck(_ time.Time, acked Size) {
+	if r.cwnd < r.ssthresh {
+		r.cwnd += minSize(acked, r.smss)
+		return
+	}
+	// Congestion avoidance with appropriate byte counting.
+	r.acked += acked
+	if r.acked >= r.cwnd {
+		r.acked -= r.cwnd
+		r.cwnd += r.smss
+	}
+}
+
+// OnLoss halves the congestion window on loss detected by duplicate ACKs
+// and sets it to one segment on retransmission timeout.
+func (r *Reno) OnLoss(flight Size, timeout bool) {
+	r.ssthresh = maxSize(flight/2, 2*r.smss)
+	r.acked = 0
+	if timeout {
+		r.cwnd = r.smss // Loss window.
+	} else {
+		r.cwnd = r.ssthresh
+	}
+}
+
+const (
+	cubicC     = 0.4 // Scaling constant of the cubic function.
+	cubicBeta  = 0.7 // Multiplicative window decrease factor.
+	cubicAlpha = 3 * (1 - cubicBeta) / (1 + cubicBeta)
+)
+
+// Cubic implements the CUBIC congestion control algorithm of RFC 9438. During congestion
+// avoidance the window grows as a cubic function of the time elapsed since the last
+// congestion event, which makes better use of paths with a large bandwidth-delay product
+// than Reno while remaining Reno-friendly on short round trip paths.
+type Cubic struct {
+	cwnd     Size
+	ssthresh Size
+	smss     Size
+	// Window sizes below are measured in segments.
+	wmax float64 // Window size before the last reduction.
+	west float64 // Reno-friendly window estimate.
+	k    float64 // Seconds it takes the window to grow back to wmax.
+	// epoch is the start of the current congestion avoidance stage. Zero if not started.
+	epoch time.Time
+}
+
+// Init resets the algorithm to its initial state.
+func (c *Cubic) Init(smss Size) {
+	*c = Cubic{
+		cwnd:     initialWindow(smss),
+		ssthresh: math.MaxUint32,
+		smss:     smss,
+	}
+}
+
+// Window returns the congestion window.
+func (c *Cubic) Window() Size { return c.cwnd }
+
+// SlowStartThreshold returns the slow start threshold.
+func (c *Cubic) SlowStartThreshold() Size { return c.ssthresh }
+
+// OnAck increases the congestion window. See RFC 9438 section 4.2 through 4.4.
+// Window growth during congestion avoidance depends on now. If now is zero, i.e: the time
+// was not set with [ControlBlock.SetTime], the window grows linearly as in Reno.
+func (c *Cubic) OnAck(now time.Time, acked Size) {
+	if c.cwnd < c.ssthresh {
+		c.cwnd += minSize(acked, c.smss)
+		return
+	} else if now.IsZero() {
+		c.cwnd += Size(float64(c.smss) * float64(acked) / float64(c.cwnd))
+		return
+	}
+	w := float64(c.cwnd) / float64(c.smss)
+	if c.epoch.IsZero() {
+		c.epoch = now
+		c.west = w
+		if c.wmax <= w {
+			c.k = 0
+			c.wmax = w
+		} else {
+			c.k = math.Cbrt((c.wmax - w) / cubicC)
+		}
+	}
+	t := now.Sub(c.epoch).Seconds() - c.k
+	target := cubicC*t*t*t + c.wmax
+	c.west += cubicAlpha * float64(acked) / float64(c.cwnd)
+	if c.west >= target {
+		// Reno-friendly region.
+		if west := Size(c.west * float64(c.smss)); west > c.cwnd {
+			c.cwnd = west
+		}
+		return
+	}
+	// Concave and convex regions. Window growth is limited to 1.5 cwnd per round trip.
+	target = math.Min(target, 1.5*w)
+	if target > w {
+		c.cwnd += Size((target - w) / w * float64(acked))
+	}
+}
+
+// OnLoss reduces the congestion window. See RFC 9438 section 4.6 and 4.7.
+// Unlike Reno the slow start threshold is calculated from the congestion window, not flight.
+func (c *Cubic) OnLoss(_ Size, timeout bool) {
+	w := float64(c.cwnd) / float64(c.smss)
+	if w < c.wmax {
+		c.wmax = w * (1 + cubicBeta) / 2 // Fast convergence.
+	} else {
+		c.wmax = w
+	}
+	c.ssthresh = maxSize(Size(float64(c.cwnd)*cubicBeta), 2*c.smss)
+	c.epoch = time.Time{}
+	if timeout {
+		c.cwnd = c.smss
+	} else {
+		c.cwnd = c.ssthresh
+	}
+}
+
+// initialWindow returns the initial congestion window for a given SMSS. See RFC 5681 section 3.1.
+func initialWindow(smss Size) Size {
+	switch {
+	case smss > 2190:
+		return 2 * smss
+	case smss > 1095:
+		return 3 * smss
+	default:
+		return 4 * smss
+	}
+}
+
+func minSize(a, b Size) Size {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func maxSize(a, b Size) Size {
+	if a > b {
+		return a
+	}
+	return b
+}
@@ -6,23 +6,32 @@ import (
 	"io"
 	"log/slog"
 	"math"
+	"time"
 )
 
 const (
 	rstJump = 100
+	// MaxWindowShift is the maximum window scale shift count. See RFC 7323 section 2.3.
+	MaxWindowShift = 14
+	// MaxWindow is the largest window that can be represented with window scaling.
+	MaxWindow Size = math.MaxUint16 << MaxWindowShift
 )
 
 var (
 	// errDropSegment is a flag that signals to drop a segment silently.
 	errDropSegment    = errors.New("drop segment")
 	errWindowTooLarge = errors.New("invalid window size > 2**16")
+	errRecvWindowMax  = errors.New("receive window exceeds maximum scaled window")
+	errWindowShift    = errors.New("window scale shift count > 14")
+	errConnReset      = errors.New("connection reset by remote")
 )
 
 // ControlBlock is a partial Transmission Control Block (TCB) implementation as per RFC 9293
-// in page 19 and clarified further in page 25. This implementation is limited to
-// receiving only sequential segments. This means buffer management is left up
-// entirely to the user of the ControlBlock. Use ControlBlock as the building block
-// that solves Sequence Number calculation and validation in a full TCP implementation.
+// in page 19 and clarified further in page 25. By default this implementation is limited to
+// receiving only sequential segments, see [ControlBlock.SetReassembly] to admit
+// out-of-order segments. Buffer management is left up entirely to the user of the ControlBlock.
+// Use ControlBlock as the building block that solves Sequence Number calculation
+// and validation in a full TCP implementation.
 //
 // A ControlBlock's internal state is modified by the available "System Calls" as defined in
 // RFC9293, such as Close, Listen/Open, Send, and Receive.
@@ -59,8 +68,42 @@ type ControlBlock struct {
 	// On a call to Send the queue is advanced and flags set in the segment are unset.
 	// The second position of the queue is used for FIN segments.
 	pending [2]Flags
-	state   State
-	log     *slog.Logger
+	// held contains the sequence space of out-of-order data received ahead of RCV.NXT.
+	// Only used when reassembly is enabled.
+	held       heldRanges
+	reassembly bool
+	// Congestion control and loss recovery state. See RFC 5681 and RFC 6582.
+	cc         CongestionControl
+	smss       Size  // Sender maximum segment size. If zero DefaultMSS is used.
+	recover    Value // SND.NXT when loss was last detected.
+	inflation  Size  // Congestion window inflation during fast recovery.
+	dupacks    uint8 // Consecutive duplicate ACKs received.
+	recovering bool  // Set during fast recovery.
+	fastRtx    bool  // Set when SND.UNA must be retransmitted without waiting for the retransmission timer.
+	// now is the time set by the caller with SetTime, passed to congestion control.
+	now time.Time
+	// Window scale shift counts. See RFC 7323 section 2. Windows of segments without
+	// SYN are scaled by these shift counts once window scaling is enabled.
+	sndShift uint8 // Applied to windows received from remote.
+	rcvShift uint8 // Applied to windows sent to remote.
+	wscale   bool  // Set when window scaling was negotiated.
+	// Selective acknowledgement state. See RFC 2018 and RFC 6675.
+	sackOK   bool       // Set when SACK was negotiated.
+	sacked   heldRanges // Sequence space above SND.UNA selectively acknowledged by remote.
+	lastHeld Value      // Sequence number of last out-of-order segment received.
+	rtxHigh  Value      // Highest sequence number retransmitted during fast recovery.
+	// Timestamps state. See RFC 7323 section 4.3.
+	tsOK        bool   // Set when timestamps were negotiated.
+	tsRecent    uint32 // TS.Recent: timestamp to be echoed in next segment sent.
+	lastACKSent Value  // Last.ACK.sent: ACK field of last segment sent.
+	// Delayed acknowledgement state. See RFC 1122 section 4.2.3.2.
+	delayACK   bool // Set when delayed acknowledgements are enabled.
+	ackDelayed bool // Set when received data has not yet been acknowledged.
+	// Silly window syndrome avoidance state. See RFC 9293 section 3.8.6.2.
+	rcvBuff   Size // RCV.BUFF: Size of the receive buffer as passed to Open.
+	maxSndWnd Size // Max(SND.WND): Largest send window advertised by remote.
+	state     State
+	log       *slog.Logger
 }
 
 // sendSpace contains Send Sequence Space data. Its sequence numbers correspond to local data.
@@ -87,6 +130,13 @@ type Segment struct {
 	DATALEN Size  // The number of octets occupied by the data (payload) not counting SYN and FIN.
 	WND     Size  // segment window
 	Flags   Flags // TCP flags.
+	// SACK contains NumSACK selective acknowledgement blocks. See RFC 2018.
+	SACK    [MaxSACKBlocks]SACKBlock
+	NumSACK uint8
+	// TSVal and TSEcr are the timestamp value and timestamp echo reply. See RFC 7323.
+	TSVal         uint32
+	TSEcr         uint32
+	HasTimestamps bool
 }
 
 // LEN returns the length of the segment in octets including SYN and FIN flags.
@@ -113,12 +163,18 @@ func (tcb *ControlBlock) PendingSegment(payloadLen int) (_ Segment, ok bool) {
 	if !established {
 		payloadLen = 0 // Can't send data if not established.
 	}
+	if payloadLen > math.MaxUint16 {
+		payloadLen = math.MaxUint16
+	}
+	if usable := tcb.usableWindow(); Size(payloadLen) > usable {
+		payloadLen = int(usable)
+		if tcb.sillyWindow(usable) {
+			payloadLen = 0 // Wait for the window to open further.
+		}
+	}
 	if pending == 0 && payloadLen == 0 {
 		return Segment{}, false // No pending segment.
 	}
-	if payloadLen > math.MaxUint16 || Size(payloadLen) > tcb.snd.WND {
-		payloadLen = int(tcb.snd.WND)
-	}
 
 	if established {
 		pending |= FlagACK // ACK is always set in established state. Not in RFC9293 but somehow expected?
@@ -140,13 +196,99 @@ func (tcb *ControlBlock) PendingSegment(payloadLen int) (_ Segment, ok bool) {
 	seg := Segment{
 		SEQ:     seq,
 		ACK:     ack,
-		WND:     tcb.rcv.WND,
+		WND:     tcb.segmentWindow(pending),
 		Flags:   pending,
 		DATALEN: Size(payloadLen),
 	}
+	tcb.putSACK(&seg)
+	tcb.putTimestamps(&seg)
+	return seg, true
+}
+
+// RetransmitSegment calculates a segment that retransmits unacknowledged sequence space
+// starting at seq with at most payloadLen octets of data. seq must be in the range [SND.UNA, SND.NXT).
+// SYN and FIN flags are set if the segment covers their sequence numbers. The segment
+// does not extend into sequence space selectively acknowledged by the remote.
+// It does not modify the ControlBlock state or pending segment queue.
+func (tcb *ControlBlock) RetransmitSegment(seq Value, payloadLen int) (_ Segment, ok bool) {
+	if !InRange(seq, tcb.snd.UNA, tcb.snd.NXT) {
+		return Segment{}, false // Nothing to retransmit at seq.
+	}
+	var flags Flags
+	if tcb.hasIRS() {
+		flags = FlagACK
+	}
+	if seq == tcb.snd.ISS && tcb.state.IsPreestablished() {
+		// Unacknowledged SYN. We never send data along with SYN.
+		seg := Segment{
+			SEQ:   seq,
+			ACK:   tcb.rcv.NXT,
+			WND:   tcb.segmentWindow(flags | FlagSYN),
+			Flags: flags | FlagSYN,
+		}
+		tcb.putTimestamps(&seg)
+		return seg, true
+	}
+	dataEnd := tcb.snd.NXT
+	if tcb.finSent() {
+		dataEnd-- // FIN occupies the last sequence number.
+	}
+	datalen := Sizeof(seq, dataEnd)
+	if Size(payloadLen) < datalen {
+		datalen = Size(payloadLen)
+	}
+	if sacked, ok := tcb.sacked.nextStart(seq); ok && LessThan(sacked, Add(seq, datalen)) {
+		datalen = Sizeof(seq, sacked)
+	}
+	if datalen > 0 {
+		flags |= FlagPSH
+	}
+	if tcb.finSent() && Add(seq, datalen) == dataEnd {
+		flags |= FlagFIN
+	}
+	seg := Segment{
+		SEQ:     seq,
+		ACK:     tcb.rcv.NXT,
+		WND:     tcb.segmentWindow(flags),
+		Flags:   flags,
+		DATALEN: datalen,
+	}
+	tcb.putSACK(&seg)
+	tcb.putTimestamps(&seg)
+	return seg, true
+}
+
+// KeepaliveSegment returns a keepalive probe for an idle connection. The probe
+// carries the sequence number SND.NXT-1 which is outside of the remote's receive
+// window and elicits an acknowledgement. See RFC 9293 section 3.8.4.
+// The returned segment occupies no sequence space and must not be passed to Send.
+func (tcb *ControlBlock) KeepaliveSegment() (_ Segment, ok bool) {
+	if tcb.state != StateEstablished && tcb.state != StateCloseWait {
+		return Segment{}, false
+	}
+	seg := Segment{
+		SEQ:   tcb.snd.NXT - 1,
+		ACK:   tcb.rcv.NXT,
+		WND:   tcb.segmentWindow(FlagACK),
+		Flags: FlagACK,
+	}
+	tcb.putTimestamps(&seg)
 	return seg, true
 }
 
+// WindowProbeSegment returns a zero window probe when the remote has advertised a zero
+// receive window and there is no data in flight. Like a keepalive probe it carries the
+// sequence number SND.NXT-1 which elicits an acknowledgement with the remote's current
+// window so that a lost window update does not deadlock the connection. The caller is
+// responsible for the persist timer. See RFC 9293 section 3.8.6.1.
+// The returned segment occupies no sequence space and must not be passed to Send.
+func (tcb *ControlBlock) WindowProbeSegment() (_ Segment, ok bool) {
+	if tcb.snd.WND != 0 || tcb.snd.UNA != tcb.snd.NXT {
+		return Segment{}, false
+	}
+	return tcb.KeepaliveSegment()
+}
+
 // HasPending returns true if there is a pending control segment to send. Calls to Send will advance the pending queue.
 func (tcb *ControlBlock) HasPending() bool { return tcb.pending[0] != 0 }
 
@@ -213,6 +355,10 @@ func (tcb *ControlBlock) rcvSynRcvd(seg Segment) (pending Flags, err error) {
 func (tcb *ControlBlock) rcvEstablished(seg Segment) (pending Flags, err error) {
 	flags := seg.Flags
 	pending = FlagACK
+	if tcb.delayACK && !flags.HasAny(FlagFIN) && tcb.canDelayACK(seg) {
+		pending = tcb.pending[0] // Keep ACKs that must be sent, i.e: to unacceptable segments.
+		tcb.ackDelayed = tcb.ackDelayed || seg.DATALEN > 0
+	}
 	if flags.HasAny(FlagFIN) {
 		// See Figure 5: TCP Connection State Diagram of RFC 9293.
 		tcb.state = StateCloseWait
@@ -221,6 +367,17 @@ func (tcb *ControlBlock) rcvEstablished(seg Segment) (pending Flags, err error)
 	return pending, nil
 }
 
+// canDelayACK checks if the acknowledgement of an in-order segment may be delayed. Segments
+// that occupy no sequence space are never acknowledged. An ACK is sent for at least every second
+// full-sized segment and immediately for segments that fill a gap. See RFC 5681 section 4.2.
+func (tcb *ControlBlock) canDelayACK(seg Segment) bool {
+	if seg.DATALEN == 0 {
+		return true
+	}
+	unacked := Sizeof(tcb.lastACKSent, Add(seg.SEQ, seg.DATALEN))
+	return tcb.held.n == 0 && unacked < 2*tcb.mss()
+}
+
 func (tcb *ControlBlock) rcvFinWait1(seg Segment) (pending Flags, err error) {
 	flags := seg.Flags
 	if !flags.HasAny(FlagACK) {
@@ -242,6 +399,15 @@ func (tcb *ControlBlock) rcvFinWait2(seg Segment) (pending Flags, err error) {
 	return FlagACK, nil
 }
 
+// rcvTimeWait acknowledges a retransmission of the remote's FIN. No other segment is
+// expected in TIME-WAIT so the segment is dropped. See RFC 9293 section 3.10.7.4.
+func (tcb *ControlBlock) rcvTimeWait(seg Segment) (pending Flags, err error) {
+	if seg.Flags.HasAny(FlagFIN) {
+		tcb.pending[0] |= FlagACK
+	}
+	return 0, errDropSegment
+}
+
 func (tcb *ControlBlock) resetSnd(localISS Value, remoteWND Size) {
 	tcb.snd = sendSpace{
 		ISS: localISS,
@@ -258,6 +424,37 @@ func (tcb *ControlBlock) resetRcv(localWND Size, remoteISS Value) {
 		NXT: remoteISS,
 		WND: localWND,
 	}
+	tcb.held.reset()
+}
+
+// canHold checks if an out-of-order segment can be admitted and held for reassembly.
+// Only data segments without SYN, FIN or RST flags set are held.
+func (tcb *ControlBlock) canHold(seg Segment) bool {
+	receivesData := tcb.state == StateEstablished || tcb.state == StateFinWait1 || tcb.state == StateFinWait2
+	return tcb.reassembly && receivesData && seg.DATALEN > 0 &&
+		!seg.Flags.HasAny(FlagSYN|FlagFIN|FlagRST) &&
+		tcb.held.canAdd(seg.SEQ, Add(seg.SEQ, seg.DATALEN))
+}
+
+// rcvOutOfOrder holds the sequence space of an out-of-order data segment and queues
+// an immediate duplicate ACK so the remote learns of the missing data (see RFC 5681 section 4.2).
+func (tcb *ControlBlock) rcvOutOfOrder(seg Segment) error {
+	tcb.held.add(seg.SEQ, Add(seg.SEQ, seg.DATALEN))
+	tcb.lastHeld = seg.SEQ
+	tcb.pending[0] |= FlagACK
+	if seg.Flags.HasAny(FlagACK) && LessThan(tcb.snd.UNA, seg.ACK) && LessThanEq(seg.ACK, tcb.snd.NXT) {
+		tcb.rcvAck(seg.ACK)
+		tcb.snd.UNA = seg.ACK
+		tcb.sacked.trim(seg.ACK)
+	}
+	tcb.rcvSACK(seg)
+	tcb.updateSendWindow(tcb.remoteWindow(seg))
+	if tcb.logenabled(slog.LevelDebug) {
+		tcb.debug("rcv:out-of-order", slog.String("state", tcb.state.String()),
+			slog.Uint64("seg.seq", uint64(seg.SEQ)), slog.Uint64("rcv.nxt", uint64(tcb.rcv.NXT)),
+			slog.Int("held", int(tcb.held.n)))
+	}
+	return nil
 }
 
 func (tcb *ControlBlock) validateIncomingSegment(seg Segment) (err error) {
@@ -269,7 +466,9 @@ func (tcb *ControlBlock) validateIncomingSegment(seg Segment) (err error) {
 	preestablished := tcb.state.IsPreestablished()
 	acksOld := hasAck && !LessThan(tcb.snd.UNA, seg.ACK)
 	acksUnsentData := hasAck && !LessThanEq(seg.ACK, tcb.snd.NXT)
-	ctlOrDataSegment := established && flags.HasAny(FlagFIN|FlagRST|FlagPSH)
+	ctlOrDataSegment := established && (seg.DATALEN > 0 || flags.HasAny(FlagFIN|FlagRST|FlagPSH))
+	// Empty segments are acceptable on a zero receive window. See RFC 9293 section 3.10.7.4.
+	zeroWindowAck := tcb.rcv.WND == 0 && seg.LEN() == 0 && seg.SEQ == tcb.rcv.NXT
 	// See section 3.4 of RFC 9293 for more on these checks.
 	switch {
 	case seg.WND > math.MaxUint16:
@@ -277,23 +476,49 @@ func (tcb *ControlBlock) validateIncomingSegment(seg Segment) (err error) {
 	case tcb.state == StateClosed:
 		err = io.ErrClosedPipe
 
-	case checkSEQ && !InWindow(seg.SEQ, tcb.rcv.NXT, tcb.rcv.WND):
+	case checkSEQ && !zeroWindowAck && !InWindow(seg.SEQ, tcb.rcv.NXT, tcb.rcv.WND):
 		err = errSeqNotInWindow
 
-	case checkSEQ && !InWindow(seg.Last(), tcb.rcv.NXT, tcb.rcv.WND):
+	case checkSEQ && !zeroWindowAck && !InWindow(seg.Last(), tcb.rcv.NXT, tcb.rcv.WND):
 		err = errLastNotInWindow
 
-	case checkSEQ && seg.SEQ != tcb.rcv.NXT:
-		// This part diverts from TCB as described in RFC 9293. We want to support
-		// only sequential segments to keep implementation simple and maintainable.
+	case checkSEQ && seg.SEQ != tcb.rcv.NXT && !flags.HasAny(FlagRST) && !tcb.canHold(seg):
+		// This part diverts from TCB as described in RFC 9293. Unless reassembly is enabled
+		// we support only sequential segments to keep implementation simple and maintainable.
 		err = errRequireSequential
 	}
+	if err == nil && checkSEQ {
+		err = tcb.rejectOld(seg)
+		if err == errPAWS {
+			tcb.pending[0] |= FlagACK // Acknowledge old duplicate, see RFC 7323 section 5.3.
+		}
+	}
+	if (err == errSeqNotInWindow || err == errLastNotInWindow) && !preestablished && !flags.HasAny(FlagRST) {
+		// Unacceptable segments are acknowledged, which also answers keepalive probes. See RFC 9293 section 3.10.7.4.
+		tcb.pending[0] |= FlagACK
+	}
 	if err != nil {
 		return err
 	}
 	isDebug := tcb.logenabled(slog.LevelDebug)
 	// Drop-segment checks.
 	switch {
+	// RST in synchronized states only resets the connection if it matches RCV.NXT exactly,
+	// other in-window RSTs are answered with a challenge ACK. See RFC 5961 section 3.2.
+	case !preestablished && flags.HasAny(FlagRST) && seg.SEQ != tcb.rcv.NXT:
+		err = errDropSegment
+		tcb.pending[0] |= FlagACK
+		if isDebug {
+			tcb.debug("rcv:RST-challenge", slog.String("state", tcb.state.String()), slog.Uint64("seg.seq", uint64(seg.SEQ)))
+		}
+
+	case !preestablished && flags.HasAny(FlagRST):
+		err = errConnReset
+		if isDebug {
+			tcb.debug("rcv:RST-reset", slog.String("state", tcb.state.String()))
+		}
+		tcb.close()
+
 	// Special treatment of duplicate ACKs on established connection and of ACKs of unsent data.
 	// https://www.rfc-editor.org/rfc/rfc9293.html#section-3.10.7.4-2.5.2.2.2.3.2.1
 	case established && acksOld && !ctlOrDataSegment:
@@ -303,6 +528,14 @@ func (tcb *ControlBlock) validateIncomingSegment(seg Segment) (err error) {
 			tcb.debug("rcv:ACK-dup", slog.String("state", tcb.state.String()),
 				slog.Uint64("seg.ack", uint64(seg.ACK)), slog.Uint64("snd.una", uint64(tcb.snd.UNA)))
 		}
+		if seg.ACK == tcb.snd.UNA && seg.SEQ == tcb.rcv.NXT && tcb.remoteWindow(seg) != tcb.snd.WND {
+			// Window update, i.e: reply to a zero window probe or a reopened window.
+			tcb.updateSendWindow(tcb.remoteWindow(seg))
+		} else if seg.ACK == tcb.snd.UNA && tcb.remoteWindow(seg) == tcb.snd.WND && tcb.snd.UNA != tcb.snd.NXT {
+			// Duplicate ACK as defined in RFC 5681 section 2 signals possible loss.
+			tcb.rcvSACK(seg)
+			tcb.rcvDupAck()
+		}
 
 	case established && acksUnsentData:
 		err = errDropSegment
@@ -316,7 +549,7 @@ func (tcb *ControlBlock) validateIncomingSegment(seg Segment) (err error) {
 		err = errDropSegment
 		tcb.pending[0] = FlagRST
 		tcb.rstPtr = seg.ACK
-		tcb.resetSnd(tcb.snd.ISS, seg.WND)
+		tcb.resetSnd(tcb.snd.ISS, tcb.remoteWindow(seg))
 		if isDebug {
 			tcb.debug("rcv:RST-old", slog.String("state", tcb.state.String()), slog.Uint64("ack", uint64(seg.ACK)))
 		}
@@ -336,7 +569,8 @@ func (tcb *ControlBlock) validateIncomingSegment(seg Segment) (err error) {
 
 func (tcb *ControlBlock) validateOutgoingSegment(seg Segment) (err error) {
 	hasAck := seg.Flags.HasAny(FlagACK)
-	checkSeq := !seg.Flags.HasAny(FlagRST)
+	// Empty segments such as ACKs may be sent on a zero send window.
+	checkSeq := !seg.Flags.HasAny(FlagRST) && !tcb.isRetransmission(seg) && (seg.LEN() > 0 || seg.SEQ != tcb.snd.NXT)
 	seglast := seg.Last()
 	switch {
 	case tcb.state == StateClosed:
@@ -346,6 +580,9 @@ func (tcb *ControlBlock) validateOutgoingSegment(seg Segment) (err error) {
 	case hasAck && seg.ACK != tcb.rcv.NXT:
 		err = errAckNotNext
 
+	case !checkSeq && seg.LEN() > 0 && !InRange(seglast, tcb.snd.UNA, tcb.snd.NXT):
+		err = errLastNotInWindow
+
 	case checkSeq && !InWindow(seg.SEQ, tcb.snd.NXT, tcb.snd.WND):
 		err = errSeqNotInWindow
 
@@ -355,15 +592,180 @@ func (tcb *ControlBlock) validateOutgoingSegment(seg Segment) (err error) {
 	return err
 }
 
+// rcvDupAck processes a duplicate ACK. On the third duplicate ACK the first unacknowledged
+// segment is flagged for fast retransmit and fast recovery is entered. See RFC 5681 section 3.2.
+func (tcb *ControlBlock) rcvDupAck() {
+	if tcb.dupacks < math.MaxUint8 {
+		tcb.dupacks++
+	}
+	switch {
+	case tcb.recovering:
+		tcb.inflation += tcb.mss() // Each duplicate ACK signals a segment left the network.
+
+	case tcb.dupacks == 3 && LessThanEq(tcb.recover, tcb.snd.UNA):
+		// RFC 6582: Only enter fast recovery if loss is not part of a previous recovery.
+		flight := Sizeof(tcb.snd.UNA, tcb.snd.NXT)
+		tcb.recover = tcb.snd.NXT
+		tcb.recovering = true
+		tcb.fastRtx = true
+		tcb.rtxHigh = tcb.snd.UNA
+		tcb.inflation = 3 * tcb.mss()
+		if tcb.cc != nil {
+			tcb.cc.OnLoss(flight, false)
+		}
+		tcb.debug("rcv:fast-retransmit", slog.Uint64("snd.una", uint64(tcb.snd.UNA)), slog.Uint64("flight", uint64(flight)))
+	}
+}
+
+// rcvAck processes an ACK that acknowledges new data up to ack. During fast recovery
+// a partial acknowledgement flags the next unacknowledged segment for retransmission
+// as described in RFC 6582 section 3.2.
+func (tcb *ControlBlock) rcvAck(ack Value) {
+	acked := Sizeof(tcb.snd.UNA, ack)
+	tcb.dupacks = 0
+	switch {
+	case !tcb.recovering:
+		if tcb.cc != nil {
+			tcb.cc.OnAck(tcb.now, acked)
+		}
+
+	case LessThan(ack, tcb.recover):
+		// Partial acknowledgement. Deflate window by amount of data acknowledged
+		// and add back one segment if at least one segment's worth was acknowledged.
+		// With SACK the next unacknowledged segment may have already been retransmitted.
+		tcb.fastRtx = !tcb.sackOK || LessThanEq(tcb.rtxHigh, ack)
+		if acked > tcb.inflation {
+			tcb.inflation = 0
+		} else {
+			tcb.inflation -= acked
+		}
+		if acked >= tcb.mss() {
+			tcb.inflation += tcb.mss()
+		}
+
+	default:
+		// Full acknowledgement, exit fast recovery.
+		tcb.recovering = false
+		tcb.fastRtx = false
+		tcb.inflation = 0
+	}
+}
+
+// remoteWindow returns the window advertised by the remote in seg scaled by the
+// send window shift count. Windows of SYN segments are never scaled.
+func (tcb *ControlBlock) remoteWindow(seg Segment) Size {
+	if !tcb.wscale || seg.Flags.HasAny(FlagSYN) {
+		return seg.WND
+	}
+	return seg.WND << tcb.sndShift
+}
+
+// localWindow returns the receive window advertised in an outgoing segment with
+// window field wnd and flags as it is interpreted by the remote.
+func (tcb *ControlBlock) localWindow(wnd Size, flags Flags) Size {
+	if !tcb.wscale || flags.HasAny(FlagSYN) {
+		return wnd
+	}
+	return wnd << tcb.rcvShift
+}
+
+// segmentWindow returns the window field of an outgoing segment with flags set
+// which advertises the receive window. See RFC 7323 section 2.3.
+func (tcb *ControlBlock) segmentWindow(flags Flags) Size {
+	wnd := tcb.rcv.WND
+	if tcb.wscale && !flags.HasAny(FlagSYN) {
+		wnd >>= tcb.rcvShift
+	}
+	return minSize(wnd, math.MaxUint16)
+}
+
+// resetCongestion resets congestion control and loss recovery state at the start of a connection.
+func (tcb *ControlBlock) resetCongestion() {
+	tcb.recover = tcb.snd.ISS
+	tcb.inflation = 0
+	tcb.dupacks = 0
+	tcb.recovering = false
+	tcb.fastRtx = false
+	if tcb.cc != nil {
+		tcb.cc.Init(tcb.mss())
+	}
+}
+
+// sendWindow returns the smaller of the remote's receive window and the congestion window.
+func (tcb *ControlBlock) sendWindow() Size {
+	wnd := tcb.snd.WND
+	if tcb.cc != nil {
+		wnd = minSize(wnd, tcb.cc.Window()+tcb.inflation)
+	}
+	return wnd
+}
+
+// sillyWindow implements sender-side silly window syndrome avoidance. A segment that is
+// limited by a usable window smaller than a full-sized segment and half of the largest
+// window advertised by remote is not sent while data is in flight since the acknowledgement
+// of that data will open the window. See RFC 9293 section 3.8.6.2.1.
+func (tcb *ControlBlock) sillyWindow(usable Size) bool {
+	return usable < tcb.mss() && usable < tcb.maxSndWnd/2 && tcb.snd.UNA != tcb.snd.NXT
+}
+
+// updateSendWindow sets SND.WND and keeps track of the largest window advertised by remote.
+func (tcb *ControlBlock) updateSendWindow(wnd Size) {
+	tcb.snd.WND = wnd
+	if wnd > tcb.maxSndWnd {
+		tcb.maxSndWnd = wnd
+	}
+}
+
+// usableWindow returns the amount of new data that may be sent.
+// See RFC 9293 section 3.8.6.2.1.
+func (tcb *ControlBlock) usableWindow() Size {
+	wnd := tcb.sendWindow()
+	inFlight := Sizeof(tcb.snd.UNA, tcb.snd.NXT)
+	if inFlight >= wnd {
+		return 0
+	}
+	return wnd - inFlight
+}
+
+func (tcb *ControlBlock) mss() Size {
+	if tcb.smss == 0 {
+		return DefaultMSS
+	}
+	return tcb.smss
+}
+
+// isRetransmission checks if the segment occupies sequence space that has already been sent.
+func (tcb *ControlBlock) isRetransmission(seg Segment) bool {
+	return seg.LEN() > 0 && InRange(seg.SEQ, tcb.snd.UNA, tcb.snd.NXT)
+}
+
+// finSent checks if a FIN has been sent and occupies the last sent sequence number.
+func (tcb *ControlBlock) finSent() bool {
+	return tcb.state == StateFinWait1 || tcb.state == StateClosing || tcb.state == StateLastAck
+}
+
 // close sets ControlBlock state to closed and resets all sequence numbers and pending flag.
 func (tcb *ControlBlock) close() {
 	tcb.state = StateClosed
 	tcb.pending = [2]Flags{}
+	tcb.resetOptions()
 	tcb.resetRcv(0, 0)
 	tcb.resetSnd(0, 0)
 	tcb.debug("close tcb")
 }
 
+// resetOptions disables options negotiated during the handshake.
+func (tcb *ControlBlock) resetOptions() {
+	tcb.sndShift = 0
+	tcb.rcvShift = 0
+	tcb.wscale = false
+	tcb.sackOK = false
+	tcb.sacked.reset()
+	tcb.tsOK = false
+	tcb.tsRecent = 0
+	tcb.lastACKSent = 0
+}
+
 // hasIRS checks if the ControlBlock has received a valid initial sequence number (IRS).
 func (tcb *ControlBlock) hasIRS() bool {
 	return tcb.isOpen() && tcb.state != StateSynSent && tcb.state != StateListen
@@ -3,7 +3,7 @@ package seqs
 import (
 	"errors"
 	"log/slog"
-	"math"
+	"time"
 )
 
 // Functions in this file correspond loosely to the API described in
@@ -26,6 +26,8 @@ var (
 	errLastNotInWindow   = newRejectErr("last not in snd/rcv.wnd")
 	errRequireSequential = newRejectErr("seq != rcv.nxt (require sequential segments)")
 	errAckNotNext        = newRejectErr("ack != snd.nxt")
+	errNoTimestamps      = newRejectErr("missing timestamps option")
+	errPAWS              = newRejectErr("seg.tsval < ts.recent (PAWS)")
 )
 
 func newRejectErr(err string) *rejectErr { return &rejectErr{err: err} }
@@ -47,19 +49,24 @@ func (tcb *ControlBlock) Open(iss Value, wnd Size, state State) (err error) {
 		err = errTCBNotClosed
 	case state != StateListen && state != StateSynSent:
 		err = errInvalidState
-	case wnd > math.MaxUint16:
-		err = errWindowTooLarge
+	case wnd > MaxWindow:
+		err = errRecvWindowMax
 	}
 	if err != nil {
 		return err
 	}
 	tcb.state = state
+	tcb.ackDelayed = false
+	tcb.rcvBuff = wnd
+	tcb.maxSndWnd = 0
+	tcb.resetOptions()
 	tcb.resetRcv(wnd, 0)
 	tcb.resetSnd(iss, 1)
 	tcb.pending = [2]Flags{}
 	if state == StateSynSent {
 		tcb.pending[0] = FlagSYN
 	}
+	tcb.resetCongestion()
 	return nil
 }
 
@@ -70,7 +77,7 @@ func (tcb *ControlBlock) Close() (err error) {
 		err = errConnNotexist
 	case StateCloseWait:
 		tcb.state = StateLastAck
-		tcb.pending = [2]Flags{FlagFIN, FlagACK}
+		tcb.pending = [2]Flags{finack, 0}
 	case StateListen, StateSynSent:
 		tcb.close()
 	case StateSynRcvd, StateEstablished:
@@ -84,12 +91,32 @@ func (tcb *ControlBlock) Close() (err error) {
 }
 
 // Send processes a segment that is being sent to the network. It updates the TCB
-// if there is no error.
+// if there is no error. Segments that retransmit already sent sequence space,
+// such as those returned by [ControlBlock.RetransmitSegment], do not modify the
+// connection state and only consume the pending ACK.
 func (tcb *ControlBlock) Send(seg Segment) error {
 	err := tcb.validateOutgoingSegment(seg)
 	if err != nil {
 		return err
 	}
+	if seg.Flags.HasAny(FlagACK) {
+		tcb.lastACKSent = seg.ACK
+		tcb.ackDelayed = false
+	}
+	if tcb.isRetransmission(seg) {
+		if seg.SEQ == tcb.snd.UNA {
+			tcb.fastRtx = false
+		}
+		if end := Add(seg.SEQ, seg.LEN()); tcb.recovering && LessThan(tcb.rtxHigh, end) {
+			tcb.rtxHigh = end
+		}
+		tcb.pending[0] &^= FlagACK
+		if tcb.pending[0] == 0 {
+			tcb.pending = [2]Flags{tcb.pending[1], 0}
+		}
+		tcb.rcv.WND = tcb.localWindow(seg.WND, seg.Flags)
+		return nil
+	}
 
 	hasFIN := seg.Flags.HasAny(FlagFIN)
 	hasACK := seg.Flags.HasAny(FlagACK)
@@ -125,21 +152,32 @@ func (tcb *ControlBlock) Send(seg Segment) error {
 	// The segment is valid, we can update TCB state.
 	seglen := seg.LEN()
 	tcb.snd.NXT.UpdateForward(seglen)
-	tcb.rcv.WND = seg.WND
+	tcb.rcv.WND = tcb.localWindow(seg.WND, seg.Flags)
 	return nil
 }
 
 // Recv processes a segment that is being received from the network. It updates the TCB
-// if there is no error. The ControlBlock can only receive segments that are the next
-// expected sequence number which means the caller must handle the out-of-order case
-// and buffering that comes with it.
+// if there is no error. Unless reassembly is enabled the ControlBlock can only receive
+// segments that are the next expected sequence number which means the caller must handle
+// the out-of-order case and buffering that comes with it.
+//
+// When reassembly is enabled an admitted segment with SEQ != RecvNext() is out-of-order
+// and its payload must be buffered by the caller at offset Sizeof(RecvNext(), seg.SEQ).
+// Once the missing data arrives RecvNext advances over all contiguous data received.
 func (tcb *ControlBlock) Recv(seg Segment) (err error) {
 	err = tcb.validateIncomingSegment(seg)
 	if err != nil {
 		return err
 	}
+	if !seg.Flags.HasAny(FlagSYN) && seg.SEQ != tcb.rcv.NXT {
+		// Validation only admits out-of-order segments that can be held.
+		return tcb.rcvOutOfOrder(seg)
+	}
 
 	prevNxt := tcb.snd.NXT
+	if seg.Flags.HasAny(FlagACK) && !tcb.state.IsPreestablished() && LessThan(tcb.snd.UNA, seg.ACK) {
+		tcb.rcvAck(seg.ACK)
+	}
 	var pending Flags
 	switch tcb.state {
 	case StateListen:
@@ -156,9 +194,11 @@ func (tcb *ControlBlock) Recv(seg Segment) (err error) {
 		pending, err = tcb.rcvFinWait2(seg)
 	case StateCloseWait:
 	case StateLastAck:
-		if seg.Flags.HasAny(FlagACK) {
-			tcb.close()
+		if seg.Flags.HasAny(FlagACK) && seg.ACK == tcb.snd.NXT {
+			tcb.close() // Our FIN was acknowledged. See RFC 9293 section 3.10.7.4.
 		}
+	case StateTimeWait:
+		pending, err = tcb.rcvTimeWait(seg)
 	default:
 		panic("unexpected state" + tcb.state.String())
 	}
@@ -174,20 +214,34 @@ func (tcb *ControlBlock) Recv(seg Segment) (err error) {
 	}
 
 	// We accept the segment and update TCB state.
-	tcb.snd.WND = seg.WND
+	tcb.rcvTimestamps(seg)
+	tcb.updateSendWindow(tcb.remoteWindow(seg))
 	if seg.Flags.HasAny(FlagACK) {
 		tcb.snd.UNA = seg.ACK
+		tcb.sacked.trim(seg.ACK)
+		tcb.rcvSACK(seg)
 	}
 	seglen := seg.LEN()
 	tcb.rcv.NXT.UpdateForward(seglen)
+	if tcb.held.n > 0 {
+		// Segment may have filled a gap, advance over contiguous held data.
+		tcb.rcv.NXT = tcb.held.advance(tcb.rcv.NXT)
+	}
 	return err
 }
 
 // RecvNext returns the next sequence number expected to be received from remote.
-// This implementation will reject segments that are not the next expected sequence.
+// Unless reassembly is enabled this implementation will reject segments that are not the next expected sequence.
 // RecvNext returns 0 before StateSynRcvd.
 func (tcb *ControlBlock) RecvNext() Value { return tcb.rcv.NXT }
 
+// SendNext returns the next sequence number to be sent to the remote (SND.NXT).
+func (tcb *ControlBlock) SendNext() Value { return tcb.snd.NXT }
+
+// SendUNA returns the oldest unacknowledged sequence number (SND.UNA). Sequence space in
+// the range [SendUNA(), SendNext()) has been sent but not yet acknowledged by remote.
+func (tcb *ControlBlock) SendUNA() Value { return tcb.snd.UNA }
+
 // RecvWindow returns the receive window size. If connection is closed will return 0.
 func (tcb *ControlBlock) RecvWindow() Size { return tcb.rcv.WND }
 
@@ -201,14 +255,135 @@ func (tcb *ControlBlock) MaxInFlightData() Size {
 		return 0 // SYN not yet received.
 	}
 	unacked := Sizeof(tcb.snd.UNA, tcb.snd.NXT)
-	return tcb.snd.WND - unacked - 1 // TODO: is this -1 supposed to be here?
+	return tcb.sendWindow() - unacked - 1 // TODO: is this -1 supposed to be here?
+}
+
+// SetCongestionControl sets the congestion control algorithm which limits the amount of
+// data in flight in addition to the remote's receive window. A nil cc disables congestion control.
+// It should be called before data is exchanged since the algorithm state is reset.
+func (tcb *ControlBlock) SetCongestionControl(cc CongestionControl) {
+	tcb.cc = cc
+	if cc != nil {
+		cc.Init(tcb.mss())
+	}
+}
+
+// SetTime sets the current time passed to congestion control when new data is acknowledged.
+// The ControlBlock has no clock so time based algorithms such as [Cubic] require the caller
+// to set the time before each call to Recv. If the time is never set Cubic grows its window as Reno.
+func (tcb *ControlBlock) SetTime(now time.Time) { tcb.now = now }
+
+// SetMaxSegmentSize sets the sender maximum segment size (SMSS) used by congestion control.
+// If not set [DefaultMSS] is used.
+func (tcb *ControlBlock) SetMaxSegmentSize(mss Size) {
+	tcb.smss = mss
+	if tcb.cc != nil {
+		tcb.cc.Init(tcb.mss())
+	}
+}
+
+// MaxSegmentSize returns the sender maximum segment size.
+func (tcb *ControlBlock) MaxSegmentSize() Size { return tcb.mss() }
+
+// PendingRetransmit returns the sequence number of a segment that must be retransmitted
+// immediately due to fast retransmit or a partial acknowledgement during fast recovery.
+// The flag is cleared once a segment starting at seq is sent, see [ControlBlock.RetransmitSegment].
+// When SACK is enabled the holes below selectively acknowledged data are also retransmitted
+// during fast recovery.
+func (tcb *ControlBlock) PendingRetransmit() (seq Value, ok bool) {
+	if tcb.snd.UNA == tcb.snd.NXT {
+		return 0, false
+	} else if tcb.fastRtx {
+		return tcb.snd.UNA, true
+	}
+	return tcb.sackHole()
 }
 
-// SetWindow sets the receive window size.
+// RetransmitTimeout informs the ControlBlock that the retransmission timer expired. Fast
+// recovery is exited and congestion control is notified of the loss unless it was already
+// notified of a timeout for the same data. See RFC 5681 section 3.1 and RFC 6582 section 4.
+func (tcb *ControlBlock) RetransmitTimeout() {
+	flight := Sizeof(tcb.snd.UNA, tcb.snd.NXT)
+	if tcb.cc != nil && (tcb.recovering || LessThanEq(tcb.recover, tcb.snd.UNA)) {
+		tcb.cc.OnLoss(flight, true)
+	}
+	tcb.recover = tcb.snd.NXT
+	tcb.recovering = false
+	tcb.fastRtx = false
+	tcb.inflation = 0
+	tcb.dupacks = 0
+	tcb.sacked.reset() // Remote may discard out-of-order data, see RFC 2018 section 8.
+}
+
+// SetWindowScale enables window scaling with the shift counts negotiated during the
+// handshake. sndShift is the shift count received in the remote's window scale option and
+// rcvShift is the shift count sent in the local window scale option. Window scaling
+// must only be enabled if both SYN segments carried the window scale option and
+// applies to segments without the SYN flag. See RFC 7323 section 2.
+func (tcb *ControlBlock) SetWindowScale(sndShift, rcvShift uint8) error {
+	if sndShift > MaxWindowShift || rcvShift > MaxWindowShift {
+		return errWindowShift
+	}
+	tcb.sndShift = sndShift
+	tcb.rcvShift = rcvShift
+	tcb.wscale = true
+	return nil
+}
+
+// WindowScale returns the window scale shift counts and whether window scaling is enabled.
+func (tcb *ControlBlock) WindowScale() (sndShift, rcvShift uint8, enabled bool) {
+	return tcb.sndShift, tcb.rcvShift, tcb.wscale
+}
+
+// SendWindow returns the send window (SND.WND) advertised by the remote.
+func (tcb *ControlBlock) SendWindow() Size { return tcb.snd.WND }
+
+// SetRecvWindow sets the receive window size, usually the free space in the receive buffer.
+// The window is reduced immediately but, to avoid the silly window syndrome, it is only
+// increased once it can grow by the smaller of a full-sized segment and half of the receive
+// buffer size passed to Open. See RFC 9293 section 3.8.6.2.2.
 func (tcb *ControlBlock) SetRecvWindow(wnd Size) {
+	if wnd > tcb.rcv.WND && wnd-tcb.rcv.WND < minSize(tcb.rcvBuff/2, tcb.mss()) {
+		return // Keep the right window edge until the window opens enough.
+	}
 	tcb.rcv.WND = wnd
 }
 
+// SetDelayedACK enables or disables delayed acknowledgements. When enabled the acknowledgement
+// of in-order data is delayed until two full-sized segments are unacknowledged or data
+// is sent to the remote so that the ACK is piggybacked. Segments that occupy no sequence space
+// are not acknowledged. The caller must run a delayed ACK timer of less than 500ms while
+// [ControlBlock.ACKDelayed] returns true and call [ControlBlock.FlushDelayedACK] on expiry.
+// See RFC 1122 section 4.2.3.2 and RFC 5681 section 4.2.
+func (tcb *ControlBlock) SetDelayedACK(enabled bool) {
+	tcb.delayACK = enabled
+	if !enabled {
+		tcb.FlushDelayedACK()
+	}
+}
+
+// ACKDelayed returns true if received data has not been acknowledged due to delayed acknowledgements.
+func (tcb *ControlBlock) ACKDelayed() bool { return tcb.ackDelayed }
+
+// FlushDelayedACK queues the acknowledgement of data whose acknowledgement was delayed.
+func (tcb *ControlBlock) FlushDelayedACK() {
+	if tcb.ackDelayed {
+		tcb.pending[0] |= FlagACK
+		tcb.ackDelayed = false
+	}
+}
+
+// SetReassembly enables or disables out-of-order segment reassembly. When enabled
+// in-window data segments that do not start at RCV.NXT are admitted by Recv and their
+// sequence space is held until the missing data arrives. Disabling reassembly
+// discards all held sequence space.
+func (tcb *ControlBlock) SetReassembly(enabled bool) {
+	tcb.reassembly = enabled
+	if !enabled {
+		tcb.held.reset()
+	}
+}
+
 // SetLogger sets the logger to be used by the ControlBlock.
 func (tcb *ControlBlock) SetLogger(log *slog.Logger) {
 	tcb.log = log
@@ -167,6 +167,31 @@ type UDPHeader struct {
 	Checksum uint16 // 6:8
 }
 
+// ICMPv4Header represents an Internet Control Message Protocol header. 8 bytes in size.
+// ICMP is protocol 1. See RFC 792.
+type ICMPv4Header struct {
+	Type     ICMPv4Type // 0:1
+	Code     uint8      // 1:2
+	Checksum uint16     // 2:4
+	// ID and Seq are the identifier and sequence number of echo messages.
+	// They are unused and must be zero for destination unreachable messages.
+	ID  uint16 // 4:6
+	Seq uint16 // 6:8
+}
+
+// ICMPv4Type is the type of an ICMP message.
+type ICMPv4Type uint8
+
+// ICMP message types and codes. See RFC 792.
+const (
+	ICMPv4EchoReply              ICMPv4Type = 0
+	ICMPv4DestinationUnreachable ICMPv4Type = 3
+	ICMPv4Echo                   ICMPv4Type = 8
+	// ICMPv4CodePortUnreachable is the code of a destination unreachable message
+	// sent when no process is listening on the destination port.
+	ICMPv4CodePortUnreachable = 3
+)
+
 // There are 9 flags, bits 100 thru 103 are reserved
 const (
 	// TCP words are 4 octals, or uint32s
@@ -182,6 +207,7 @@ const (
 	SizeUDPHeader      = 8
 	SizeARPv4Header    = 28
 	SizeTCPHeader      = 20
+	SizeICMPv4Header   = 8
 	SizeDHCPHeader     = 44
 	ipflagDontFrag     = 0x4000
 	ipFlagMoreFrag     = 0x8000
@@ -391,6 +417,42 @@ func (uhdr *UDPHeader) String() string {
 	return fmt.Sprintf("%d->%d len=%d", uhdr.SourcePort, uhdr.DestinationPort, uhdr.Length)
 }
 
+// DecodeICMPv4Header decodes an ICMP header from buf. Panics if buf is less than 8 bytes in length.
+func DecodeICMPv4Header(buf []byte) (ihdr ICMPv4Header) {
+	_ = buf[7]
+	ihdr.Type = ICMPv4Type(buf[0])
+	ihdr.Code = buf[1]
+	ihdr.Checksum = binary.BigEndian.Uint16(buf[2:4])
+	ihdr.ID = binary.BigEndian.Uint16(buf[4:6])
+	ihdr.Seq = binary.BigEndian.Uint16(buf[6:8])
+	return ihdr
+}
+
+// Put marshals the ICMPv4Header onto buf. If buf's length is less than 8 then Put panics.
+func (ihdr *ICMPv4Header) Put(buf []byte) {
+	_ = buf[7]
+	buf[0] = uint8(ihdr.Type)
+	buf[1] = ihdr.Code
+	binary.BigEndian.PutUint16(buf[2:4], ihdr.Checksum)
+	binary.BigEndian.PutUint16(buf[4:6], ihdr.ID)
+	binary.BigEndian.PutUint16(buf[6:8], ihdr.Seq)
+}
+
+// CalculateChecksum calculates the checksum of the ICMP header and message payload.
+func (ihdr *ICMPv4Header) CalculateChecksum(payload []byte) uint16 {
+	var crc CRC791
+	crc.AddUint8(uint8(ihdr.Type))
+	crc.AddUint8(ihdr.Code)
+	crc.AddUint16(ihdr.ID)
+	crc.AddUint16(ihdr.Seq)
+	crc.Write(payload)
+	return crc.Sum16()
+}
+
+func (ihdr *ICMPv4Header) String() string {
+	return strcat("ICMP type ", u32toa(uint32(ihdr.Type)), " code ", u32toa(uint32(ihdr.Code)))
+}
+
 // Put marshals the ARP header onto buf. buf needs to be 28 bytes in length or Put panics.
 func (ahdr *ARPv4Header) Put(buf []byte) {
 	_ = buf[27]
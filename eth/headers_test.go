@@ -227,3 +227,81 @@ func TestIPChecksum(t *testing.T) {
 		t.Errorf("checksum mismatch, got %#04x; expected %#04x", got, expected)
 	}
 }
+
+func TestICMPChecksum(t *testing.T) {
+	// Echo request sent by Windows ping.
+	const expected = 0x4d51
+	payload := []byte("abcdefghijklmnopqrstuvwabcdefghi")
+	ihdr := ICMPv4Header{Type: ICMPv4Echo, ID: 1, Seq: 10}
+	got := ihdr.CalculateChecksum(payload)
+	if got != expected {
+		t.Errorf("checksum mismatch, got %#04x; expected %#04x", got, expected)
+	}
+	ihdr.Checksum = got
+	var buf [SizeICMPv4Header]byte
+	ihdr.Put(buf[:])
+	decoded := DecodeICMPv4Header(buf[:])
+	if decoded != ihdr {
+		t.Errorf("ICMP header marshal mismatch, got %v; expected %v", decoded.String(), ihdr.String())
+	}
+}
+
+func TestTCPOptions(t *testing.T) {
+	// Options of a Linux SYN segment: MSS, SACK permitted, timestamps, NOP and window scale.
+	synOptions, _ := hex.DecodeString("020405b40402080a14ccf8250000000001030307")
+	var kinds []TCPOptionKind
+	err := ForEachTCPOption(synOptions, func(opt TCPOption) error {
+		kinds = append(kinds, opt.Kind)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantKinds := []TCPOptionKind{TCPOptMSS, TCPOptSACKPermitted, TCPOptTimestamps, TCPOptWindowScale}
+	if fmt.Sprint(kinds) != fmt.Sprint(wantKinds) {
+		t.Errorf("got option kinds %v, want %v", kinds, wantKinds)
+	}
+	opts, err := DecodeTCPOptions(synOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := TCPOptions{MSS: 1460, SACKPermitted: true, HasTimestamps: true, TSVal: 0x14ccf825,
+		HasWindowScale: true, WindowScale: 7}
+	if opts != want {
+		t.Errorf("got %+v, want %+v", opts, want)
+	}
+
+	// Encode and decode round trip.
+	tests := []TCPOptions{
+		{},
+		want,
+		{HasTimestamps: true, TSVal: 1, TSEcr: 2, NumSACK: 3, SACK: [MaxTCPSACKBlocks]TCPSACKBlock{{Left: 1, Right: 2}, {Left: 3, Right: 4}, {Left: 5, Right: 6}}},
+		{NumSACK: 4, SACK: [MaxTCPSACKBlocks]TCPSACKBlock{{Left: 1, Right: 2}, {Left: 3, Right: 4}, {Left: 5, Right: 6}, {Left: 7, Right: 8}}},
+		{HasWindowScale: true},
+	}
+	var buf [MaxSizeTCPOptions]byte
+	for i, test := range tests {
+		n, err := test.Put(buf[:])
+		if err != nil {
+			t.Fatal(i, err)
+		}
+		if n != test.Size() || n%4 != 0 {
+			t.Errorf("%d: got encoded size %d, want %d (multiple of 4)", i, n, test.Size())
+		}
+		got, err := DecodeTCPOptions(buf[:n])
+		if err != nil {
+			t.Fatal(i, err)
+		}
+		if got != test {
+			t.Errorf("%d: got %+v, want %+v", i, got, test)
+		}
+	}
+	tooLong := TCPOptions{MSS: 1, HasTimestamps: true, NumSACK: 4}
+	if _, err := tooLong.Put(buf[:]); err == nil {
+		t.Error("expected error encoding options larger than 40 bytes")
+	}
+	_, err = DecodeTCPOptions([]byte{byte(TCPOptMSS), 4, 0})
+	if err == nil {
+		t.Error("expected error decoding truncated option")
+	}
+}
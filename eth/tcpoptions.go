@@ -0,0 +1,263 @@
+package eth
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/soypat/seqs"
+)
+
+// MaxSizeTCPOptions is the maximum size of the TCP options area in bytes.
+const MaxSizeTCPOptions = 40
+
+// MaxTCPSACKBlocks is the maximum amount of SACK blocks that fit in the TCP options area.
+const MaxTCPSACKBlocks = seqs.MaxSACKBlocks
+
+var (
+	errTCPOptionTooLong    = errors.New("TCP option data too long")
+	errTCPOptionShortBuf   = errors.New("TCP option buffer too short")
+	errTCPOptionBadLength  = errors.New("TCP option length exceeds options area")
+	errTCPOptionsTooLong   = errors.New("TCP options exceed 40 bytes")
+	errTCPOptionBadDataLen = errors.New("unexpected TCP option data length")
+)
+
+// TCPOptionKind is the kind of a TCP option as assigned by IANA.
+//
+//go:generate stringer -type=TCPOptionKind -trimprefix=TCPOpt
+type TCPOptionKind uint8
+
+const (
+	TCPOptEnd           TCPOptionKind = 0 // End of option list. Single byte.
+	TCPOptNop           TCPOptionKind = 1 // No-operation, used for alignment. Single byte.
+	TCPOptMSS           TCPOptionKind = 2 // Maximum segment size. RFC 9293.
+	TCPOptWindowScale   TCPOptionKind = 3 // Window scale shift count. RFC 7323.
+	TCPOptSACKPermitted TCPOptionKind = 4 // Selective acknowledgement permitted. RFC 2018.
+	TCPOptSACK          TCPOptionKind = 5 // Selective acknowledgement blocks. RFC 2018.
+	TCPOptTimestamps    TCPOptionKind = 8 // Timestamps. RFC 7323.
+)
+
+// TCPOption is a single TCP option as found in the TCP header options area.
+type TCPOption struct {
+	Kind TCPOptionKind
+	Data []byte
+}
+
+func (opt *TCPOption) String() string {
+	return opt.Kind.String() + ":" + fmt.Sprint(opt.Data)
+}
+
+// Encode writes the option to dst and returns the amount of bytes written.
+// End and Nop options are encoded as a single byte and carry no data.
+func (opt *TCPOption) Encode(dst []byte) (int, error) {
+	if opt.Kind == TCPOptEnd || opt.Kind == TCPOptNop {
+		if len(dst) < 1 {
+			return 0, errTCPOptionShortBuf
+		}
+		dst[0] = byte(opt.Kind)
+		return 1, nil
+	}
+	if len(opt.Data) > MaxSizeTCPOptions-2 {
+		return 0, errTCPOptionTooLong
+	} else if len(dst) < 2+len(opt.Data) {
+		return 0, errTCPOptionShortBuf
+	}
+	dst[0] = byte(opt.Kind)
+	dst[1] = byte(2 + len(opt.Data)) // Length includes kind and length bytes.
+	copy(dst[2:], opt.Data)
+	return 2 + len(opt.Data), nil
+}
+
+// ForEachTCPOption calls fn for each option in the TCP options area. Nop options
+// are skipped and parsing stops at the End option.
+func ForEachTCPOption(tcpOptions []byte, fn func(opt TCPOption) error) error {
+	if fn == nil {
+		return errors.New("nil function to parse TCP options")
+	}
+	ptr := 0
+	for ptr < len(tcpOptions) {
+		kind := TCPOptionKind(tcpOptions[ptr])
+		if kind == TCPOptEnd {
+			break
+		} else if kind == TCPOptNop {
+			ptr++
+			continue
+		}
+		if ptr+1 >= len(tcpOptions) {
+			return errTCPOptionBadLength
+		}
+		optlen := int(tcpOptions[ptr+1])
+		if optlen < 2 || ptr+optlen > len(tcpOptions) {
+			return errTCPOptionBadLength
+		}
+		if err := fn(TCPOption{Kind: kind, Data: tcpOptions[ptr+2 : ptr+optlen]}); err != nil {
+			return err
+		}
+		ptr += optlen
+	}
+	return nil
+}
+
+// TCPSACKBlock is a block of contiguous sequence space received by the sender
+// of a SACK option. Left is the first sequence number of the block and Right
+// is the sequence number immediately following the last sequence number of the block.
+type TCPSACKBlock = seqs.SACKBlock
+
+// TCPOptions is the decoded representation of the TCP options supported by this package.
+// Presence of options which have no meaningful zero value is signalled by a boolean field.
+type TCPOptions struct {
+	// MSS is the maximum segment size. Zero if not present. Only sent in SYN segments.
+	MSS uint16
+	// WindowScale is the window scale shift count. Only sent in SYN segments.
+	WindowScale    uint8
+	HasWindowScale bool
+	// SACKPermitted signals the sender supports selective acknowledgements. Only sent in SYN segments.
+	SACKPermitted bool
+	// SACK contains NumSACK selective acknowledgement blocks.
+	SACK    [MaxTCPSACKBlocks]TCPSACKBlock
+	NumSACK uint8
+	// TSVal and TSEcr are the timestamp value and timestamp echo reply.
+	TSVal         uint32
+	TSEcr         uint32
+	HasTimestamps bool
+}
+
+// DecodeTCPOptions decodes the options in a TCP options area. Unknown options are ignored.
+func DecodeTCPOptions(tcpOptions []byte) (opts TCPOptions, err error) {
+	err = ForEachTCPOption(tcpOptions, func(opt TCPOption) error {
+		switch opt.Kind {
+		case TCPOptMSS:
+			if len(opt.Data) != 2 {
+				return errTCPOptionBadDataLen
+			}
+			opts.MSS = binary.BigEndian.Uint16(opt.Data)
+		case TCPOptWindowScale:
+			if len(opt.Data) != 1 {
+				return errTCPOptionBadDataLen
+			}
+			opts.WindowScale = opt.Data[0]
+			opts.HasWindowScale = true
+		case TCPOptSACKPermitted:
+			if len(opt.Data) != 0 {
+				return errTCPOptionBadDataLen
+			}
+			opts.SACKPermitted = true
+		case TCPOptSACK:
+			if len(opt.Data)%8 != 0 || len(opt.Data) > 8*MaxTCPSACKBlocks {
+				return errTCPOptionBadDataLen
+			}
+			opts.NumSACK = uint8(len(opt.Data) / 8)
+			for i := 0; i < int(opts.NumSACK); i++ {
+				opts.SACK[i] = TCPSACKBlock{
+					Left:  seqs.Value(binary.BigEndian.Uint32(opt.Data[8*i:])),
+					Right: seqs.Value(binary.BigEndian.Uint32(opt.Data[8*i+4:])),
+				}
+			}
+		case TCPOptTimestamps:
+			if len(opt.Data) != 8 {
+				return errTCPOptionBadDataLen
+			}
+			opts.TSVal = binary.BigEndian.Uint32(opt.Data)
+			opts.TSEcr = binary.BigEndian.Uint32(opt.Data[4:])
+			opts.HasTimestamps = true
+		}
+		return nil
+	})
+	return opts, err
+}
+
+// Size returns the size in bytes of the encoded options including padding
+// so that the result is a multiple of the 4 byte TCP word length.
+func (opts *TCPOptions) Size() int {
+	size := 0
+	if opts.MSS != 0 {
+		size += 4
+	}
+	if opts.HasWindowScale {
+		size += 4 // Nop + 3 byte option.
+	}
+	if opts.SACKPermitted {
+		size += 4 // Two Nops + 2 byte option.
+	}
+	if opts.HasTimestamps {
+		size += 12 // Two Nops + 10 byte option.
+	}
+	if opts.NumSACK > 0 {
+		size += 4 + 8*int(opts.NumSACK) // Two Nops + 2 byte option header + blocks.
+	}
+	return size
+}
+
+// Put encodes the options into b in their usual word aligned layout and returns
+// the amount of bytes written, which is equal to Size.
+func (opts *TCPOptions) Put(b []byte) (int, error) {
+	size := opts.Size()
+	if size > MaxSizeTCPOptions {
+		return 0, errTCPOptionsTooLong
+	} else if len(b) < size || opts.NumSACK > MaxTCPSACKBlocks {
+		return 0, errTCPOptionShortBuf
+	}
+	n := 0
+	if opts.MSS != 0 {
+		b[0] = byte(TCPOptMSS)
+		b[1] = 4
+		binary.BigEndian.PutUint16(b[2:], opts.MSS)
+		n += 4
+	}
+	if opts.HasWindowScale {
+		b[n] = byte(TCPOptNop)
+		b[n+1] = byte(TCPOptWindowScale)
+		b[n+2] = 3
+		b[n+3] = opts.WindowScale
+		n += 4
+	}
+	if opts.SACKPermitted {
+		b[n] = byte(TCPOptNop)
+		b[n+1] = byte(TCPOptNop)
+		b[n+2] = byte(TCPOptSACKPermitted)
+		b[n+3] = 2
+		n += 4
+	}
+	if opts.HasTimestamps {
+		b[n] = byte(TCPOptNop)
+		b[n+1] = byte(TCPOptNop)
+		b[n+2] = byte(TCPOptTimestamps)
+		b[n+3] = 10
+		binary.BigEndian.PutUint32(b[n+4:], opts.TSVal)
+		binary.BigEndian.PutUint32(b[n+8:], opts.TSEcr)
+		n += 12
+	}
+	if opts.NumSACK > 0 {
+		b[n] = byte(TCPOptNop)
+		b[n+1] = byte(TCPOptNop)
+		b[n+2] = byte(TCPOptSACK)
+		b[n+3] = 2 + 8*opts.NumSACK
+		n += 4
+		for _, block := range opts.SACK[:opts.NumSACK] {
+			binary.BigEndian.PutUint32(b[n:], uint32(block.Left))
+			binary.BigEndian.PutUint32(b[n+4:], uint32(block.Right))
+			n += 8
+		}
+	}
+	return n, nil
+}
+
+func (opts *TCPOptions) String() string {
+	s := ""
+	if opts.MSS != 0 {
+		s += "mss=" + u32toa(uint32(opts.MSS)) + " "
+	}
+	if opts.HasWindowScale {
+		s += "wscale=" + u32toa(uint32(opts.WindowScale)) + " "
+	}
+	if opts.SACKPermitted {
+		s += "sackOK "
+	}
+	for _, block := range opts.SACK[:min(opts.NumSACK, MaxTCPSACKBlocks)] {
+		s += "sack=" + u32toa(uint32(block.Left)) + "-" + u32toa(uint32(block.Right)) + " "
+	}
+	if opts.HasTimestamps {
+		s += "tsval=" + u32toa(opts.TSVal) + " tsecr=" + u32toa(opts.TSEcr) + " "
+	}
+	return s
+}
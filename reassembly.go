@@ -0,0 +1,106 @@
+package seqs
+
+// maxHeldRanges is the maximum amount of disjoint out-of-order sequence ranges
+// a ControlBlock can keep track of while waiting for missing data to arrive.
+const maxHeldRanges = 4
+
+// seqRange represents the [start, end) range of sequence numbers.
+type seqRange struct {
+	start Value
+	end   Value
+}
+
+// heldRanges is a fixed capacity list of disjoint, non-adjacent sequence number ranges
+// sorted in ascending (modulo 32) order. It is used to keep track of
+// out-of-order data received ahead of RCV.NXT.
+type heldRanges struct {
+	r [maxHeldRanges]seqRange
+	n uint8
+}
+
+// add adds the [start, end) range to the list merging it with overlapping or adjacent
+// ranges. It returns false if there is no space left to hold the range.
+func (h *heldRanges) add(start, end Value) bool {
+	if start == end {
+		return true
+	}
+	// Find insertion point: first range that ends at or after start.
+	i := 0
+	for i < int(h.n) && LessThan(h.r[i].end, start) {
+		i++
+	}
+	// Merge all ranges overlapping or adjacent to [start, end).
+	j := i
+	for j < int(h.n) && LessThanEq(h.r[j].start, end) {
+		if LessThan(h.r[j].start, start) {
+			start = h.r[j].start
+		}
+		if LessThan(end, h.r[j].end) {
+			end = h.r[j].end
+		}
+		j++
+	}
+	merged := j - i
+	if merged == 0 && h.n == maxHeldRanges {
+		return false // No space for a new disjoint range.
+	}
+	// Ranges in [i, j) are replaced by a single range.
+	newN := int(h.n) - merged + 1
+	copy(h.r[i+1:newN], h.r[j:h.n])
+	h.r[i] = seqRange{start: start, end: end}
+	h.n = uint8(newN)
+	return true
+}
+
+// canAdd returns true if the [start, end) range can be added to the list.
+func (h *heldRanges) canAdd(start, end Value) bool {
+	if h.n < maxHeldRanges {
+		return true
+	}
+	for i := 0; i < int(h.n); i++ {
+		if LessThanEq(h.r[i].start, end) && LessThanEq(start, h.r[i].end) {
+			return true // Range can be merged.
+		}
+	}
+	return false
+}
+
+// advance removes all ranges that begin at or before nxt and returns the
+// sequence number following the contiguous data that starts at nxt.
+func (h *heldRanges) advance(nxt Value) Value {
+	i := 0
+	for i < int(h.n) && LessThanEq(h.r[i].start, nxt) {
+		if LessThan(nxt, h.r[i].end) {
+			nxt = h.r[i].end
+		}
+		i++
+	}
+	copy(h.r[:], h.r[i:h.n])
+	h.n -= uint8(i)
+	return nxt
+}
+
+func (h *heldRanges) reset() { h.n = 0 }
+
+// trim removes all sequence space before seq.
+func (h *heldRanges) trim(seq Value) {
+	i := 0
+	for i < int(h.n) && LessThanEq(h.r[i].end, seq) {
+		i++
+	}
+	copy(h.r[:], h.r[i:h.n])
+	h.n -= uint8(i)
+	if h.n > 0 && LessThan(h.r[0].start, seq) {
+		h.r[0].start = seq
+	}
+}
+
+// nextStart returns the start of the first range beginning after seq.
+func (h *heldRanges) nextStart(seq Value) (Value, bool) {
+	for i := 0; i < int(h.n); i++ {
+		if LessThan(seq, h.r[i].start) {
+			return h.r[i].start, true
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,95 @@
+package seqs
+
+// MaxSACKBlocks is the maximum amount of SACK blocks a segment can carry.
+// See RFC 2018 section 3.
+const MaxSACKBlocks = 4
+
+// SACKBlock is a block of contiguous sequence space received by the sender of a
+// selective acknowledgement. Left is the first sequence number of the block and
+// Right is the sequence number immediately following the last sequence number of the block.
+type SACKBlock struct {
+	Left  Value
+	Right Value
+}
+
+// SetSACK enables or disables selective acknowledgements. SACK must only be enabled
+// if both SYN segments carried the SACK-permitted option, see RFC 2018 section 2.
+// When enabled outgoing segments that acknowledge data report out-of-order data held
+// for reassembly in their SACK blocks and SACK blocks of incoming segments are used
+// to retransmit only the missing sequence space during fast recovery.
+func (tcb *ControlBlock) SetSACK(enabled bool) {
+	tcb.sackOK = enabled
+	tcb.sacked.reset()
+}
+
+// SACK returns true if selective acknowledgements are enabled.
+func (tcb *ControlBlock) SACK() bool { return tcb.sackOK }
+
+// SkipSACKed returns the first sequence number at or after seq that has not
+// been selectively acknowledged by the remote.
+func (tcb *ControlBlock) SkipSACKed(seq Value) Value {
+	for i := 0; i < int(tcb.sacked.n); i++ {
+		r := tcb.sacked.r[i]
+		if LessThanEq(r.start, seq) && LessThan(seq, r.end) {
+			seq = r.end
+		}
+	}
+	return seq
+}
+
+// putSACK sets the SACK blocks of an outgoing segment that acknowledges data.
+// The first block contains the most recently received segment as required by RFC 2018 section 4.
+func (tcb *ControlBlock) putSACK(seg *Segment) {
+	if !tcb.sackOK || tcb.held.n == 0 || !seg.Flags.HasAny(FlagACK) || seg.Flags.HasAny(FlagSYN|FlagRST) {
+		return
+	}
+	first := 0
+	for i := 0; i < int(tcb.held.n); i++ {
+		if InRange(tcb.lastHeld, tcb.held.r[i].start, tcb.held.r[i].end) {
+			first = i
+			break
+		}
+	}
+	seg.SACK[0] = SACKBlock{Left: tcb.held.r[first].start, Right: tcb.held.r[first].end}
+	n := 1
+	for i := 0; i < int(tcb.held.n) && n < MaxSACKBlocks; i++ {
+		if i != first {
+			seg.SACK[n] = SACKBlock{Left: tcb.held.r[i].start, Right: tcb.held.r[i].end}
+			n++
+		}
+	}
+	seg.NumSACK = uint8(n)
+}
+
+// rcvSACK adds the SACK blocks of an incoming segment to the scoreboard of selectively
+// acknowledged sequence space. Blocks outside of the unacknowledged sequence space are ignored.
+func (tcb *ControlBlock) rcvSACK(seg Segment) {
+	if !tcb.sackOK || !seg.Flags.HasAny(FlagACK) {
+		return
+	}
+	n := seg.NumSACK
+	if n > MaxSACKBlocks {
+		n = MaxSACKBlocks
+	}
+	for _, block := range seg.SACK[:n] {
+		if LessThan(block.Left, block.Right) && LessThanEq(tcb.snd.UNA, block.Left) && LessThanEq(block.Right, tcb.snd.NXT) {
+			tcb.sacked.add(block.Left, block.Right) // Blocks that do not fit are ignored.
+		}
+	}
+}
+
+// sackHole returns the start of the next hole in the sequence space that must be retransmitted
+// during fast recovery. A hole is unacknowledged sequence space below selectively acknowledged
+// data which has not yet been retransmitted. See RFC 6675 section 4.
+func (tcb *ControlBlock) sackHole() (Value, bool) {
+	if !tcb.sackOK || !tcb.recovering || tcb.sacked.n == 0 {
+		return 0, false
+	}
+	seq := tcb.snd.UNA
+	if LessThan(seq, tcb.rtxHigh) {
+		seq = tcb.rtxHigh
+	}
+	seq = tcb.SkipSACKed(seq)
+	highest := tcb.sacked.r[tcb.sacked.n-1].start
+	return seq, LessThan(seq, highest)
+}
@@ -1,8 +1,10 @@
 package seqs_test
 
 import (
+	"math"
 	"strconv"
 	"testing"
+	"time"
 
 	"github.com/soypat/seqs"
 	"github.com/soypat/seqs/eth"
@@ -292,6 +294,30 @@ func TestExchange_rfc9293_figure13(t *testing.T) {
 	// No need to test B since exchange is completely symmetric.
 }
 
+// TestExchange_lastAck checks the connection is closed in LAST-ACK only once our FIN is
+// acknowledged and not on any ACK. See RFC 9293 section 3.10.7.4.
+func TestExchange_lastAck(t *testing.T) {
+	const issA, issB, windowA, windowB = 100, 300, 1000, 1000
+	exchangeB := []seqs.Exchange{
+		0: { // B sends FIN|ACK to A after receiving A's FIN.
+			Outgoing:  &seqs.Segment{SEQ: issB, ACK: issA + 1, Flags: FINACK, WND: windowB},
+			WantState: seqs.StateLastAck,
+		},
+		1: { // B receives a duplicate ACK which does not acknowledge its FIN.
+			Incoming:  &seqs.Segment{SEQ: issA + 1, ACK: issB, Flags: seqs.FlagACK, WND: windowA},
+			WantState: seqs.StateLastAck,
+		},
+		2: { // B receives the ACK of its FIN.
+			Incoming:  &seqs.Segment{SEQ: issA + 1, ACK: issB + 1, Flags: seqs.FlagACK, WND: windowA},
+			WantState: seqs.StateClosed,
+		},
+	}
+	var tcbB seqs.ControlBlock
+	tcbB.HelperInitState(seqs.StateCloseWait, issB, issB, windowB)
+	tcbB.HelperInitRcv(issA, issA+1, windowA)
+	tcbB.HelperExchange(t, exchangeB)
+}
+
 // This test reenacts a full client-server interaction in the sending and receiving
 // of the 12 byte message "hello world\n" over TCP.
 func TestExchange_helloworld(t *testing.T) {
@@ -430,6 +456,44 @@ func TestExchange_helloworld_client(t *testing.T) {
 	}
 }
 
+// This test reenacts the reception of an out-of-order segment with reassembly
+// enabled. The second data segment arrives before the first one and is held
+// until the first segment fills the gap.
+func TestExchange_reassembly(t *testing.T) {
+	const issA, issB, windowA, windowB = 100, 300, 1000, 1000
+	const datalen = 10
+	exchangeA := []seqs.Exchange{
+		0: { // A receives B's second data segment before the first. A responds with duplicate ACK.
+			Incoming:    &seqs.Segment{SEQ: issB + datalen, ACK: issA, Flags: PSHACK, WND: windowB, DATALEN: datalen},
+			WantState:   seqs.StateEstablished,
+			WantPending: &seqs.Segment{SEQ: issA, ACK: issB, Flags: seqs.FlagACK, WND: windowA},
+		},
+		1: { // A sends the duplicate ACK.
+			Outgoing:  &seqs.Segment{SEQ: issA, ACK: issB, Flags: seqs.FlagACK, WND: windowA},
+			WantState: seqs.StateEstablished,
+		},
+		2: { // A receives B's first data segment which fills the gap. A ACKs both segments.
+			Incoming:    &seqs.Segment{SEQ: issB, ACK: issA, Flags: seqs.FlagACK, WND: windowB, DATALEN: datalen},
+			WantState:   seqs.StateEstablished,
+			WantPending: &seqs.Segment{SEQ: issA, ACK: issB + 2*datalen, Flags: seqs.FlagACK, WND: windowA},
+		},
+	}
+	var tcbA seqs.ControlBlock
+	tcbA.HelperInitState(seqs.StateEstablished, issA, issA, windowA)
+	tcbA.HelperInitRcv(issB, issB, windowB)
+	tcbA.SetReassembly(true)
+	tcbA.HelperExchange(t, exchangeA)
+
+	// Without reassembly the out-of-order segment is rejected.
+	var tcbB seqs.ControlBlock
+	tcbB.HelperInitState(seqs.StateEstablished, issA, issA, windowA)
+	tcbB.HelperInitRcv(issB, issB, windowB)
+	err := tcbB.Recv(*exchangeA[0].Incoming)
+	if err == nil {
+		t.Error("expected out-of-order segment to be rejected without reassembly")
+	}
+}
+
 func parseSegment(t *testing.T, b []byte) (seqs.Segment, []byte) {
 	t.Helper()
 	ehdr := eth.DecodeEthernetHeader(b)
@@ -503,3 +567,440 @@ var exchangeHelloWorld = [][]byte{
 	// server ACK
 	11: []byte("\xd8\x5e\xd3\x43\x03\xeb\x28\xcd\xc1\x05\x4d\xbb\x08\x00\x45\x00\x00\x28\x00\x00\x40\x00\x40\x06\xb6\x5b\xc0\xa8\x01\x91\xc0\xa8\x01\x93\x04\xd2\x84\x96\xbe\x6e\x4c\x28\x5e\x72\x2b\x97\x50\x10\x10\x00\xfd\x56\x00\x00\x00\x00\x00\x00\x00\x00"),
 }
+
+func TestExchange_fastRetransmit(t *testing.T) {
+	const issA, issB, windowA, windowB = 100, 300, 1000, 1000
+	const mss = 10
+	var tcbA seqs.ControlBlock
+	tcbA.HelperInitState(seqs.StateEstablished, issA, issA, windowA)
+	tcbA.HelperInitRcv(issB, issB, windowB)
+	tcbA.SetMaxSegmentSize(mss)
+	tcbA.SetCongestionControl(&seqs.Reno{})
+	if got := tcbA.MaxInFlightData(); got != 4*mss-1 {
+		t.Fatalf("initial window: got %d want %d", got, 4*mss-1)
+	}
+	// A sends a full congestion window of 4 segments, the first of which is lost.
+	var exchangeA []seqs.Exchange
+	for i := 0; i < 4; i++ {
+		exchangeA = append(exchangeA, seqs.Exchange{
+			Outgoing:  &seqs.Segment{SEQ: issA + seqs.Value(i*mss), ACK: issB, Flags: PSHACK, WND: windowA, DATALEN: mss},
+			WantState: seqs.StateEstablished,
+		})
+	}
+	tcbA.HelperExchange(t, exchangeA)
+	if _, ok := tcbA.PendingSegment(mss); ok {
+		t.Fatal("congestion window exceeded")
+	}
+	// B ACKs each of the 3 segments it received with a duplicate ACK.
+	dupack := seqs.Segment{SEQ: issB, ACK: issA, Flags: seqs.FlagACK, WND: windowB}
+	for i := 0; i < 3; i++ {
+		if _, ok := tcbA.PendingRetransmit(); ok {
+			t.Fatalf("fast retransmit after %d duplicate ACKs", i)
+		}
+		tcbA.Recv(dupack)
+	}
+	seq, ok := tcbA.PendingRetransmit()
+	if !ok || seq != issA {
+		t.Fatalf("expected fast retransmit of %d, got %d (ok=%v)", issA, seq, ok)
+	}
+	seg, ok := tcbA.RetransmitSegment(seq, mss)
+	if !ok {
+		t.Fatal("no segment to retransmit")
+	}
+	err := tcbA.Send(seg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := tcbA.PendingRetransmit(); ok {
+		t.Error("fast retransmit still pending after retransmission")
+	}
+	// B receives retransmitted segment and ACKs all data, ending fast recovery with a halved window.
+	err = tcbA.Recv(seqs.Segment{SEQ: issB, ACK: issA + 4*mss, Flags: seqs.FlagACK, WND: windowB})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := tcbA.MaxInFlightData(); got != 2*mss-1 {
+		t.Errorf("window after recovery: got %d want %d", got, 2*mss-1)
+	}
+}
+
+func TestExchange_windowScale(t *testing.T) {
+	const issA, issB, windowA, windowB = 100, 300, 1 << 20, 1000
+	const shiftA, shiftB = 5, 2
+	var tcbA seqs.ControlBlock
+	err := tcbA.Open(issA, windowA, seqs.StateSynSent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Windows in SYN segments are never scaled.
+	syn, ok := tcbA.PendingSegment(0)
+	if !ok || syn.WND != math.MaxUint16 {
+		t.Fatalf("SYN: got %+v, want window %d", syn, math.MaxUint16)
+	}
+	err = tcbA.Send(syn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tcbA.Recv(seqs.Segment{SEQ: issB, ACK: issA + 1, WND: windowB, Flags: SYNACK})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tcbA.SendWindow() != windowB {
+		t.Errorf("SYN-ACK window scaled: got %d want %d", tcbA.SendWindow(), windowB)
+	}
+	err = tcbA.SetWindowScale(shiftB, shiftA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tcbA.SetRecvWindow(windowA)
+	ack, ok := tcbA.PendingSegment(0)
+	if !ok || ack.WND != windowA>>shiftA {
+		t.Fatalf("ACK: got %+v, want window %d", ack, windowA>>shiftA)
+	}
+	err = tcbA.Send(ack)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tcbA.RecvWindow() != windowA {
+		t.Errorf("receive window: got %d want %d", tcbA.RecvWindow(), windowA)
+	}
+	err = tcbA.Recv(seqs.Segment{SEQ: issB + 1, ACK: issA + 1, WND: windowB, Flags: PSHACK, DATALEN: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tcbA.SendWindow() != windowB<<shiftB {
+		t.Errorf("scaled send window: got %d want %d", tcbA.SendWindow(), windowB<<shiftB)
+	}
+	if err = tcbA.SetWindowScale(seqs.MaxWindowShift+1, 0); err == nil {
+		t.Error("expected error for shift count exceeding maximum")
+	}
+}
+
+func TestExchange_sack(t *testing.T) {
+	const issA, issB, windowA, windowB = 100, 300, 1000, 1000
+	const mss = 10
+	var tcbA, tcbB seqs.ControlBlock
+	tcbA.HelperInitState(seqs.StateEstablished, issA, issA, windowA)
+	tcbA.HelperInitRcv(issB, issB, windowB)
+	tcbA.SetSACK(true)
+	tcbB.HelperInitState(seqs.StateEstablished, issB, issB, windowB)
+	tcbB.HelperInitRcv(issA, issA, windowA)
+	tcbB.SetReassembly(true)
+	tcbB.SetSACK(true)
+
+	// A sends 5 segments of which the first and third are lost.
+	for i := 0; i < 5; i++ {
+		seg := seqs.Segment{SEQ: issA + seqs.Value(i*mss), ACK: issB, Flags: PSHACK, WND: windowA, DATALEN: mss}
+		err := tcbA.Send(seg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i == 0 || i == 2 {
+			continue
+		}
+		err = tcbB.Recv(seg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// B reports the held data in SACK blocks, the most recently received block first.
+		dupack, ok := tcbB.PendingSegment(0)
+		if !ok || dupack.ACK != issA || dupack.NumSACK == 0 {
+			t.Fatalf("expected duplicate ACK with SACK blocks, got %+v", dupack)
+		}
+		if first := dupack.SACK[0]; !seqs.InRange(seg.SEQ, first.Left, first.Right) {
+			t.Errorf("first SACK block %+v does not contain last segment received %d", first, seg.SEQ)
+		}
+		err = tcbB.Send(dupack)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tcbA.Recv(dupack)
+	}
+	// A retransmits only the holes in the sequence space.
+	for _, want := range []seqs.Value{issA, issA + 2*mss} {
+		seq, ok := tcbA.PendingRetransmit()
+		if !ok || seq != want {
+			t.Fatalf("expected retransmit of %d, got %d (ok=%v)", want, seq, ok)
+		}
+		seg, ok := tcbA.RetransmitSegment(seq, 5*mss)
+		if !ok || seg.DATALEN != mss {
+			t.Fatalf("expected retransmission of hole of %d octets, got %+v", mss, seg)
+		}
+		err := tcbA.Send(seg)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if seq, ok := tcbA.PendingRetransmit(); ok {
+		t.Errorf("unexpected retransmit of %d", seq)
+	}
+}
+
+func TestExchange_timestamps(t *testing.T) {
+	const issA, issB, windowA, windowB = 100, 300, 1000, 1000
+	const datalen = 10
+	var tcbA seqs.ControlBlock
+	tcbA.HelperInitState(seqs.StateEstablished, issA, issA, windowA)
+	tcbA.HelperInitRcv(issB, issB, windowB)
+	tcbA.SetTimestamps(true)
+	err := tcbA.Send(seqs.Segment{SEQ: issA, ACK: issB, Flags: seqs.FlagACK, WND: windowA, HasTimestamps: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tcbA.Recv(seqs.Segment{SEQ: issB, ACK: issA, Flags: PSHACK, WND: windowB, DATALEN: datalen, TSVal: 1000, HasTimestamps: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A echoes the timestamp of the segment it acknowledges.
+	ack, ok := tcbA.PendingSegment(0)
+	if !ok || !ack.HasTimestamps || ack.TSEcr != 1000 {
+		t.Fatalf("expected ACK echoing timestamp 1000, got %+v", ack)
+	}
+	err = tcbA.Send(ack)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// PAWS: An old duplicate segment with a timestamp older than TS.Recent is rejected and acknowledged.
+	err = tcbA.Recv(seqs.Segment{SEQ: issB + datalen, ACK: issA, Flags: PSHACK, WND: windowB, DATALEN: datalen, TSVal: 900, HasTimestamps: true})
+	if err == nil || tcbA.RecvNext() != issB+datalen {
+		t.Fatalf("old duplicate accepted: err=%v rcv.nxt=%d", err, tcbA.RecvNext())
+	}
+	if ack, ok := tcbA.PendingSegment(0); !ok || !ack.Flags.HasAny(seqs.FlagACK) {
+		t.Errorf("expected ACK for old duplicate, got %+v", ack)
+	}
+	// Segments without timestamps are dropped once timestamps are negotiated.
+	err = tcbA.Recv(seqs.Segment{SEQ: issB + datalen, ACK: issA, Flags: PSHACK, WND: windowB, DATALEN: datalen})
+	if err == nil {
+		t.Fatal("segment without timestamps accepted")
+	}
+	err = tcbA.Recv(seqs.Segment{SEQ: issB + datalen, ACK: issA, Flags: PSHACK, WND: windowB, DATALEN: datalen, TSVal: 1001, HasTimestamps: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tcbA.TSRecent() != 1001 {
+		t.Errorf("TS.Recent: got %d want %d", tcbA.TSRecent(), 1001)
+	}
+}
+
+func TestExchange_delayedACK(t *testing.T) {
+	const issA, issB, windowA, windowB = 100, 300, 1000, 1000
+	const mss = 100
+	var tcbA seqs.ControlBlock
+	tcbA.HelperInitState(seqs.StateEstablished, issA, issA, windowA)
+	tcbA.HelperInitRcv(issB, issB, windowB)
+	tcbA.SetMaxSegmentSize(mss)
+	tcbA.SetDelayedACK(true)
+	err := tcbA.Send(seqs.Segment{SEQ: issA, ACK: issB, Flags: seqs.FlagACK, WND: windowA})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// First full-sized segment is not acknowledged immediately.
+	err = tcbA.Recv(seqs.Segment{SEQ: issB, ACK: issA, Flags: PSHACK, WND: windowB, DATALEN: mss})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if seg, ok := tcbA.PendingSegment(0); ok || !tcbA.ACKDelayed() {
+		t.Fatalf("expected delayed ACK, got pending %+v", seg)
+	}
+	// Second full-sized segment is acknowledged.
+	err = tcbA.Recv(seqs.Segment{SEQ: issB + mss, ACK: issA, Flags: PSHACK, WND: windowB, DATALEN: mss})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ack, ok := tcbA.PendingSegment(0)
+	if !ok || ack.Flags != seqs.FlagACK || ack.ACK != issB+2*mss {
+		t.Fatalf("expected ACK of two segments, got %+v", ack)
+	}
+	err = tcbA.Send(ack)
+	if err != nil {
+		t.Fatal(err)
+	} else if tcbA.ACKDelayed() {
+		t.Fatal("ACK still delayed after being sent")
+	}
+	// Small segment is acknowledged when the delayed ACK timer expires.
+	err = tcbA.Recv(seqs.Segment{SEQ: issB + 2*mss, ACK: issA, Flags: PSHACK, WND: windowB, DATALEN: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := tcbA.PendingSegment(0); ok {
+		t.Fatal("expected delayed ACK for small segment")
+	}
+	tcbA.FlushDelayedACK()
+	ack, ok = tcbA.PendingSegment(0)
+	if !ok || ack.ACK != issB+2*mss+10 {
+		t.Fatalf("expected ACK after timer expiry, got %+v", ack)
+	}
+}
+
+func TestExchange_sillyWindow(t *testing.T) {
+	const issA, issB, windowA, windowB = 100, 300, 1000, 1000
+	const mss = 200
+	var tcbA seqs.ControlBlock
+	err := tcbA.Open(issA, windowA, seqs.StateSynSent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tcbA.SetMaxSegmentSize(mss)
+	tcbA.HelperExchange(t, []seqs.Exchange{
+		{ // A sends SYN.
+			Outgoing:  &seqs.Segment{SEQ: issA, Flags: seqs.FlagSYN, WND: windowA},
+			WantState: seqs.StateSynSent,
+		},
+		{ // A receives SYNACK and acknowledges it.
+			Incoming:    &seqs.Segment{SEQ: issB, ACK: issA + 1, Flags: SYNACK, WND: windowB},
+			WantState:   seqs.StateEstablished,
+			WantPending: &seqs.Segment{SEQ: issA + 1, ACK: issB + 1, Flags: seqs.FlagACK, WND: windowA},
+		},
+		{
+			Outgoing:  &seqs.Segment{SEQ: issA + 1, ACK: issB + 1, Flags: seqs.FlagACK, WND: windowA},
+			WantState: seqs.StateEstablished,
+		},
+	})
+
+	// Receiver: window is closed immediately but not reopened by less than a full-sized segment.
+	tcbA.SetRecvWindow(0)
+	for _, free := range []seqs.Size{1, 50, mss - 1} {
+		tcbA.SetRecvWindow(free)
+		if tcbA.RecvWindow() != 0 {
+			t.Fatalf("window opened by %d bytes: got %d want 0", free, tcbA.RecvWindow())
+		}
+	}
+	tcbA.SetRecvWindow(mss)
+	if tcbA.RecvWindow() != mss {
+		t.Fatalf("window not opened: got %d want %d", tcbA.RecvWindow(), mss)
+	}
+	tcbA.SetRecvWindow(windowA)
+
+	// Sender: data in flight leaves a small usable window.
+	const inflight = windowB - 100
+	seg, ok := tcbA.PendingSegment(inflight)
+	if !ok || seg.DATALEN != inflight {
+		t.Fatalf("expected %d byte segment, got %+v", inflight, seg)
+	}
+	err = tcbA.Send(seg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// All queued data fits the usable window so it is sent.
+	if seg, ok = tcbA.PendingSegment(50); !ok || seg.DATALEN != 50 {
+		t.Fatalf("expected 50 byte segment, got %+v", seg)
+	}
+	// Data exceeding the usable window is not sent in a small segment.
+	if seg, ok = tcbA.PendingSegment(mss); ok {
+		t.Fatalf("expected no segment for silly window, got %+v", seg)
+	}
+	// Acknowledgement opens the window.
+	err = tcbA.Recv(seqs.Segment{SEQ: issB + 1, ACK: issA + 1 + inflight, Flags: seqs.FlagACK, WND: windowB})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if seg, ok = tcbA.PendingSegment(mss); !ok || seg.DATALEN != mss {
+		t.Fatalf("expected %d byte segment, got %+v", mss, seg)
+	}
+}
+
+func TestExchange_rstSynchronized(t *testing.T) {
+	const issA, issB, windowA, windowB = 100, 300, 1000, 1000
+	var tcbA seqs.ControlBlock
+	tcbA.HelperInitState(seqs.StateEstablished, issA, issA, windowA)
+	tcbA.HelperInitRcv(issB, issB, windowB)
+	// RST outside of the receive window is discarded silently.
+	err := tcbA.Recv(seqs.Segment{SEQ: issB + windowA + 10, Flags: seqs.FlagRST})
+	if err == nil || tcbA.State() != seqs.StateEstablished || tcbA.HasPending() {
+		t.Fatalf("out of window RST: err=%v state=%s pending=%v", err, tcbA.State(), tcbA.HasPending())
+	}
+	// RST in window not matching RCV.NXT elicits a challenge ACK. See RFC 5961 section 3.2.
+	err = tcbA.Recv(seqs.Segment{SEQ: issB + 10, Flags: seqs.FlagRST})
+	if err == nil || tcbA.State() != seqs.StateEstablished {
+		t.Fatalf("in window RST: err=%v state=%s", err, tcbA.State())
+	}
+	ack, ok := tcbA.PendingSegment(0)
+	if !ok || ack.Flags != seqs.FlagACK || ack.SEQ != issA || ack.ACK != issB {
+		t.Fatalf("expected challenge ACK, got %+v", ack)
+	}
+	err = tcbA.Send(ack)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// RST matching RCV.NXT resets the connection.
+	err = tcbA.Recv(seqs.Segment{SEQ: issB, Flags: seqs.FlagRST})
+	if err == nil || tcbA.State() != seqs.StateClosed {
+		t.Fatalf("exact RST: err=%v state=%s", err, tcbA.State())
+	}
+}
+
+func TestCongestionControl(t *testing.T) {
+	const mss = 1000
+	var reno seqs.Reno
+	reno.Init(mss)
+	if reno.Window() != 4*mss {
+		t.Fatalf("reno initial window: got %d want %d", reno.Window(), 4*mss)
+	}
+	reno.OnAck(time.Time{}, mss) // Slow start.
+	if reno.Window() != 5*mss {
+		t.Errorf("reno slow start: got %d want %d", reno.Window(), 5*mss)
+	}
+	reno.OnLoss(8*mss, false)
+	if reno.Window() != 4*mss || reno.SlowStartThreshold() != 4*mss {
+		t.Errorf("reno fast retransmit: got cwnd=%d ssthresh=%d want %d", reno.Window(), reno.SlowStartThreshold(), 4*mss)
+	}
+	for i := 0; i < 4; i++ {
+		reno.OnAck(time.Time{}, mss) // Congestion avoidance grows cwnd by 1 MSS per window acknowledged.
+	}
+	if reno.Window() != 5*mss {
+		t.Errorf("reno congestion avoidance: got %d want %d", reno.Window(), 5*mss)
+	}
+	reno.OnLoss(5*mss, true)
+	if reno.Window() != mss || reno.SlowStartThreshold() != 2500 {
+		t.Errorf("reno timeout: got cwnd=%d ssthresh=%d", reno.Window(), reno.SlowStartThreshold())
+	}
+
+	var cubic seqs.Cubic
+	epoch := time.Unix(1000, 0)
+	cubic.Init(mss)
+	for cubic.Window() < 10*mss {
+		cubic.OnAck(epoch, mss) // Slow start.
+	}
+	// ssthresh is calculated from cwnd and not from flight size, see RFC 9438 section 4.6.
+	cubic.OnLoss(5*mss, false)
+	if cubic.Window() != 7*mss || cubic.SlowStartThreshold() != 7*mss {
+		t.Errorf("cubic loss: got cwnd=%d ssthresh=%d want %d", cubic.Window(), cubic.SlowStartThreshold(), 7*mss)
+	}
+	prev := cubic.Window()
+	ackCubic := func(now time.Time, n int) {
+		t.Helper()
+		for i := 0; i < n; i++ {
+			cubic.OnAck(now, mss)
+			if cubic.Window() < prev {
+				t.Fatalf("cubic window decreased on ACK: %d -> %d", prev, cubic.Window())
+			}
+			prev = cubic.Window()
+		}
+	}
+	// At the start of the epoch the cubic function equals cwnd, only Reno-friendly growth applies.
+	ackCubic(epoch, 7)
+	if prev <= 7*mss || prev > 8*mss {
+		t.Errorf("cubic window at epoch start out of expected range: %d", prev)
+	}
+	// Well past K the window grows beyond W_max in the convex region.
+	ackCubic(epoch.Add(5*time.Second), 20)
+	if prev <= 10*mss || prev > 30*mss {
+		t.Errorf("cubic window in convex region out of expected range: %d", prev)
+	}
+	cubic.OnLoss(0, true)
+	if cubic.Window() != mss || cubic.SlowStartThreshold() != seqs.Size(float64(prev)*0.7) {
+		t.Errorf("cubic timeout: got cwnd=%d ssthresh=%d", cubic.Window(), cubic.SlowStartThreshold())
+	}
+
+	// Without a time set with ControlBlock.SetTime Cubic grows by about one segment per window as Reno.
+	cubic.Init(mss)
+	for cubic.Window() < 10*mss {
+		cubic.OnAck(time.Time{}, mss)
+	}
+	cubic.OnLoss(0, false)
+	prev = cubic.Window()
+	ackCubic(time.Time{}, 7)
+	if prev < 7*mss+mss*9/10 || prev > 8*mss {
+		t.Errorf("cubic window without time out of expected range: %d", prev)
+	}
+}
@@ -1,36 +1,64 @@
 package stacks
 
 import (
+	"context"
+	"encoding/binary"
 	"errors"
 	"log/slog"
 	"net/netip"
+	"time"
 
 	"github.com/soypat/seqs/eth"
 )
 
-// ARP returns the ARP client for this stack. The type is not exported since
-// it's implementation is experimental.
-func (ps *PortStack) ARP() *arpClient {
+// ARP returns the ARP client for this stack.
+func (ps *PortStack) ARP() *ARPClient {
 	return &ps.arpClient
 }
 
+const (
+	defaultARPCacheSize = 8
+	// arpReachableTime is the time after a confirmation during which an entry is considered reachable.
+	// Stale entries are still used but a request is sent to refresh them. See RFC 1122 2.3.2.1.
+	arpReachableTime = 30 * time.Second
+	// arpRetryInterval is the time between requests for an address, at most one per second per RFC 1122 2.3.2.1.
+	arpRetryInterval = time.Second
+	// arpMaxRequests is the amount of unanswered requests after which resolution fails.
+	arpMaxRequests = 3
+	// Address conflict detection timing. See RFC 5227 section 1.1.
+	arpProbeWait        = time.Second     // Maximum initial random delay before the first probe.
+	arpProbeNum         = 3               // Number of probes.
+	arpProbeMin         = time.Second     // Minimum delay until next probe.
+	arpProbeMax         = 2 * time.Second // Maximum delay until next probe.
+	arpAnnounceWait     = 2 * time.Second // Delay after the last probe before the address is considered free.
+	arpAnnounceNum      = 2               // Number of announcements.
+	arpAnnounceInterval = 2 * time.Second // Time between announcements.
+)
+
 var (
+	// ErrAddrConflict is returned by [ARPClient.Probe] when another host uses the probed address.
+	ErrAddrConflict = errors.New("address in use by another host")
+
 	errARPUnsupported     = errors.New("unsupported ARP request")
 	errNoARPInProgress    = errors.New("no ARP in progress")
 	errARPResponsePending = errors.New("ARP response pending")
+	errARPTimeout         = errors.New("ARP resolution timed out")
+	errARPCacheFull       = errors.New("ARP cache full")
+	errARPNoAddr          = errors.New("ARP announce requires an address")
 )
 
 /*
 ARP PortStack state machine:
 
-# ARP User Request (outgoing request)
-
-PortStack.arpResult contains state:
-1. Upon user request `BeginResolveARPv4`: PortStack.arpResult.Operation = 1 (request), which means request has not been sent out.
-2. Upon `handleARP`: PortStack.arpResult.Operation = 0xffff (wait)
-3. Upon corresponding ARP reply in `recvARP`: PortStack.arpResult.Operation = 2 (reply).
+# Neighbor cache (outgoing requests)
 
-If `BeginResolveARPv4` is called at any point in resolution, the state is reset to 1.
+arpClient.cache contains an entry per address being resolved or resolved:
+ 1. Upon user request `BeginResolve` or a lookup of a stale entry: the entry is flagged as resolving
+    with a zero request time, which means a request has not been sent out. New entries are incomplete.
+ 2. Upon `handle`: A request is broadcast and the request time set. Unanswered requests are
+    retried every arpRetryInterval. After arpMaxRequests unanswered requests the entry is removed.
+ 3. Upon a corresponding ARP reply or request from the address in `recv`: The entry is reachable
+    until arpReachableTime passes without confirmation, after which it becomes stale.
 
 # External ARP incoming request
 
@@ -38,66 +66,264 @@ PortStack.pendingARPresponse contains state:
 1. Upon ARP request in `recvARP`, case 1: Store outgoing ARP response in PortStack.pendingARPresponse. PortStack.pendingARPresponse.Operation = 2 (reply)
 2. Upon `handleARP`: Packet sent out. PortStack.pendingARPresponse.Operation = 0 (no pending response) Ready to receive.
 */
-type arpClient struct {
-	stack           *PortStack
-	result          eth.ARPv4Header
+
+// ARPClient resolves IPv4 addresses to hardware addresses on the local network
+// and caches the results. It answers ARP requests for the PortStack's address,
+// announces the address with gratuitous ARP and detects address conflicts.
+// Requests are sent out on calls to [PortStack.HandleEth].
+type ARPClient struct {
+	stack *PortStack
+	cache []arpEntry
+	// lastResolve is the address of the last call to BeginResolve, whose result is returned by ResultAs6.
+	lastResolve [4]byte
+	// lastFailed is set when resolution of lastResolve timed out.
+	lastFailed      bool
 	pendingResponse eth.ARPv4Header
+	probe           arpProbe
+	// announceLeft is the amount of announcements left to send, the next sent at announceNext.
+	announceLeft uint8
+	announceNext time.Time
+	rand         uint32
+	// notify guards the cache and the probe and announcement state shared between
+	// users and the PortStack and wakes users blocked in Resolve and Probe.
+	notify notifier
+}
+
+// arpProbe is the state of address conflict detection. See RFC 5227 section 2.1.
+type arpProbe struct {
+	addr [4]byte
+	// sent is the amount of probes sent.
+	sent uint8
+	// next is the time at which the next probe is sent or, after the last probe, the time probing ends.
+	next     time.Time
+	running  bool
+	conflict bool
 }
 
-func (c *arpClient) ResultAs6() (netip.Addr, [6]byte, error) {
-	switch c.result.Operation {
-	case 0:
+// arpState is the state of an entry in the ARP cache.
+type arpState uint8
+
+const (
+	arpFree       arpState = iota // Entry not in use.
+	arpIncomplete                 // Resolution in progress, hardware address unknown.
+	arpReachable                  // Hardware address recently confirmed.
+	arpStale                      // Hardware address not confirmed in arpReachableTime, usable but refreshed on use.
+)
+
+type arpEntry struct {
+	addr  [4]byte
+	mac   [6]byte
+	state arpState
+	// updated is the time of the last confirmation of the hardware address or the entry creation.
+	updated time.Time
+	// resolving is set while requests for the address are being sent.
+	resolving bool
+	// reqSent is the time the last request was sent. Zero if a request must be sent.
+	reqSent time.Time
+	// requests is the amount of unanswered requests sent.
+	requests uint8
+}
+
+// ResultAs6 returns the result of the last resolution started with BeginResolve.
+func (c *ARPClient) ResultAs6() (netip.Addr, [6]byte, error) {
+	c.notify.lock()
+	defer c.notify.unlock()
+	if c.lastFailed {
+		return netip.Addr{}, [6]byte{}, errARPTimeout
+	}
+	e := c.find(c.lastResolve)
+	switch {
+	case e == nil:
 		return netip.Addr{}, [6]byte{}, errNoARPInProgress
-	case 1:
+	case e.state == arpIncomplete:
 		return netip.Addr{}, [6]byte{}, errARPResponsePending
 	}
-	return netip.AddrFrom4(c.result.ProtoSender), c.result.HardwareSender, nil
+	return netip.AddrFrom4(e.addr), e.mac, nil
 }
 
-func (c *arpClient) BeginResolve(addr netip.Addr) error {
+// BeginResolve starts resolution of addr. The result is queried with ResultAs6 or Lookup.
+// Addresses in the cache are not requested again unless stale.
+func (c *ARPClient) BeginResolve(addr netip.Addr) error {
+	c.notify.lock()
+	defer c.notify.unlock()
+	return c.beginResolve(addr)
+}
+
+// beginResolve implements BeginResolve. c must be locked.
+func (c *ARPClient) beginResolve(addr netip.Addr) error {
 	if !addr.Is4() {
 		return errIPVersion
 	}
-	c.result = eth.ARPv4Header{
-		Operation:      1, // Request.
-		HardwareType:   1, // Ethernet.
-		ProtoType:      uint16(eth.EtherTypeIPv4),
-		HardwareLength: 6,
-		ProtoLength:    4,
-		HardwareSender: c.stack.MACAs6(),
-		ProtoSender:    c.stack.ip,
-		HardwareTarget: [6]byte{}, // Zeroes, is filled by target.
-		ProtoTarget:    addr.As4(),
+	addr4 := addr.As4()
+	c.age(c.stack.now())
+	e := c.find(addr4)
+	if e == nil {
+		e = c.alloc()
+		if e == nil {
+			return errARPCacheFull
+		}
+		*e = arpEntry{addr: addr4, state: arpIncomplete, updated: c.stack.now()}
+	}
+	if e.state != arpReachable {
+		e.startResolve()
+	}
+	c.lastResolve = addr4
+	c.lastFailed = false
+	return nil
+}
+
+// Lookup returns the hardware address of addr if present in the cache.
+// Looking up a stale entry starts its refresh.
+func (c *ARPClient) Lookup(addr netip.Addr) (mac [6]byte, ok bool) {
+	c.notify.lock()
+	defer c.notify.unlock()
+	return c.lookup(addr)
+}
+
+// lookup implements Lookup. c must be locked.
+func (c *ARPClient) lookup(addr netip.Addr) (mac [6]byte, ok bool) {
+	if !addr.Is4() {
+		return mac, false
+	}
+	c.age(c.stack.now())
+	e := c.find(addr.As4())
+	if e == nil || e.state == arpIncomplete {
+		return mac, false
+	}
+	if e.state == arpStale && !e.resolving {
+		e.startResolve()
 	}
+	return e.mac, true
+}
+
+// Resolve returns the hardware address of addr. If addr is not cached Resolve sends
+// requests and blocks until a reply is received, the resolution times out or ctx is done.
+// The PortStack must be handled concurrently for requests to be sent.
+func (c *ARPClient) Resolve(ctx context.Context, addr netip.Addr) ([6]byte, error) {
+	c.notify.lock()
+	defer c.notify.unlock()
+	if mac, ok := c.lookup(addr); ok {
+		return mac, nil
+	}
+	err := c.beginResolve(addr)
+	if err != nil {
+		return [6]byte{}, err
+	}
+	addr4 := addr.As4()
+	var mac [6]byte
+	var resolveErr error
+	err = c.notify.waitContext(ctx, func() bool {
+		e := c.find(addr4)
+		switch {
+		case e == nil:
+			resolveErr = errARPTimeout // Entry removed after unanswered requests.
+		case e.state == arpIncomplete:
+			return false
+		default:
+			mac = e.mac
+		}
+		return true
+	})
+	if err == nil {
+		err = resolveErr
+	}
+	return mac, err
+}
+
+// Announce sends gratuitous ARP announcements of the PortStack's address so that
+// other hosts update their caches. Should be called after the address is set. See RFC 5227 section 2.3.
+func (c *ARPClient) Announce() error {
+	c.notify.lock()
+	defer c.notify.unlock()
+	if c.stack.ip == [4]byte{} {
+		return errARPNoAddr
+	}
+	c.announceLeft = arpAnnounceNum
+	c.announceNext = c.stack.now()
 	return nil
 }
 
-func (c *arpClient) isPending() bool {
-	return c.pendingReplyToARP() || c.pendingResolveARPv4()
+// Probe checks whether addr is in use by another host on the network by sending ARP
+// probes and returns [ErrAddrConflict] if a reply or a probe from another host for addr
+// is received. Probe blocks for several seconds until probing ends or ctx is done.
+// It should be called before the address is set with [PortStack.SetAddr]. See RFC 5227 section 2.1.
+// The PortStack must be handled concurrently for probes to be sent.
+func (c *ARPClient) Probe(ctx context.Context, addr netip.Addr) error {
+	if !addr.Is4() {
+		return errIPVersion
+	}
+	c.notify.lock()
+	defer c.notify.unlock()
+	c.probe = arpProbe{
+		addr:    addr.As4(),
+		next:    c.stack.now().Add(c.jitter(arpProbeWait)),
+		running: true,
+	}
+	err := c.notify.waitContext(ctx, func() bool { return !c.probe.running })
+	c.probe.running = false
+	if err != nil {
+		return err
+	} else if c.probe.conflict {
+		return ErrAddrConflict
+	}
+	return nil
+}
+
+func (c *ARPClient) isPending() bool {
+	c.notify.lock()
+	defer c.notify.unlock()
+	return c.pendingReplyToARP() || c.pendingResolveARPv4() || c.probe.running || c.announceLeft > 0
 }
 
-func (c *arpClient) pendingReplyToARP() bool {
+func (c *ARPClient) pendingReplyToARP() bool {
 	return c.pendingResponse.Operation == 2 // 2 means reply.
 }
 
-func (c *arpClient) pendingResolveARPv4() bool {
-	return c.result.Operation == 1 // User asked for a ARP request.
+// pendingResolveARPv4 returns true if there are addresses being resolved. Retries
+// of unanswered requests are sent on future calls to handle.
+func (c *ARPClient) pendingResolveARPv4() bool {
+	for i := range c.cache {
+		if c.cache[i].resolving {
+			return true
+		}
+	}
+	return false
 }
 
-func (c *arpClient) handle(dst []byte) (n int) {
-	pendingResolve := c.pendingResolveARPv4()
+func (c *ARPClient) handle(dst []byte) (n int) {
+	c.notify.lock()
+	defer c.notify.unlock()
+	now := c.stack.now()
+	c.age(now)
+	var request *arpEntry
+	for i := range c.cache {
+		if c.cache[i].resolving && c.cache[i].reqSent.IsZero() {
+			request = &c.cache[i]
+			break
+		}
+	}
 	switch {
-	case pendingResolve:
-		// We have a pending request from user to perform ARP.
-		ehdr := eth.EthernetHeader{
-			Destination:     eth.BroadcastHW6(),
-			Source:          c.stack.MACAs6(),
-			SizeOrEtherType: uint16(eth.EtherTypeARP),
+	case c.probe.running && c.probe.sent < arpProbeNum && !now.Before(c.probe.next):
+		// Probe has a zero sender address so that the caches of other hosts are not polluted.
+		n = c.putRequest(dst, [4]byte{}, c.probe.addr)
+		c.probe.sent++
+		if c.probe.sent < arpProbeNum {
+			c.probe.next = now.Add(arpProbeMin + c.jitter(arpProbeMax-arpProbeMin))
+		} else {
+			c.probe.next = now.Add(arpAnnounceWait)
 		}
-		ehdr.Put(dst)
-		c.result.Put(dst[eth.SizeEthernetHeader:])
-		c.result.Operation = arpOpWait // Clear pending ARP to not loop.
-		n = eth.SizeEthernetHeader + eth.SizeARPv4Header
+
+	case c.announceLeft > 0 && !now.Before(c.announceNext):
+		// Announcement is a request with our address as sender and target.
+		n = c.putRequest(dst, c.stack.ip, c.stack.ip)
+		c.announceLeft--
+		c.announceNext = now.Add(arpAnnounceInterval)
+
+	case request != nil:
+		// We have a pending request to perform ARP.
+		n = c.putRequest(dst, c.stack.ip, request.addr)
+		request.reqSent = now
+		request.requests++
 
 	case c.pendingReplyToARP():
 		// We need to respond to an ARP request that queries our address.
@@ -115,18 +341,53 @@ func (c *arpClient) handle(dst []byte) (n int) {
 		// return 0 // Nothing to do, n=0.
 	}
 	if n > 0 && c.stack.isLogEnabled(slog.LevelDebug) {
-		c.stack.debug("ARP:send", slog.Bool("isReply", !pendingResolve))
+		c.stack.debug("ARP:send", slog.Int("op", int(binary.BigEndian.Uint16(dst[eth.SizeEthernetHeader+6:]))))
 	}
 	return n
 }
 
-func (c *arpClient) recv(ahdr *eth.ARPv4Header) error {
+// putRequest writes a broadcast ARP request for target into dst and returns its length.
+func (c *ARPClient) putRequest(dst []byte, sender, target [4]byte) int {
+	ehdr := eth.EthernetHeader{
+		Destination:     eth.BroadcastHW6(),
+		Source:          c.stack.MACAs6(),
+		SizeOrEtherType: uint16(eth.EtherTypeARP),
+	}
+	ahdr := eth.ARPv4Header{
+		Operation:      1, // Request.
+		HardwareType:   1, // Ethernet.
+		ProtoType:      uint16(eth.EtherTypeIPv4),
+		HardwareLength: 6,
+		ProtoLength:    4,
+		HardwareSender: c.stack.MACAs6(),
+		ProtoSender:    sender,
+		HardwareTarget: [6]byte{}, // Zeroes, is filled by target.
+		ProtoTarget:    target,
+	}
+	ehdr.Put(dst)
+	ahdr.Put(dst[eth.SizeEthernetHeader:])
+	return eth.SizeEthernetHeader + eth.SizeARPv4Header
+}
+
+func (c *ARPClient) recv(ahdr *eth.ARPv4Header) error {
+	c.notify.lock()
+	defer c.notify.unlock()
 	if ahdr.HardwareLength != 6 || ahdr.ProtoLength != 4 || ahdr.HardwareType != 1 || ahdr.AssertEtherType() != eth.EtherTypeIPv4 {
 		return errARPUnsupported // Ignore ARP unsupported requests.
 	}
+	if c.probe.running && ahdr.HardwareSender != c.stack.mac && (ahdr.ProtoSender == c.probe.addr ||
+		(ahdr.Operation == 1 && ahdr.ProtoSender == [4]byte{} && ahdr.ProtoTarget == c.probe.addr)) {
+		// Another host uses the address or is probing for it. See RFC 5227 section 2.1.1.
+		c.stack.info("ARP:conflict", slog.String("addr", netip.AddrFrom4(c.probe.addr).String()))
+		c.probe.conflict = true
+		c.probe.running = false
+		c.notify.broadcast()
+	}
+	forUs := ahdr.ProtoTarget == c.stack.ip
 	switch ahdr.Operation {
 	case 1: // We received ARP request.
-		if c.pendingReplyToARP() || ahdr.ProtoTarget != c.stack.ip {
+		c.update(ahdr.ProtoSender, ahdr.HardwareSender, forUs)
+		if c.pendingReplyToARP() || !forUs {
 			return nil // ARP reply pending or not for us.
 		}
 		// We need to respond to this ARP request by inverting Sender/Target fields.
@@ -139,12 +400,10 @@ func (c *arpClient) recv(ahdr *eth.ARPv4Header) error {
 		c.pendingResponse = *ahdr
 
 	case 2: // We received ARP reply.
-		if c.result.Operation != arpOpWait || // Result already received
-			ahdr.ProtoTarget != c.stack.ip || // Not meant for us.
-			ahdr.ProtoSender != c.result.ProtoTarget { // does not correspond to last request.
-			return nil
+		if !forUs {
+			return nil // Not meant for us.
 		}
-		c.result = *ahdr
+		c.update(ahdr.ProtoSender, ahdr.HardwareSender, false)
 	default:
 		return errARPUnsupported
 	}
@@ -153,3 +412,106 @@ func (c *arpClient) recv(ahdr *eth.ARPv4Header) error {
 	}
 	return nil
 }
+
+// update sets the hardware address of an entry in the cache and marks it reachable.
+// If the address is not in the cache a new entry is created only if insert is set.
+// See the merge flag in RFC 826 packet reception. c must be locked.
+func (c *ARPClient) update(addr [4]byte, mac [6]byte, insert bool) {
+	if addr == ([4]byte{}) {
+		return // Probe from a host without address.
+	}
+	e := c.find(addr)
+	if e == nil {
+		if !insert {
+			return
+		}
+		e = c.alloc()
+		if e == nil {
+			return
+		}
+	}
+	*e = arpEntry{addr: addr, mac: mac, state: arpReachable, updated: c.stack.now()}
+	c.notify.broadcast()
+}
+
+// age updates the state of the cache entries to the current time. c must be locked.
+func (c *ARPClient) age(now time.Time) {
+	for i := range c.cache {
+		e := &c.cache[i]
+		if e.state == arpReachable && now.Sub(e.updated) > arpReachableTime {
+			e.state = arpStale
+		}
+		if !e.resolving || e.reqSent.IsZero() || now.Sub(e.reqSent) < arpRetryInterval {
+			continue
+		}
+		if e.requests < arpMaxRequests {
+			e.reqSent = time.Time{} // Retry.
+			continue
+		}
+		// Unanswered, address unreachable.
+		if c.stack.isLogEnabled(slog.LevelDebug) {
+			c.stack.debug("ARP:timeout", slog.String("addr", netip.AddrFrom4(e.addr).String()))
+		}
+		if e.addr == c.lastResolve {
+			c.lastFailed = true
+		}
+		*e = arpEntry{}
+		c.notify.broadcast()
+	}
+	if c.probe.running && c.probe.sent == arpProbeNum && !now.Before(c.probe.next) {
+		c.probe.running = false // No conflict detected.
+		c.notify.broadcast()
+	}
+}
+
+func (c *ARPClient) find(addr [4]byte) *arpEntry {
+	for i := range c.cache {
+		if c.cache[i].state != arpFree && c.cache[i].addr == addr {
+			return &c.cache[i]
+		}
+	}
+	return nil
+}
+
+// alloc returns a free entry, evicting the least recently confirmed resolved entry if the cache is full.
+// It returns nil if all entries are being resolved.
+func (c *ARPClient) alloc() *arpEntry {
+	var oldest *arpEntry
+	for i := range c.cache {
+		e := &c.cache[i]
+		switch {
+		case e.state == arpFree:
+			return e
+		case e.state != arpIncomplete && (oldest == nil || e.updated.Before(oldest.updated)):
+			oldest = e
+		}
+	}
+	return oldest
+}
+
+// jitter returns a pseudo random duration in [0, max).
+func (c *ARPClient) jitter(max time.Duration) time.Duration {
+	if c.rand == 0 {
+		mac := c.stack.mac
+		c.rand = uint32(c.stack.now().UnixNano()) ^ binary.BigEndian.Uint32(mac[2:]) | 1
+	}
+	c.rand = prand32(c.rand)
+	return time.Duration(c.rand) % max
+}
+
+// isResolving returns true if the hardware address of addr is being resolved and is not yet known.
+func (c *ARPClient) isResolving(addr netip.Addr) bool {
+	c.notify.lock()
+	defer c.notify.unlock()
+	if !addr.Is4() {
+		return false
+	}
+	e := c.find(addr.As4())
+	return e != nil && e.state == arpIncomplete
+}
+
+func (e *arpEntry) startResolve() {
+	e.resolving = true
+	e.reqSent = time.Time{}
+	e.requests = 0
+}
@@ -0,0 +1,163 @@
+package stacks
+
+import (
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"time"
+
+	"github.com/soypat/seqs"
+)
+
+var (
+	_ net.Conn     = (*TCPConn)(nil)
+	_ net.Listener = (*netListener)(nil)
+)
+
+// TCPConn adapts a TCPSocket to the [net.Conn] interface so that standard library
+// packages such as bufio, crypto/tls and net/http can run over a PortStack.
+// Write blocks until all data is queued in the socket's output buffer.
+// Read returns [io.EOF] once the remote has closed the connection and all received data was read.
+// Operations that exceed a deadline return [os.ErrDeadlineExceeded].
+type TCPConn struct {
+	sock          *TCPSocket
+	readDeadline  time.Time
+	writeDeadline time.Time
+	closed        bool
+}
+
+// NewTCPConn returns a TCPConn using the open socket sock.
+func NewTCPConn(sock *TCPSocket) *TCPConn {
+	return &TCPConn{sock: sock}
+}
+
+// Socket returns the TCPSocket underlying the connection.
+func (c *TCPConn) Socket() *TCPSocket { return c.sock }
+
+// Read reads data received from the remote into b. It blocks until data is
+// available, the remote closes the connection or the read deadline is exceeded.
+func (c *TCPConn) Read(b []byte) (int, error) {
+	sock := c.sock
+	sock.notify.lock()
+	defer sock.notify.unlock()
+	if c.closed {
+		return 0, net.ErrClosed
+	} else if len(b) == 0 {
+		return 0, nil
+	}
+	sock.notify.wait(&c.readDeadline, func() bool {
+		return sock.rx.Buffered() > 0 || c.closed || sock.abortErr != nil || remoteClosed(sock.scb.State())
+	})
+	switch {
+	case sock.rx.Buffered() > 0:
+		return sock.rx.Read(b)
+	case c.closed:
+		return 0, net.ErrClosed
+	case sock.abortErr != nil:
+		return 0, sock.abortErr
+	case remoteClosed(sock.scb.State()):
+		return 0, io.EOF
+	}
+	return 0, os.ErrDeadlineExceeded
+}
+
+// Write queues b to be sent to the remote. It blocks until all of b is queued
+// in the socket's output buffer or the write deadline is exceeded.
+func (c *TCPConn) Write(b []byte) (n int, err error) {
+	c.sock.notify.lock()
+	defer c.sock.notify.unlock()
+	return c.sock.writeWait(b, &c.writeDeadline, func() bool { return c.closed })
+}
+
+// Close closes the connection. Data queued by Write is sent before the
+// connection is terminated. Blocked Read and Write operations return [net.ErrClosed].
+func (c *TCPConn) Close() error {
+	c.sock.notify.lock()
+	if c.closed {
+		c.sock.notify.unlock()
+		return net.ErrClosed
+	}
+	c.closed = true
+	c.sock.notify.unlock()
+	return c.sock.Close() // Wakes blocked Read and Write calls.
+}
+
+// LocalAddr returns the local address of the connection as a [*net.TCPAddr].
+func (c *TCPConn) LocalAddr() net.Addr {
+	return net.TCPAddrFromAddrPort(netip.AddrPortFrom(c.sock.stack.Addr(), c.sock.localPort))
+}
+
+// RemoteAddr returns the remote address of the connection as a [*net.TCPAddr].
+func (c *TCPConn) RemoteAddr() net.Addr {
+	return net.TCPAddrFromAddrPort(c.sock.remote)
+}
+
+// SetDeadline sets the read and write deadlines. A zero value disables the deadlines.
+// Blocked Read and Write calls are woken up and observe the new deadlines.
+func (c *TCPConn) SetDeadline(t time.Time) error {
+	c.setDeadlines(&t, &t)
+	return nil
+}
+
+// SetReadDeadline sets the deadline for Read calls. A zero value disables the deadline.
+// A blocked Read call is woken up and observes the new deadline.
+func (c *TCPConn) SetReadDeadline(t time.Time) error {
+	c.setDeadlines(&t, nil)
+	return nil
+}
+
+// SetWriteDeadline sets the deadline for Write calls. A zero value disables the deadline.
+// A blocked Write call is woken up and observes the new deadline.
+func (c *TCPConn) SetWriteDeadline(t time.Time) error {
+	c.setDeadlines(nil, &t)
+	return nil
+}
+
+// setDeadlines sets the non-nil deadlines under the socket lock and wakes waiters
+// so that they re-evaluate their deadline.
+func (c *TCPConn) setDeadlines(read, write *time.Time) {
+	c.sock.notify.lock()
+	defer c.sock.notify.unlock()
+	if read != nil {
+		c.readDeadline = *read
+	}
+	if write != nil {
+		c.writeDeadline = *write
+	}
+	c.sock.notify.broadcast()
+}
+
+// NetListener returns a [net.Listener] which accepts connections on l as [*TCPConn].
+func (l *TCPListener) NetListener() net.Listener {
+	return &netListener{l: l}
+}
+
+type netListener struct {
+	l *TCPListener
+}
+
+func (nl *netListener) Accept() (net.Conn, error) {
+	sock, err := nl.l.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return NewTCPConn(sock), nil
+}
+
+func (nl *netListener) Close() error { return nl.l.Close() }
+
+// Addr returns the listening address as a [*net.TCPAddr].
+func (nl *netListener) Addr() net.Addr {
+	return net.TCPAddrFromAddrPort(netip.AddrPortFrom(nl.l.stack.Addr(), nl.l.Port()))
+}
+
+// remoteClosed returns true if no more data can be received in state,
+// which is the case once the remote's FIN has been received or the connection is closed.
+func remoteClosed(state seqs.State) bool {
+	switch state {
+	case seqs.StateCloseWait, seqs.StateLastAck, seqs.StateClosing, seqs.StateTimeWait, seqs.StateClosed:
+		return true
+	}
+	return false
+}
@@ -18,19 +18,29 @@ var (
 	errUnexpectedXid  = errors.New("unexpected xid")
 )
 
+// DHCPClient requests an address from a DHCP server. Once the server acknowledges the
+// request the subnet and router received are added to the PortStack's routing table,
+// replacing the routes added for a previous lease.
 type DHCPClient struct {
 	stack *PortStack
 	state uint8
 	// The result IP of the DHCP transaction (our new IP).
 	offer [4]byte
 	// DHCP server IP
-	svip        [4]byte
+	svip [4]byte
+	// Subnet mask and default gateway received from the server. Zero if not received.
+	subnetMask  [4]byte
+	router      [4]byte
 	requestedIP [4]byte
 	currentXid  uint32
 	port        uint16
 	aborted     bool
 	aux         UDPPacket // Avoid heap allocation.
 	optionbuf   [4]dhcp.Option
+	// routeSubnet and routeGateway are the routes added to the PortStack for the last
+	// acknowledged lease. Invalid if not added. Kept on abort so they can be replaced.
+	routeSubnet  netip.Prefix
+	routeGateway netip.Addr
 }
 
 // State transition table:
@@ -87,6 +97,29 @@ func (d *DHCPClient) Offer() netip.Addr {
 	return netip.AddrFrom4(d.offer)
 }
 
+// Router returns the default gateway received from the server. Invalid if none was received.
+func (d *DHCPClient) Router() netip.Addr {
+	if d.router == [4]byte{} {
+		return netip.Addr{}
+	}
+	return netip.AddrFrom4(d.router)
+}
+
+// Subnet returns the offered address' network as given by the subnet mask received
+// from the server. Invalid if no valid mask was received.
+func (d *DHCPClient) Subnet() netip.Prefix {
+	ones := 0
+	mask := binary.BigEndian.Uint32(d.subnetMask[:])
+	for mask&(1<<31) != 0 {
+		ones++
+		mask <<= 1
+	}
+	if ones == 0 || mask != 0 {
+		return netip.Prefix{} // No mask or non contiguous mask.
+	}
+	return netip.PrefixFrom(d.Offer(), ones).Masked()
+}
+
 func (d *DHCPClient) ourHeader() dhcp.HeaderV4 {
 	hdr := dhcp.HeaderV4{
 		OP:     dhcp.OpRequest,
@@ -211,6 +244,14 @@ func (d *DHCPClient) recv(pkt *UDPPacket) (err error) {
 			if len(opt.Data) == 1 {
 				msgType = dhcp.MessageType(opt.Data[0])
 			}
+		case dhcp.OptSubnetMask:
+			if len(opt.Data) == 4 {
+				d.subnetMask = [4]byte(opt.Data)
+			}
+		case dhcp.OptRouter:
+			if len(opt.Data) >= 4 {
+				d.router = [4]byte(opt.Data[:4]) // Routers listed in order of preference.
+			}
 		}
 		if debugEnabled {
 			d.stack.debug("DHCP:rx", slog.String("opt", opt.Num.String()), slog.String("data", stringNumList(opt.Data)))
@@ -229,6 +270,7 @@ func (d *DHCPClient) recv(pkt *UDPPacket) (err error) {
 	case dhcpStateWaitAck:
 		if msgType == dhcp.MsgAck {
 			d.state = dhcpStateDone
+			d.addRoutes()
 		}
 	case dhcpStateDone:
 		err = io.EOF // We got a valid response, close socket.
@@ -241,6 +283,36 @@ func (d *DHCPClient) recv(pkt *UDPPacket) (err error) {
 	return nil
 }
 
+// addRoutes adds the routes to the subnet and through the default gateway received from the server.
+// Routes added for a previous lease are removed first so that a stale gateway is not used.
+func (d *DHCPClient) addRoutes() {
+	defaultRoute := netip.PrefixFrom(netip.IPv4Unspecified(), 0)
+	if d.routeSubnet.IsValid() {
+		d.stack.RemoveRoute(d.routeSubnet, netip.Addr{})
+		d.routeSubnet = netip.Prefix{}
+	}
+	if d.routeGateway.IsValid() {
+		d.stack.RemoveRoute(defaultRoute, d.routeGateway)
+		d.routeGateway = netip.Addr{}
+	}
+	var err error
+	if subnet := d.Subnet(); subnet.IsValid() {
+		err = d.stack.AddRoute(Route{Prefix: subnet})
+		if err == nil {
+			d.routeSubnet = subnet
+		}
+	}
+	if router := d.Router(); router.IsValid() && err == nil {
+		err = d.stack.AddRoute(Route{Prefix: defaultRoute, Gateway: router})
+		if err == nil {
+			d.routeGateway = router
+		}
+	}
+	if err != nil {
+		d.stack.error("DHCP:route", slog.String("err", err.Error()))
+	}
+}
+
 func (d *DHCPClient) isPendingHandling() bool {
 	return !d.isAborted() && d.state != dhcpStateDone
 }
@@ -251,8 +323,10 @@ func (d *DHCPClient) Abort() {
 
 func (d *DHCPClient) abort() {
 	*d = DHCPClient{
-		stack: d.stack,
-		port:  d.port,
+		stack:        d.stack,
+		port:         d.port,
+		routeSubnet:  d.routeSubnet,
+		routeGateway: d.routeGateway,
 	}
 }
 
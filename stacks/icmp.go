@@ -0,0 +1,262 @@
+package stacks
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log/slog"
+	"net/netip"
+	"time"
+
+	"github.com/soypat/seqs/eth"
+)
+
+var (
+	errICMPChecksum = errors.New("invalid ICMP checksum")
+	errNoPing       = errors.New("no ping in progress")
+	errPingPending  = errors.New("ping reply pending")
+)
+
+// ICMP returns the ICMPv4 handler of the stack.
+func (ps *PortStack) ICMP() *ICMPv4 {
+	return &ps.icmp
+}
+
+// ICMPv4 answers echo requests addressed to the PortStack so that it can be pinged
+// and sends echo requests to measure the round trip time to other hosts. See RFC 792.
+// Replies and requests are sent out on calls to [PortStack.HandleEth].
+type ICMPv4 struct {
+	stack *PortStack
+	// replyLen is the length of the pending echo reply in reply. Zero when there is no pending reply.
+	replyLen int
+	reply    [defaultMTU]byte
+	ipID     uint16
+	ping     pingState
+	// notify guards the reply and ping state shared between users and the
+	// PortStack and wakes users blocked in Ping.
+	notify notifier
+}
+
+// pingStatus is the state of an echo request sent by the user.
+type pingStatus uint8
+
+const (
+	pingNone    pingStatus = iota // No ping in progress.
+	pingPending                   // Echo request waiting to be sent, possibly for next hop resolution.
+	pingSent                      // Echo request sent, waiting for reply.
+	pingDone                      // Echo reply received.
+	pingFailed                    // Next hop could not be resolved.
+)
+
+type pingState struct {
+	status  pingStatus
+	addr    netip.Addr
+	nextHop netip.Addr
+	mac     [6]byte
+	id      uint16
+	seq     uint16
+	data    []byte
+	sent    time.Time
+	rtt     time.Duration
+}
+
+// BeginPing starts sending an echo request with payload to addr. The hardware address of the
+// next hop is resolved with ARP before the request is sent. The result is queried with PingResult.
+// Starting a new ping cancels the previous one.
+func (ic *ICMPv4) BeginPing(addr netip.Addr, payload []byte) error {
+	ic.notify.lock()
+	defer ic.notify.unlock()
+	return ic.beginPing(addr, payload)
+}
+
+// beginPing implements BeginPing. ic must be locked.
+func (ic *ICMPv4) beginPing(addr netip.Addr, payload []byte) error {
+	ps := ic.stack
+	switch {
+	case !addr.Is4():
+		return errIPVersion
+	case eth.SizeEthernetHeader+eth.SizeIPv4Header+eth.SizeICMPv4Header+len(payload) > int(ps.mtu):
+		return errPacketExceedsMTU
+	}
+	nextHop := ps.nextHop(addr)
+	if !nextHop.IsValid() {
+		return ErrHostUnreachable // No route to addr.
+	}
+	mac, ok := ps.arpClient.Lookup(nextHop)
+	if !ok {
+		err := ps.arpClient.BeginResolve(nextHop)
+		if err != nil {
+			return err
+		}
+	}
+	if ic.ping.id == 0 {
+		ic.ping.id = prand16(uint16(ps.now().UnixNano()) | 1)
+	}
+	ic.ping = pingState{
+		status:  pingPending,
+		addr:    addr,
+		nextHop: nextHop,
+		mac:     mac,
+		id:      ic.ping.id,
+		seq:     ic.ping.seq + 1,
+		data:    append(ic.ping.data[:0], payload...),
+	}
+	return nil
+}
+
+// PingResult returns the round trip time of the last ping started with BeginPing.
+func (ic *ICMPv4) PingResult() (time.Duration, error) {
+	ic.notify.lock()
+	defer ic.notify.unlock()
+	return ic.pingResult()
+}
+
+// pingResult implements PingResult. ic must be locked.
+func (ic *ICMPv4) pingResult() (time.Duration, error) {
+	switch ic.ping.status {
+	case pingNone:
+		return 0, errNoPing
+	case pingPending, pingSent:
+		return 0, errPingPending
+	case pingFailed:
+		return 0, ErrHostUnreachable
+	}
+	return ic.ping.rtt, nil
+}
+
+// Ping sends an echo request with payload to addr and blocks until the reply is received
+// or ctx is done, returning the round trip time. ctx should have a deadline since lost
+// requests are not retransmitted. The PortStack must be handled concurrently for the request to be sent.
+func (ic *ICMPv4) Ping(ctx context.Context, addr netip.Addr, payload []byte) (time.Duration, error) {
+	ic.notify.lock()
+	defer ic.notify.unlock()
+	err := ic.beginPing(addr, payload)
+	if err != nil {
+		return 0, err
+	}
+	err = ic.notify.waitContext(ctx, func() bool {
+		return ic.ping.status == pingDone || ic.ping.status == pingFailed
+	})
+	if err != nil {
+		ic.ping.status = pingNone
+		return 0, err
+	}
+	return ic.pingResult()
+}
+
+func (ic *ICMPv4) isPending() bool {
+	ic.notify.lock()
+	defer ic.notify.unlock()
+	return ic.replyLen > 0 || ic.ping.status == pingPending
+}
+
+func (ic *ICMPv4) handle(dst []byte) (n int) {
+	ic.notify.lock()
+	defer ic.notify.unlock()
+	if ic.replyLen > 0 {
+		n = copy(dst, ic.reply[:ic.replyLen])
+		ic.replyLen = 0
+		return n
+	}
+	if ic.ping.status != pingPending || !ic.resolveNextHop() {
+		return 0
+	}
+	ping := &ic.ping
+	icmp := eth.ICMPv4Header{
+		Type: eth.ICMPv4Echo,
+		ID:   ping.id,
+		Seq:  ping.seq,
+	}
+	icmp.Checksum = icmp.CalculateChecksum(ping.data)
+	n = ic.putPacket(dst, ping.mac, ping.addr.As4(), &icmp, ping.data)
+	ping.sent = ic.stack.now()
+	ping.status = pingSent
+	if ic.stack.isLogEnabled(slog.LevelDebug) {
+		ic.stack.debug("ICMP:echo", slog.String("addr", ping.addr.String()), slog.Uint64("seq", uint64(ping.seq)))
+	}
+	return n
+}
+
+// resolveNextHop sets the hardware address of the pending ping's next hop once resolved by ARP.
+// It returns true if the echo request can be sent. ic must be locked.
+func (ic *ICMPv4) resolveNextHop() bool {
+	ping := &ic.ping
+	if ping.mac != ([6]byte{}) {
+		return true
+	}
+	mac, ok := ic.stack.arpClient.Lookup(ping.nextHop)
+	if ok {
+		ping.mac = mac
+	} else if !ic.stack.arpClient.isResolving(ping.nextHop) {
+		ping.status = pingFailed
+		ic.notify.broadcast()
+	}
+	return ok
+}
+
+// recv processes an ICMP message. payload contains the ICMP header and message.
+func (ic *ICMPv4) recv(ehdr *eth.EthernetHeader, ihdr *eth.IPv4Header, payload []byte) error {
+	ic.notify.lock()
+	defer ic.notify.unlock()
+	if len(payload) < eth.SizeICMPv4Header {
+		return errPacketSmol
+	}
+	icmp := eth.DecodeICMPv4Header(payload)
+	data := payload[eth.SizeICMPv4Header:]
+	if icmp.CalculateChecksum(data) != icmp.Checksum {
+		return errICMPChecksum
+	}
+	ps := ic.stack
+	switch icmp.Type {
+	case eth.ICMPv4Echo:
+		if ic.replyLen > 0 || ihdr.Destination != ps.ip || ps.ip == [4]byte{} {
+			return nil // Reply pending or echo to broadcast address, drop.
+		}
+		// Echo reply has the same identifier, sequence number and data as the request.
+		icmp.Type = eth.ICMPv4EchoReply
+		icmp.Checksum = icmp.CalculateChecksum(data)
+		ic.replyLen = ic.putPacket(ic.reply[:], ehdr.Source, ihdr.Source, &icmp, data)
+
+	case eth.ICMPv4EchoReply:
+		ping := &ic.ping
+		if ping.status != pingSent || icmp.ID != ping.id || icmp.Seq != ping.seq ||
+			ihdr.Source != ping.addr.As4() || !bytes.Equal(data, ping.data) {
+			return nil // Not a reply to our last request.
+		}
+		ping.rtt = ps.lastRx.Sub(ping.sent)
+		ping.status = pingDone
+		ic.notify.broadcast()
+	}
+	if ps.isLogEnabled(slog.LevelDebug) {
+		ps.debug("ICMP:recv", slog.Int("type", int(icmp.Type)), slog.Int("plen", len(data)))
+	}
+	return nil
+}
+
+// putPacket writes an ICMP message with its Ethernet and IP headers into dst and returns its length.
+func (ic *ICMPv4) putPacket(dst []byte, dstMAC [6]byte, dstIP [4]byte, icmp *eth.ICMPv4Header, data []byte) int {
+	const ipLenInWords = 5
+	ic.ipID = prand16(ic.ipID + 1)
+	ihdr := eth.IPv4Header{
+		VersionAndIHL: ipLenInWords,
+		TotalLength:   4*ipLenInWords + eth.SizeICMPv4Header + uint16(len(data)),
+		ID:            ic.ipID,
+		TTL:           64,
+		Protocol:      1,
+		Source:        ic.stack.ip,
+		Destination:   dstIP,
+	}
+	ihdr.Checksum = ihdr.CalculateChecksum()
+	ehdr := eth.EthernetHeader{
+		Destination:     dstMAC,
+		Source:          ic.stack.mac,
+		SizeOrEtherType: uint16(eth.EtherTypeIPv4),
+	}
+	ehdr.Put(dst)
+	ihdr.Put(dst[eth.SizeEthernetHeader:])
+	ptr := eth.SizeEthernetHeader + eth.SizeIPv4Header
+	icmp.Put(dst[ptr:])
+	ptr += eth.SizeICMPv4Header
+	ptr += copy(dst[ptr:], data)
+	return ptr
+}
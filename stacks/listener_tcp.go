@@ -0,0 +1,281 @@
+package stacks
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"net/netip"
+
+	"github.com/soypat/seqs"
+)
+
+var _ itcphandler = (*TCPListener)(nil)
+
+var (
+	errListenerOpen       = errors.New("listener already open")
+	errListenerNoConns    = errors.New("listener requires at least one connection")
+	errListenerSharedCC   = errors.New("listener connections can't share congestion control, use NewCongestionControl")
+	errListenerBadBacklog = errors.New("listener backlog exceeds connections")
+)
+
+// listenerSlot is the state of a socket in the listener's pool.
+type listenerSlot uint8
+
+const (
+	slotFree     listenerSlot = iota // Socket available for a new connection.
+	slotBacklog                      // Connection in progress or established and waiting to be accepted.
+	slotAccepted                     // Connection returned by Accept, owned by the user until closed.
+)
+
+// TCPListener accepts multiple TCP connections on a single local port. Incoming
+// connections are handled by sockets from a pool allocated on creation. Each connection
+// occupies a port of the PortStack keyed by the remote address so the listening port
+// only receives new connection requests. Connections which have not yet been accepted,
+// either still in the handshake or established, are kept in a bounded backlog.
+// SYNs received while the backlog is full are dropped and retransmitted by the remote.
+type TCPListener struct {
+	stack *PortStack
+	port  uint16
+	iss   seqs.Value
+	conns []TCPSocket
+	slots []listenerSlot
+	// backlog is the maximum amount of connections in the slotBacklog state.
+	backlog int
+	// notify guards the listener and the sockets in its pool, which share it,
+	// and wakes users blocked in Accept or on the sockets.
+	notify notifier
+}
+
+type TCPListenerConfig struct {
+	// MaxConnections is the size of the socket pool. It limits the amount of
+	// connections open at a time including connections in the backlog.
+	MaxConnections int
+	// Backlog is the maximum amount of connections that have not been accepted.
+	// Defaults to MaxConnections.
+	Backlog int
+	// ConnConfig configures the sockets in the pool. ConnConfig.CongestionControl must be nil.
+	ConnConfig TCPSocketConfig
+	// NewCongestionControl, if set, is called once for each socket in the pool
+	// to create its congestion control algorithm.
+	NewCongestionControl func() seqs.CongestionControl
+}
+
+// NewTCPListener creates a TCPListener and allocates its socket pool.
+func NewTCPListener(stack *PortStack, cfg TCPListenerConfig) (*TCPListener, error) {
+	switch {
+	case cfg.MaxConnections <= 0:
+		return nil, errListenerNoConns
+	case cfg.Backlog > cfg.MaxConnections:
+		return nil, errListenerBadBacklog
+	case cfg.ConnConfig.CongestionControl != nil:
+		return nil, errListenerSharedCC
+	}
+	if cfg.Backlog <= 0 {
+		cfg.Backlog = cfg.MaxConnections
+	}
+	l := &TCPListener{
+		stack:   stack,
+		conns:   make([]TCPSocket, cfg.MaxConnections),
+		slots:   make([]listenerSlot, cfg.MaxConnections),
+		backlog: cfg.Backlog,
+	}
+	for i := range l.conns {
+		connCfg := cfg.ConnConfig
+		if cfg.NewCongestionControl != nil {
+			connCfg.CongestionControl = cfg.NewCongestionControl()
+		}
+		sock, err := NewTCPSocket(stack, connCfg)
+		if err != nil {
+			return nil, err
+		}
+		sock.listener = l
+		sock.notify = &l.notify
+		l.conns[i] = *sock
+	}
+	return l, nil
+}
+
+// PortStack returns the PortStack that this listener is attached to.
+func (l *TCPListener) PortStack() *PortStack { return l.stack }
+
+// Port returns the local port on which the listener accepts connections. Zero if not listening.
+func (l *TCPListener) Port() uint16 {
+	l.notify.lock()
+	defer l.notify.unlock()
+	return l.port
+}
+
+// Listen opens the local port and starts accepting connections. The initial send sequence
+// number of the first connection is iss, subsequent connections use pseudo random numbers derived from it.
+func (l *TCPListener) Listen(localPort uint16, iss seqs.Value) error {
+	l.notify.lock()
+	defer l.notify.unlock()
+	if l.port != 0 {
+		return errListenerOpen
+	}
+	l.port = localPort
+	l.iss = iss
+	err := l.stack.OpenTCP(localPort, l)
+	if err != nil {
+		l.port = 0
+	}
+	return err
+}
+
+// Accept waits for an established connection in the backlog and returns its socket.
+// The socket must be closed with [TCPSocket.Close] to return it to the pool once the user is done with it.
+// Accept returns [net.ErrClosed] if the listener is closed.
+func (l *TCPListener) Accept() (*TCPSocket, error) {
+	l.notify.lock()
+	defer l.notify.unlock()
+	accepted := -1
+	l.notify.wait(nil, func() bool {
+		accepted = l.acceptable()
+		return accepted >= 0 || l.port == 0
+	})
+	if accepted < 0 {
+		return nil, net.ErrClosed
+	}
+	l.slots[accepted] = slotAccepted
+	return &l.conns[accepted], nil
+}
+
+// acceptable returns the index of an established connection in the backlog or -1 if there is none.
+func (l *TCPListener) acceptable() int {
+	for i := range l.conns {
+		state := l.conns[i].scb.State()
+		if l.slots[i] == slotBacklog && !state.IsPreestablished() && state != seqs.StateClosed {
+			return i
+		}
+	}
+	return -1
+}
+
+// Close closes the listening port and aborts the connections in the backlog.
+// Accepted connections are not affected.
+func (l *TCPListener) Close() error {
+	if l.Port() == 0 {
+		return net.ErrClosed
+	}
+	return l.stack.closeTCP(l)
+}
+
+// recv receives segments addressed to the listening port which do not belong to a connection.
+func (l *TCPListener) recv(pkt *TCPPacket) error {
+	if pkt.TCP.Flags()&(seqs.FlagSYN|seqs.FlagACK|seqs.FlagRST) != seqs.FlagSYN {
+		// Segment is not a connection request and belongs to no connection. See RFC 9293 section 3.10.7.2.
+		l.stack.rejecter.rejectTCP(&pkt.Eth, &pkt.IP, &pkt.TCP, len(pkt.Payload()))
+		return nil
+	}
+	remote := netip.AddrPortFrom(netip.AddrFrom4(pkt.IP.Source), pkt.TCP.SourcePort)
+	l.notify.lock()
+	conn := l.newConn(remote)
+	l.notify.unlock()
+	if conn == nil {
+		l.stack.debug("TCP:backlog-full", slog.Uint64("port", uint64(l.port)))
+		return nil // Drop SYN, remote will retransmit.
+	}
+	err := conn.recv(pkt)
+	l.notify.lock()
+	admitted := err != io.EOF && conn.remote.IsValid()
+	l.notify.unlock()
+	if !admitted {
+		// SYN was not admitted, return socket to pool.
+		l.stack.closeTCP(conn)
+		err = nil
+	}
+	return err
+}
+
+// send is a no-op, connections send over their own ports.
+func (l *TCPListener) send(dst []byte) (n int, err error) { return 0, nil }
+
+func (l *TCPListener) isPendingHandling() bool { return false }
+
+func (l *TCPListener) isTimerRunning() bool { return false }
+
+// abort is called by the PortStack when the listening port is closed.
+func (l *TCPListener) abort() {
+	for i := range l.conns {
+		l.notify.lock()
+		inBacklog := l.slots[i] == slotBacklog
+		l.notify.unlock()
+		if inBacklog {
+			l.stack.closeTCP(&l.conns[i]) // Locks the listener on abort.
+		}
+	}
+	l.notify.lock()
+	l.port = 0
+	l.notify.broadcast()
+	l.notify.unlock()
+}
+
+// newConn takes a socket from the pool, opens its port for the connection
+// with remote and prepares it to receive a SYN. It returns nil if the backlog
+// is full or there are no sockets or ports available.
+func (l *TCPListener) newConn(remote netip.AddrPort) *TCPSocket {
+	free := -1
+	inBacklog := 0
+	for i := range l.slots {
+		switch l.slots[i] {
+		case slotFree:
+			if free < 0 {
+				free = i
+			}
+		case slotBacklog:
+			inBacklog++
+		}
+	}
+	if free < 0 || inBacklog >= l.backlog {
+		return nil
+	}
+	conn := &l.conns[free]
+	err := conn.initState(l.port, l.iss, [6]byte{}, netip.AddrPort{})
+	if err != nil {
+		return nil
+	}
+	err = l.stack.openTCP(l.port, remote, conn)
+	if err != nil {
+		conn.deleteState()
+		return nil
+	}
+	l.iss = seqs.Value(prand32(uint32(l.iss) | 1))
+	l.slots[free] = slotBacklog
+	return conn
+}
+
+// connAborted is called when the port of a connection is closed. The socket is returned
+// to the pool unless it was accepted and the user has not yet closed it.
+func (l *TCPListener) connAborted(sock *TCPSocket) {
+	i := l.connIndex(sock)
+	if i >= 0 && (l.slots[i] != slotAccepted || sock.closing) {
+		l.slots[i] = slotFree
+	}
+}
+
+// release returns an accepted socket whose connection has terminated to the pool.
+func (l *TCPListener) release(sock *TCPSocket) {
+	i := l.connIndex(sock)
+	if i >= 0 && l.slots[i] == slotAccepted {
+		l.slots[i] = slotFree
+	}
+}
+
+func (l *TCPListener) connIndex(sock *TCPSocket) int {
+	for i := range l.conns {
+		if &l.conns[i] == sock {
+			return i
+		}
+	}
+	return -1
+}
+
+// prand32 generates a pseudo random number from a seed.
+func prand32(seed uint32) uint32 {
+	// 32bit Xorshift  https://en.wikipedia.org/wiki/Xorshift
+	seed ^= seed << 13
+	seed ^= seed >> 17
+	seed ^= seed << 5
+	return seed
+}
@@ -0,0 +1,85 @@
+//go:build !tinygo
+
+package stacks
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// notifier guards the state of a socket shared between the user and the stack and wakes
+// goroutines blocked on the socket when the stack changes its state, i.e: data is written
+// to the input buffer, output buffer space is freed by an acknowledgement or the connection
+// state changes. Waiters evaluate their condition with the lock held and block on a channel
+// which is closed on broadcast. Tiny targets use a polling implementation instead.
+type notifier struct {
+	mu sync.Mutex
+	// ch is closed on broadcast. Nil if there are no waiters.
+	ch chan struct{}
+}
+
+func (n *notifier) lock()   { n.mu.Lock() }
+func (n *notifier) unlock() { n.mu.Unlock() }
+
+// broadcast wakes all goroutines waiting on n. n must be locked.
+func (n *notifier) broadcast() {
+	if n.ch != nil {
+		close(n.ch)
+		n.ch = nil
+	}
+}
+
+// wait blocks until done returns true or the deadline is exceeded, in which case it returns false.
+// n must be locked; it is unlocked while blocked and locked again before wait returns.
+// done and the deadline are evaluated with n locked on every broadcast so that a deadline
+// changed by another goroutine, followed by a broadcast, takes effect on a blocked waiter.
+// A zero deadline means wait blocks until done returns true. deadline may be nil.
+func (n *notifier) wait(deadline *time.Time, done func() bool) bool {
+	for !done() {
+		var dl time.Time
+		if deadline != nil {
+			dl = *deadline
+		}
+		if dl.IsZero() {
+			n.waitChan(nil, nil)
+			continue
+		}
+		d := time.Until(dl)
+		if d <= 0 {
+			return false
+		}
+		timer := time.NewTimer(d)
+		n.waitChan(timer.C, nil)
+		timer.Stop()
+	}
+	return true
+}
+
+// waitContext blocks until done returns true or ctx is done, in which case it returns ctx.Err().
+// n must be locked; it is unlocked while blocked and locked again before waitContext returns.
+func (n *notifier) waitContext(ctx context.Context, done func() bool) error {
+	for !done() {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		n.waitChan(nil, ctx.Done())
+	}
+	return nil
+}
+
+// waitChan unlocks n and blocks until the next broadcast or until timeout or cancel are ready.
+// n is locked again before waitChan returns.
+func (n *notifier) waitChan(timeout <-chan time.Time, cancel <-chan struct{}) {
+	if n.ch == nil {
+		n.ch = make(chan struct{})
+	}
+	ch := n.ch
+	n.mu.Unlock()
+	select {
+	case <-ch:
+	case <-timeout:
+	case <-cancel:
+	}
+	n.mu.Lock()
+}
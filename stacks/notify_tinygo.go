@@ -0,0 +1,54 @@
+//go:build tinygo
+
+package stacks
+
+import (
+	"context"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// notifier guards the state of a socket shared between the user and the stack. Waiters poll
+// their condition on tiny targets where the scheduler is cooperative and the stack is usually
+// driven from the same goroutine as the user. The condition is evaluated with the lock held.
+type notifier struct {
+	mu sync.Mutex
+}
+
+func (n *notifier) lock()   { n.mu.Lock() }
+func (n *notifier) unlock() { n.mu.Unlock() }
+
+func (n *notifier) broadcast() {}
+
+// wait yields until done returns true or the deadline is exceeded, in which case it returns false.
+// n must be locked; it is unlocked while yielding. A zero deadline means wait blocks until done returns true.
+// deadline is read on every poll and may be nil.
+func (n *notifier) wait(deadline *time.Time, done func() bool) bool {
+	for !done() {
+		if deadline != nil && !deadline.IsZero() && time.Until(*deadline) <= 0 {
+			return false
+		}
+		n.yield()
+	}
+	return true
+}
+
+// waitContext yields until done returns true or ctx is done, in which case it returns ctx.Err().
+// n must be locked; it is unlocked while yielding.
+func (n *notifier) waitContext(ctx context.Context, done func() bool) error {
+	for !done() {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		n.yield()
+	}
+	return nil
+}
+
+// yield unlocks n so that the stack can make progress and locks it again.
+func (n *notifier) yield() {
+	n.mu.Unlock()
+	runtime.Gosched()
+	n.mu.Lock()
+}
@@ -2,6 +2,7 @@ package stacks
 
 import (
 	"errors"
+	"net/netip"
 	"strconv"
 	"time"
 
@@ -20,13 +21,17 @@ type itcphandler interface {
 	recv(pkt *TCPPacket) error
 	// needsHandling() bool
 	isPendingHandling() bool
+	isTimerRunning() bool
 	abort()
 }
 
 type tcpPort struct {
 	handler itcphandler
-	port    uint16
-	p       bool
+	// remote is the remote address of the port's connection. It is the zero value
+	// for listening ports which match segments from any remote.
+	remote netip.AddrPort
+	port   uint16
+	p      bool
 }
 
 func (port tcpPort) Port() uint16 { return port.port }
@@ -36,6 +41,12 @@ func (port *tcpPort) IsPendingHandling() bool {
 	return port.port != 0 && port.handler.isPendingHandling()
 }
 
+// IsTimerRunning returns true if the port's handler has a running timer which must be
+// handled once expired.
+func (port *tcpPort) IsTimerRunning() bool {
+	return port.port != 0 && port.handler.isTimerRunning()
+}
+
 // HandleEth writes the socket's response into dst to be sent over an ethernet interface.
 // HandleEth can return 0 bytes written and a nil error to indicate no action must be taken.
 func (port *tcpPort) HandleEth(dst []byte) (n int, err error) {
@@ -51,14 +62,16 @@ func (port *tcpPort) HandleEth(dst []byte) (n int, err error) {
 	return n, err
 }
 
-// Open sets the UDP handler and opens the port.
-func (port *tcpPort) Open(portNum uint16, handler itcphandler) {
+// Open sets the TCP handler and opens the port for segments from remote.
+// If remote is the zero value the port matches segments from any remote.
+func (port *tcpPort) Open(portNum uint16, remote netip.AddrPort, handler itcphandler) {
 	if portNum == 0 || handler == nil {
 		panic("invalid port or nil handler" + strconv.Itoa(int(port.port)))
 	} else if port.port != 0 {
 		panic("port already open")
 	}
 	port.handler = handler
+	port.remote = remote
 	port.port = portNum
 	port.p = false
 }
@@ -68,6 +81,7 @@ func (port *tcpPort) Close() {
 		port.handler.abort()
 	}
 	port.handler = nil
+	port.remote = netip.AddrPort{}
 	port.port = 0 // Port 0 flags the port is inactive.
 }
 
@@ -101,12 +115,30 @@ func (pkt *TCPPacket) PutHeaders(b []byte) {
 	pkt.TCP.Put(b[eth.SizeEthernetHeader+eth.SizeIPv4Header:])
 }
 
+// PutHeadersWithOptions puts the Ethernet, IPv4 and TCP headers along with their
+// options stored in the packet into b. The payload should be written to b following
+// the TCP options, see [TCPPacket.CalculateHeadersWithOptions].
 func (pkt *TCPPacket) PutHeadersWithOptions(b []byte) error {
 	const minSize = eth.SizeEthernetHeader + eth.SizeIPv4Header + eth.SizeTCPHeader
 	if len(b) < minSize {
 		panic("short tcpPacket buffer")
 	}
-	panic("PutHeadersWithOptions not implemented")
+	ipOptions := pkt.IPOptions()
+	tcpOptions := pkt.TCPOptions()
+	if ipOptions == nil || tcpOptions == nil {
+		return errors.New("bad IP or TCP header length")
+	} else if len(b) < minSize+len(ipOptions)+len(tcpOptions) {
+		return errors.New("short buffer for TCP packet options")
+	}
+	pkt.Eth.Put(b)
+	ptr := eth.SizeEthernetHeader
+	pkt.IP.Put(b[ptr:])
+	ptr += eth.SizeIPv4Header
+	ptr += copy(b[ptr:], ipOptions)
+	pkt.TCP.Put(b[ptr:])
+	ptr += eth.SizeTCPHeader
+	copy(b[ptr:], tcpOptions)
+	return nil
 }
 
 // Payload returns the TCP payload. If TCP or IPv4 header data is incorrect/bad it returns nil.
@@ -155,7 +187,26 @@ func (pkt *TCPPacket) InvertSrcDest() {
 	pkt.TCP.DestinationPort, pkt.TCP.SourcePort = pkt.TCP.SourcePort, pkt.TCP.DestinationPort
 }
 
+// CalculateHeaders sets the packet headers for a segment with no IP or TCP options.
 func (pkt *TCPPacket) CalculateHeaders(seg seqs.Segment, payload []byte) {
+	pkt.calculateHeaders(seg, 0, payload)
+}
+
+// CalculateHeadersWithOptions sets the packet headers for a segment carrying TCP options.
+// The encoded options are stored in the packet and the checksum is calculated over them.
+// Use [TCPPacket.PutHeadersWithOptions] to marshal the headers and options.
+func (pkt *TCPPacket) CalculateHeadersWithOptions(seg seqs.Segment, opts *eth.TCPOptions, payload []byte) error {
+	n, err := opts.Put(pkt.data[:eth.MaxSizeTCPOptions])
+	if err != nil {
+		return err
+	}
+	pkt.calculateHeaders(seg, n, payload)
+	return nil
+}
+
+// calculateHeaders sets the packet headers. The first optlen bytes of
+// the packet data must contain the encoded TCP options.
+func (pkt *TCPPacket) calculateHeaders(seg seqs.Segment, optlen int, payload []byte) {
 	const ipLenInWords = 5
 	if int(seg.DATALEN) != len(payload) {
 		panic("seg.DATALEN != len(payload)")
@@ -168,13 +219,13 @@ func (pkt *TCPPacket) CalculateHeaders(seg seqs.Segment, payload []byte) {
 	pkt.IP.TTL = 64
 	pkt.IP.ID = prand16(pkt.IP.ID)
 	pkt.IP.VersionAndIHL = ipLenInWords // Sets IHL: No IP options. Version set automatically.
-	pkt.IP.TotalLength = 4*ipLenInWords + eth.SizeTCPHeader + uint16(len(payload))
+	pkt.IP.TotalLength = 4*ipLenInWords + eth.SizeTCPHeader + uint16(optlen+len(payload))
 	// TODO(soypat): Document how to handle ToS. For now just use ToS used by other side.
 	pkt.IP.Flags = 0 // packet.IP.ToS = 0
 	pkt.IP.Checksum = pkt.IP.CalculateChecksum()
 
 	// TCP frame.
-	const offset = 5
+	offset := uint8(5 + optlen/4)
 
 	pkt.TCP = eth.TCPHeader{
 		SourcePort:      pkt.TCP.SourcePort,
@@ -186,7 +237,7 @@ func (pkt *TCPPacket) CalculateHeaders(seg seqs.Segment, payload []byte) {
 	}
 	pkt.TCP.SetFlags(seg.Flags)
 	pkt.TCP.SetOffset(offset)
-	pkt.TCP.Checksum = pkt.TCP.CalculateChecksumIPv4(&pkt.IP, nil, payload)
+	pkt.TCP.Checksum = pkt.TCP.CalculateChecksumIPv4(&pkt.IP, pkt.data[:optlen], payload)
 }
 
 // prand16 generates a pseudo random number from a seed.
@@ -209,8 +260,9 @@ func ParseTCPPacket(b []byte) (pkt TCPPacket, err error) {
 	if pkt.Eth.AssertType() != eth.EtherTypeIPv4 {
 		return pkt, errors.New("not ipv4")
 	}
-	var offset uint8
+	var offset, ipOffset uint8
 	pkt.IP, offset = eth.DecodeIPv4Header(b[eth.SizeEthernetHeader:])
+	ipOffset = offset
 	if int(eth.SizeEthernetHeader+offset) > len(b) {
 		return pkt, errors.New("short packet or bad IP.IHL")
 	} else if uint16(offset) > pkt.IP.TotalLength {
@@ -227,7 +279,7 @@ func ParseTCPPacket(b []byte) (pkt TCPPacket, err error) {
 	}
 	pkt.TCP, offset = eth.DecodeTCPHeader(ipPayload)
 	tcpOptions := ipPayload[eth.SizeTCPHeader:offset]
-	tcpPayload := ipPayload[offset:pkt.IP.TotalLength]
+	tcpPayload := ipPayload[offset : pkt.IP.TotalLength-uint16(ipOffset)]
 	n := copy(pkt.data[:], ipOptions)
 	n += copy(pkt.data[n:], tcpOptions)
 	copy(pkt.data[n:], tcpPayload)
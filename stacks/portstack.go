@@ -9,6 +9,7 @@ import (
 	"net/netip"
 	"runtime"
 	"strconv"
+	"sync/atomic"
 	"time"
 
 	"github.com/soypat/seqs/eth"
@@ -31,12 +32,31 @@ type PortStackConfig struct {
 	MAC    [6]byte
 	// MTU is the maximum transmission unit of the ethernet interface.
 	MTU uint16
+	// ICMPPortUnreachable enables ICMP port unreachable replies to UDP datagrams
+	// addressed to ports with no open socket. TCP segments addressed to closed ports
+	// are always answered with a reset.
+	ICMPPortUnreachable bool
+	// ARPCacheSize is the amount of addresses in the ARP cache. Defaults to 8.
+	ARPCacheSize int
+	// MaxRoutes is the capacity of the routing table. Defaults to 4. See [PortStack.AddRoute].
+	MaxRoutes int
 }
 
 // NewPortStack creates a ready to use TCP/UDP Stack instance.
 func NewPortStack(cfg PortStackConfig) *PortStack {
 	s := &PortStack{}
 	s.arpClient.stack = s
+	if cfg.ARPCacheSize <= 0 {
+		cfg.ARPCacheSize = defaultARPCacheSize
+	}
+	s.arpClient.cache = make([]arpEntry, cfg.ARPCacheSize)
+	if cfg.MaxRoutes <= 0 {
+		cfg.MaxRoutes = defaultMaxRoutes
+	}
+	s.routes = make([]Route, 0, cfg.MaxRoutes)
+	s.rejecter.stack = s
+	s.icmp.stack = s
+	s.rejecter.icmp = cfg.ICMPPortUnreachable
 	s.mac = cfg.MAC
 	// s.ip = cfg.IP.As4()
 	s.portsUDP = make([]udpPort, cfg.MaxOpenPortsUDP)
@@ -53,6 +73,8 @@ var ErrFlagPending = io.ErrNoProgress
 
 // PortStack implements partial TCP/UDP packet muxing to respective sockets with [PortStack.RcvEth].
 // This implementation limits itself basic header validation and port matching.
+// TCP segments are matched on local port, remote address and remote port and
+// fall back to a listening port opened with [PortStack.OpenTCP] if no connection matches.
 // Users of PortStack are expected to implement connection state, packet buffering and retransmission logic.
 //   - In the case of TCP this means implementing the TCP state machine.
 //   - In the case of UDP PortStack should be enough to build  most applications.
@@ -92,6 +114,8 @@ type PortStack struct {
 	portsUDP      []udpPort
 	portsTCP      []tcpPort
 
+	// pendingUDPv4 and pendingTCPv4 are accessed atomically since sockets
+	// flag themselves as pending from user goroutines.
 	pendingUDPv4     uint32
 	pendingTCPv4     uint32
 	processedPackets uint32
@@ -99,7 +123,13 @@ type PortStack struct {
 	// that have been dropped due to the port requiring handling before admitting more packets.
 	droppedPackets uint32
 	// ARP state. See arp.go for detailed information on the ARP state machine.
-	arpClient arpClient
+	arpClient ARPClient
+	// rejecter responds to packets addressed to closed ports. See reject.go.
+	rejecter rejecter
+	// icmp answers echo requests and sends pings. See icmp.go.
+	icmp ICMPv4
+	// routes is the routing table used to choose the next hop of outgoing packets. See route.go.
+	routes []Route
 	// Auxiliary struct to avoid allocations passed to global handler.
 	auxEth eth.EthernetHeader
 	mac    [6]byte
@@ -208,11 +238,12 @@ func (ps *PortStack) RecvEth(ethernetFrame []byte) (err error) {
 	switch ihdr.Protocol {
 	default:
 		err = errUnknownIPProto
+	case 1:
+		// ICMP (Internet Control Message Protocol).
+		err = ps.icmp.recv(ehdr, &ihdr, payload)
 	case 17:
 		// UDP (User Datagram Protocol).
-		if len(ps.portsUDP) == 0 {
-			break // No sockets.
-		} else if len(payload) < eth.SizeUDPHeader {
+		if len(payload) < eth.SizeUDPHeader {
 			err = errTooShortTCPOrUDP
 			break
 		}
@@ -234,7 +265,9 @@ func (ps *PortStack) RecvEth(ethernetFrame []byte) (err error) {
 
 		port := findPort(ps.portsUDP, uhdr.DestinationPort)
 		if port == nil {
-			break // No socket listening on this port.
+			// No socket listening on this port.
+			ps.rejecter.rejectUDP(ehdr, &ihdr, ethernetFrame[eth.SizeEthernetHeader:end])
+			break
 		}
 
 		pkt := &ps.auxUDP
@@ -250,7 +283,7 @@ func (ps *PortStack) RecvEth(ethernetFrame []byte) (err error) {
 		}
 
 		// Flag packets as needing processing.
-		ps.pendingUDPv4++
+		ps.flagPendingUDP()
 
 		pkt.Rx = ps.lastRx
 		pkt.Eth = *ehdr
@@ -271,9 +304,7 @@ func (ps *PortStack) RecvEth(ethernetFrame []byte) (err error) {
 
 	case 6:
 		// TCP (Transport Control Protocol).
-		if len(ps.portsTCP) == 0 {
-			break // No sockets.
-		} else if len(payload) < eth.SizeTCPHeader {
+		if len(payload) < eth.SizeTCPHeader {
 			err = errTooShortTCPOrUDP
 			break
 		}
@@ -295,12 +326,15 @@ func (ps *PortStack) RecvEth(ethernetFrame []byte) (err error) {
 			err = errChecksumTCPorUDP
 			break
 		}
-		port := findPort(ps.portsTCP, thdr.DestinationPort)
+		remote := netip.AddrPortFrom(netip.AddrFrom4(ihdr.Source), thdr.SourcePort)
+		port := findTCPPort(ps.portsTCP, thdr.DestinationPort, remote)
 		if port == nil {
 			if isDebug {
 				ps.debug("tcp:noSocket", slog.Int("port", int(thdr.DestinationPort)), slog.Int("avail", len(ps.portsTCP)))
 			}
-			break // No socket listening on this port.
+			// No socket listening on this port.
+			ps.rejecter.rejectTCP(ehdr, &ihdr, &thdr, len(payload))
+			break
 		}
 
 		pkt := &ps.auxTCP
@@ -317,7 +351,7 @@ func (ps *PortStack) RecvEth(ethernetFrame []byte) (err error) {
 				slog.Int("payload", len(payload)),
 			)
 		}
-		ps.pendingTCPv4++
+		ps.flagPendingTCP()
 		pkt.Rx = ps.lastRx
 		pkt.Eth = *ehdr
 		pkt.IP = ihdr
@@ -380,6 +414,14 @@ func (ps *PortStack) handleEth(dst []byte) (n int, err error) {
 	if n != 0 {
 		return n, nil
 	}
+	n = ps.rejecter.handle(dst)
+	if n != 0 {
+		return n, nil
+	}
+	n = ps.icmp.handle(dst)
+	if n != 0 {
+		return n, nil
+	}
 
 	type Socket interface {
 		Close()
@@ -411,7 +453,7 @@ func (ps *PortStack) handleEth(dst []byte) (n int, err error) {
 
 	isDebug := ps.isLogEnabled(slog.LevelDebug)
 	socketPending := false
-	if ps.pendingUDPv4 > 0 {
+	if pendingUDP := atomic.LoadUint32(&ps.pendingUDPv4); pendingUDP > 0 {
 		for i := range ps.portsUDP {
 			n, pending, err := handleSocket(dst, &ps.portsUDP[i])
 			if pending {
@@ -427,16 +469,18 @@ func (ps *PortStack) handleEth(dst []byte) (n int, err error) {
 			}
 		}
 		if !socketPending {
-			ps.pendingUDPv4 = 0 // No more pending UDP sockets.
+			// No more pending UDP sockets unless flagged by the user while handling.
+			atomic.CompareAndSwapUint32(&ps.pendingUDPv4, pendingUDP, 0)
 		}
 	}
 
 	socketPending = false
-	if ps.pendingTCPv4 > 0 {
+	if pendingTCP := atomic.LoadUint32(&ps.pendingTCPv4); pendingTCP > 0 {
 		for i := range ps.portsTCP {
-			n, pending, err := handleSocket(dst, &ps.portsTCP[i])
-			if pending {
-				pending = true
+			port := &ps.portsTCP[i]
+			n, pending, err := handleSocket(dst, port)
+			if pending || port.IsTimerRunning() {
+				socketPending = true // Timers are checked on future calls until they expire.
 			}
 			if err != nil {
 				return 0, err
@@ -448,7 +492,8 @@ func (ps *PortStack) handleEth(dst []byte) (n int, err error) {
 			}
 		}
 		if !socketPending {
-			ps.pendingTCPv4 = 0 // No more pending TCP sockets.
+			// No more pending TCP sockets unless flagged by the user while handling.
+			atomic.CompareAndSwapUint32(&ps.pendingTCPv4, pendingTCP, 0)
 		}
 	}
 
@@ -457,7 +502,21 @@ func (ps *PortStack) handleEth(dst []byte) (n int, err error) {
 
 // IsPendingHandling checks if a call to HandleEth could possibly result in a packet being generated by the PortStack.
 func (ps *PortStack) IsPendingHandling() bool {
-	return ps.pendingUDPv4 > 0 || ps.pendingTCPv4 > 0 || ps.arpClient.isPending()
+	return atomic.LoadUint32(&ps.pendingUDPv4) > 0 || ps.isPendingTCP() || ps.arpClient.isPending() || ps.rejecter.isPending() || ps.icmp.isPending()
+}
+
+// isPendingTCP checks if a TCP port has a segment to send or an expired timer. Ports are only
+// checked while flagged; ports with running timers keep the flag set until the timers stop.
+func (ps *PortStack) isPendingTCP() bool {
+	if atomic.LoadUint32(&ps.pendingTCPv4) == 0 {
+		return false
+	}
+	for i := range ps.portsTCP {
+		if ps.portsTCP[i].IsPendingHandling() {
+			return true
+		}
+	}
+	return false
 }
 
 // OpenUDP opens a UDP port and sets the handler.
@@ -493,10 +552,13 @@ func (ps *PortStack) FlagPendingUDP(portNum uint16) error {
 	if port == nil {
 		return errPortNonexistent
 	}
-	ps.pendingUDPv4++
+	ps.flagPendingUDP()
 	return nil
 }
 
+// flagPendingUDP flags that a UDP port may have a packet to send. Safe for concurrent use.
+func (ps *PortStack) flagPendingUDP() { atomic.AddUint32(&ps.pendingUDPv4, 1) }
+
 // CloseUDP closes a UDP port. See [PortStack].
 func (ps *PortStack) CloseUDP(portNum uint16) error {
 	if portNum == 0 {
@@ -510,23 +572,31 @@ func (ps *PortStack) CloseUDP(portNum uint16) error {
 	return nil
 }
 
-// OpenTCP opens a TCP port and sets the handler.
+// OpenTCP opens a listening TCP port and sets the handler. The handler receives
+// segments addressed to the port that do not belong to a connection opened on the same port.
 // OpenTCP returns an error if the port is already open
 // or if there is no socket available it returns an error.
 //
 // See [PortStack] for information on handler argument.
 func (ps *PortStack) OpenTCP(portNum uint16, handler itcphandler) error {
+	return ps.openTCP(portNum, netip.AddrPort{}, handler)
+}
+
+// openTCP opens a TCP port for the connection with remote. Several connections
+// may share a local port as long as their remotes differ.
+// If remote is the zero value a listening port is opened.
+func (ps *PortStack) openTCP(portNum uint16, remote netip.AddrPort, handler itcphandler) error {
 	switch {
 	case portNum == 0:
 		return errZeroPort
 	case handler == nil:
 		return errNilHandler
 	}
-	p, err := findAvailPort(ps.portsTCP, portNum)
+	p, err := findAvailTCPPort(ps.portsTCP, portNum, remote)
 	if err != nil {
 		return err
 	}
-	p.Open(portNum, handler)
+	p.Open(portNum, remote, handler)
 	return nil
 }
 
@@ -542,11 +612,14 @@ func (ps *PortStack) FlagPendingTCP(portNum uint16) error {
 	if port == nil {
 		return errPortNonexistent
 	}
-	ps.pendingTCPv4++
+	ps.flagPendingTCP()
 	return nil
 }
 
-// CloseTCP closes the TCP port, effectively aborting the connection. See [PortStack].
+// flagPendingTCP flags that a TCP port may have a packet to send. Safe for concurrent use.
+func (ps *PortStack) flagPendingTCP() { atomic.AddUint32(&ps.pendingTCPv4, 1) }
+
+// CloseTCP closes the TCP port, effectively aborting all connections on the port. See [PortStack].
 func (ps *PortStack) CloseTCP(portNum uint16) error {
 	if portNum == 0 {
 		return errZeroPort
@@ -555,10 +628,24 @@ func (ps *PortStack) CloseTCP(portNum uint16) error {
 	if port == nil {
 		return errPortNonexistent
 	}
-	port.Close()
+	for port != nil {
+		port.Close()
+		port = findPort(ps.portsTCP, portNum)
+	}
 	return nil
 }
 
+// closeTCP closes the TCP port with the handler, aborting its connection.
+func (ps *PortStack) closeTCP(handler itcphandler) error {
+	for i := range ps.portsTCP {
+		if ps.portsTCP[i].port != 0 && ps.portsTCP[i].handler == handler {
+			ps.portsTCP[i].Close()
+			return nil
+		}
+	}
+	return errPortNonexistent
+}
+
 func (ps *PortStack) now() time.Time {
 	return time.Now()
 }
@@ -686,6 +773,39 @@ func findAvailPort[T porter](list []T, portNum uint16) (*T, error) {
 	return &list[availableIdx], nil
 }
 
+// findTCPPort returns the port of the connection with remote or the listening port
+// if there is no such connection. It returns nil if neither is open.
+func findTCPPort(list []tcpPort, portNum uint16, remote netip.AddrPort) *tcpPort {
+	var listener *tcpPort
+	for i := range list {
+		if list[i].port != portNum {
+			continue
+		} else if list[i].remote == remote {
+			return &list[i]
+		} else if !list[i].remote.IsValid() {
+			listener = &list[i]
+		}
+	}
+	return listener
+}
+
+// findAvailTCPPort returns an unused port. It returns an error if a port
+// with the same local port number and remote is already open.
+func findAvailTCPPort(list []tcpPort, portNum uint16, remote netip.AddrPort) (*tcpPort, error) {
+	var avail *tcpPort
+	for i := range list {
+		if list[i].port == portNum && list[i].remote == remote {
+			return nil, errPortNoneAvail
+		} else if list[i].port == 0 && avail == nil {
+			avail = &list[i]
+		}
+	}
+	if avail == nil {
+		return nil, errPortNoSpace
+	}
+	return avail, nil
+}
+
 func bytesAttr(name string, b []byte) slog.Attr {
 	return slog.Attr{
 		Key:   name,
@@ -0,0 +1,161 @@
+package stacks
+
+import (
+	"log/slog"
+	"time"
+
+	"github.com/soypat/seqs"
+	"github.com/soypat/seqs/eth"
+)
+
+const (
+	// rejectRateLimit is the maximum amount of resets and ICMP messages sent per
+	// second in response to packets addressed to closed ports. See RFC 1812 4.3.2.8.
+	rejectRateLimit = 16
+	// sizeRejectBuf fits the largest response: an ICMP destination unreachable
+	// message containing an IP header with options and 8 bytes of the original datagram.
+	sizeRejectBuf = eth.SizeEthernetHeader + eth.SizeIPv4Header + eth.SizeICMPv4Header + 60 + 8
+)
+
+// rejecter generates responses to packets addressed to ports with no open socket.
+// TCP segments are answered with a reset so that the remote connection fails
+// immediately instead of waiting for a timeout. UDP datagrams are answered with an
+// ICMP port unreachable message if enabled. A single response is stored at a time
+// and is written out on the next call to [PortStack.HandleEth].
+type rejecter struct {
+	stack *PortStack
+	// icmp enables ICMP port unreachable responses to UDP datagrams.
+	icmp bool
+	// n is the length of the pending response in buf. Zero when there is no pending response.
+	n    int
+	ipID uint16
+	// windowStart and sent implement the rate limit.
+	windowStart time.Time
+	sent        int
+	buf         [sizeRejectBuf]byte
+}
+
+func (r *rejecter) isPending() bool { return r.n > 0 }
+
+func (r *rejecter) handle(dst []byte) (n int) {
+	if r.n == 0 {
+		return 0
+	}
+	n = copy(dst, r.buf[:r.n])
+	r.n = 0
+	if r.stack.isLogEnabled(slog.LevelDebug) {
+		r.stack.debug("reject:send", slog.Int("plen", n))
+	}
+	return n
+}
+
+// rejectTCP stores a reset in response to a segment addressed to a closed port.
+// See RFC 9293 3.10.7.1.
+func (r *rejecter) rejectTCP(ehdr *eth.EthernetHeader, ihdr *eth.IPv4Header, thdr *eth.TCPHeader, payloadLen int) {
+	seg := thdr.Segment(payloadLen)
+	if seg.Flags.HasAny(seqs.FlagRST) || !r.allow(ehdr, ihdr) {
+		return // An incoming reset is discarded.
+	}
+	rst := eth.TCPHeader{
+		SourcePort:      thdr.DestinationPort,
+		DestinationPort: thdr.SourcePort,
+	}
+	if seg.Flags.HasAny(seqs.FlagACK) {
+		// <SEQ=SEG.ACK><CTL=RST>
+		rst.Seq = seg.ACK
+		rst.SetFlags(seqs.FlagRST)
+	} else {
+		// <SEQ=0><ACK=SEG.SEQ+SEG.LEN><CTL=RST,ACK>
+		rst.Ack = seqs.Add(seg.SEQ, seg.LEN())
+		rst.SetFlags(seqs.FlagRST | seqs.FlagACK)
+	}
+	rst.SetOffset(5)
+	rip := r.ipHeader(ihdr, 6, eth.SizeTCPHeader)
+	rst.Checksum = rst.CalculateChecksumIPv4(&rip, nil, nil)
+
+	r.putHeaders(ehdr, &rip)
+	rst.Put(r.buf[eth.SizeEthernetHeader+eth.SizeIPv4Header:])
+	r.n = eth.SizeEthernetHeader + eth.SizeIPv4Header + eth.SizeTCPHeader
+}
+
+// rejectUDP stores an ICMP port unreachable message in response to a datagram
+// addressed to a closed port. datagram must contain the original IP header
+// followed by at least the 8 byte UDP header. See RFC 792 and RFC 1122 4.1.3.1.
+func (r *rejecter) rejectUDP(ehdr *eth.EthernetHeader, ihdr *eth.IPv4Header, datagram []byte) {
+	if !r.icmp || !r.allow(ehdr, ihdr) {
+		return
+	}
+	ipOffset := 4 * int(ihdr.IHL())
+	if len(datagram) > ipOffset+8 {
+		datagram = datagram[:ipOffset+8]
+	}
+	icmp := eth.ICMPv4Header{
+		Type: eth.ICMPv4DestinationUnreachable,
+		Code: eth.ICMPv4CodePortUnreachable,
+	}
+	icmp.Checksum = icmp.CalculateChecksum(datagram)
+	rip := r.ipHeader(ihdr, 1, eth.SizeICMPv4Header+len(datagram))
+
+	r.putHeaders(ehdr, &rip)
+	ptr := eth.SizeEthernetHeader + eth.SizeIPv4Header
+	icmp.Put(r.buf[ptr:])
+	ptr += eth.SizeICMPv4Header
+	ptr += copy(r.buf[ptr:], datagram)
+	r.n = ptr
+}
+
+// allow checks whether a response can be generated to a packet and
+// counts the response towards the rate limit.
+func (r *rejecter) allow(ehdr *eth.EthernetHeader, ihdr *eth.IPv4Header) bool {
+	ps := r.stack
+	switch {
+	case r.n > 0:
+		return false // Response pending, drop.
+	case ps.ip == [4]byte{} || ihdr.Destination != ps.ip:
+		return false // Packet not addressed to us.
+	case ehdr.Destination != ps.mac:
+		return false // Never respond to broadcast frames.
+	case ihdr.Source == [4]byte{} || ihdr.Source == [4]byte{255, 255, 255, 255}:
+		return false // Invalid source address.
+	}
+	now := ps.now()
+	if now.Sub(r.windowStart) >= time.Second {
+		r.windowStart = now
+		r.sent = 0
+	}
+	if r.sent >= rejectRateLimit {
+		if ps.isLogEnabled(slog.LevelDebug) {
+			ps.debug("reject:ratelimit")
+		}
+		return false
+	}
+	r.sent++
+	return true
+}
+
+// ipHeader returns the IP header of a response to the packet with IP header ihdr.
+func (r *rejecter) ipHeader(ihdr *eth.IPv4Header, protocol uint8, payloadLen int) eth.IPv4Header {
+	const ipLenInWords = 5
+	r.ipID = prand16(r.ipID + 1)
+	rip := eth.IPv4Header{
+		VersionAndIHL: ipLenInWords,
+		TotalLength:   4*ipLenInWords + uint16(payloadLen),
+		ID:            r.ipID,
+		TTL:           64,
+		Protocol:      protocol,
+		Source:        ihdr.Destination,
+		Destination:   ihdr.Source,
+	}
+	rip.Checksum = rip.CalculateChecksum()
+	return rip
+}
+
+func (r *rejecter) putHeaders(ehdr *eth.EthernetHeader, rip *eth.IPv4Header) {
+	reth := eth.EthernetHeader{
+		Destination:     ehdr.Source,
+		Source:          r.stack.mac,
+		SizeOrEtherType: uint16(eth.EtherTypeIPv4),
+	}
+	reth.Put(r.buf[:])
+	rip.Put(r.buf[eth.SizeEthernetHeader:])
+}
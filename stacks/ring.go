@@ -5,94 +5,87 @@ import (
 	"io"
 )
 
+var errRingNoSpace = errors.New("no more space")
+
+// ring is a circular buffer. Buffered data starts at buf[off] and spans n bytes,
+// possibly wrapping around the end of buf.
 type ring struct {
 	buf []byte
 	off int
-	end int
+	n   int
 }
 
 func (r *ring) Write(b []byte) (int, error) {
-	free := r.Free()
-	if len(b) > free {
-		return 0, errors.New("no more space")
-	}
-	midFree := r.midFree()
-	if midFree > 0 {
-		n := copy(r.buf[r.end:], b)
-		r.end += n
-		return n, nil
+	if len(b) > r.Free() {
+		return 0, errRingNoSpace
 	}
+	n := r.writeAt(0, b)
+	r.n += n
+	return n, nil
+}
 
-	n := copy(r.buf[r.end:], b)
-	r.end = n
+// writeAt writes b to the free space of the ring starting at offset off from the end of the
+// buffered data. The data is not buffered until a call to commit. The caller must ensure
+// off+len(b) <= r.Free().
+func (r *ring) writeAt(off int, b []byte) int {
+	start := (r.off + r.n + off) % len(r.buf)
+	n := copy(r.buf[start:], b)
 	if n < len(b) {
-		n2 := copy(r.buf, b[n:])
-		r.end = n2
-		n += n2
+		n += copy(r.buf, b[n:])
 	}
-	return n, nil
+	return n
+}
+
+// commit marks n bytes written with writeAt following the buffered data as buffered.
+func (r *ring) commit(n int) {
+	if n > r.Free() {
+		panic("ring commit exceeds free space")
+	}
+	r.n += n
 }
 
 func (r *ring) Read(b []byte) (int, error) {
 	if r.Buffered() == 0 {
 		return 0, io.EOF
 	}
+	n := r.readAt(b, 0)
+	r.off = (r.off + n) % len(r.buf)
+	r.n -= n
+	return n, nil
+}
 
-	if r.end >= r.off {
-		// start       off       end      len(buf)
-		//   |  sfree   |  used   |  efree   |
-		n := copy(b, r.buf[r.off:r.end])
-		r.off += n
-		r.onReadEnd()
-		return n, nil
+// readAt reads buffered data starting at offset off from the start of the buffered data
+// without consuming it.
+func (r *ring) readAt(b []byte, off int) int {
+	if off >= r.n {
+		return 0
 	}
-	// start     end       off     len(buf)
-	//   |  used  |  mfree  |  used  |
-	n := copy(b, r.buf[r.off:])
-	r.off += n
+	b = b[:min(len(b), r.n-off)]
+	start := (r.off + off) % len(r.buf)
+	n := copy(b, r.buf[start:])
 	if n < len(b) {
-		n2 := copy(b[n:], r.buf[:r.end])
-		r.off = n2
-		n += n2
+		n += copy(b[n:], r.buf)
 	}
-	r.onReadEnd()
-	return n, nil
+	return n
 }
 
-func (r *ring) Buffered() int {
-	return len(r.buf) - r.Free()
+// discard consumes n bytes from the start of the buffered data without reading them.
+func (r *ring) discard(n int) {
+	if n > r.n {
+		panic("ring discard exceeds buffered data")
+	}
+	r.off = (r.off + n) % len(r.buf)
+	r.n -= n
 }
 
+func (r *ring) Buffered() int { return r.n }
+
 func (r *ring) Reset() {
 	r.off = 0
-	r.end = 0
-}
-
-func (r *ring) Free() int {
-	if r.end >= r.off {
-		// start       off       end      len(buf)
-		//   |  sfree   |  used   |  efree   |
-		startFree := r.off
-		endFree := len(r.buf) - r.end
-		return startFree + endFree
-	}
-	// start     end       off     len(buf)
-	//   |  used  |  mfree  |  used  |
-	return r.off - r.end
+	r.n = 0
 }
 
-func (r *ring) midFree() int {
-	if r.end >= r.off {
-		return 0
-	}
-	return r.off - r.end
-}
-
-func (r *ring) onReadEnd() {
-	if r.off == r.end {
-		r.Reset() // We read everything, reset.
-	}
-}
+func (r *ring) Free() int { return len(r.buf) - r.n }
 
 func max(a, b int) int {
 	if a > b {
@@ -0,0 +1,97 @@
+package stacks
+
+import (
+	"errors"
+	"net/netip"
+)
+
+const defaultMaxRoutes = 4
+
+var (
+	errRouteNoSpace  = errors.New("route table full")
+	errRouteInvalid  = errors.New("route requires IPv4 prefix and gateway")
+	errRouteNotFound = errors.New("route not found")
+)
+
+// Route is an entry of the IPv4 routing table of a PortStack.
+type Route struct {
+	// Prefix is the destination network of the route.
+	Prefix netip.Prefix
+	// Gateway is the router that packets addressed to Prefix are sent to.
+	// The zero value means hosts in Prefix are on the local network.
+	Gateway netip.Addr
+	// Metric is the cost of the route. Among matching routes with equal prefix
+	// length the route with the lowest metric is used.
+	Metric uint16
+}
+
+// IsOnLink returns true if the route's destinations are on the local network.
+func (r Route) IsOnLink() bool { return !r.Gateway.IsValid() }
+
+// AddRoute adds a route to the routing table. A route with the same prefix and
+// gateway as an existing route replaces it.
+func (ps *PortStack) AddRoute(r Route) error {
+	if !r.Prefix.IsValid() || !r.Prefix.Addr().Is4() || (r.Gateway.IsValid() && !r.Gateway.Is4()) {
+		return errRouteInvalid
+	}
+	r.Prefix = r.Prefix.Masked()
+	if i := ps.findRoute(r.Prefix, r.Gateway); i >= 0 {
+		ps.routes[i] = r
+		return nil
+	} else if len(ps.routes) == cap(ps.routes) {
+		return errRouteNoSpace
+	}
+	ps.routes = append(ps.routes, r)
+	return nil
+}
+
+// RemoveRoute removes the route with the given prefix and gateway from the routing table.
+func (ps *PortStack) RemoveRoute(prefix netip.Prefix, gateway netip.Addr) error {
+	i := ps.findRoute(prefix.Masked(), gateway)
+	if i < 0 {
+		return errRouteNotFound
+	}
+	ps.routes = append(ps.routes[:i], ps.routes[i+1:]...)
+	return nil
+}
+
+// Routes appends the routes in the routing table to dst and returns the result.
+func (ps *PortStack) Routes(dst []Route) []Route {
+	return append(dst, ps.routes...)
+}
+
+// nextHop returns the address of the host on the local network that packets to addr are sent to.
+// The route with the longest prefix matching addr is used. If the routing table is empty all
+// destinations are considered to be on the local network. If no route matches the returned
+// address is invalid, meaning addr is unreachable.
+func (ps *PortStack) nextHop(addr netip.Addr) netip.Addr {
+	if len(ps.routes) == 0 || addr == netip.AddrFrom4([4]byte{255, 255, 255, 255}) {
+		return addr
+	}
+	best := -1
+	for i, r := range ps.routes {
+		if !r.Prefix.Contains(addr) {
+			continue
+		}
+		if best < 0 || r.Prefix.Bits() > ps.routes[best].Prefix.Bits() ||
+			(r.Prefix.Bits() == ps.routes[best].Prefix.Bits() && r.Metric < ps.routes[best].Metric) {
+			best = i
+		}
+	}
+	switch {
+	case best < 0:
+		return netip.Addr{}
+	case ps.routes[best].IsOnLink():
+		return addr
+	}
+	return ps.routes[best].Gateway
+}
+
+func (ps *PortStack) findRoute(prefix netip.Prefix, gateway netip.Addr) int {
+	for i, r := range ps.routes {
+		if r.Prefix == prefix && r.Gateway == gateway {
+			return i
+		}
+	}
+	return -1
+}
@@ -4,9 +4,10 @@ import (
 	"errors"
 	"io"
 	"log/slog"
+	"math"
 	"net"
 	"net/netip"
-	"runtime"
+	"os"
 	"time"
 
 	"github.com/soypat/seqs"
@@ -18,6 +19,29 @@ var _ itcphandler = (*TCPSocket)(nil)
 const (
 	defaultSocketSize = 2048
 	sizeTCPNoOptions  = eth.SizeEthernetHeader + eth.SizeIPv4Header + eth.SizeTCPHeader
+	// Keepalive defaults match those commonly used by BSD and Linux stacks.
+	defaultKeepAliveInterval = 75 * time.Second
+	defaultKeepAliveCount    = 9
+	// defaultMSL is the maximum segment lifetime which keeps connections in TIME-WAIT for one minute.
+	defaultMSL = 30 * time.Second
+)
+
+var (
+	// ErrRetransmitTimeout is returned by TCPSocket methods after the connection was aborted
+	// due to the remote not acknowledging data after the maximum amount of retransmissions.
+	ErrRetransmitTimeout = errors.New("retransmission timeout")
+	// ErrKeepaliveTimeout is returned by TCPSocket methods after the connection was aborted
+	// due to the remote not responding to keepalive probes.
+	ErrKeepaliveTimeout = errors.New("keepalive timeout")
+	// ErrConnectionReset is returned by TCPSocket methods after the connection was
+	// reset by the remote, analogous to ECONNRESET.
+	ErrConnectionReset = errors.New("connection reset by peer")
+	// ErrHostUnreachable is returned by TCPSocket methods after a connection opened with
+	// [TCPSocket.DialTCP] was aborted due to the next hop's hardware address not being resolved.
+	ErrHostUnreachable = errors.New("host unreachable")
+
+	errTimeWait     = errors.New("connection in TIME-WAIT")
+	errTCPUnknownHW = errors.New("unknown hardware address for remote, resolve with ARP first")
 )
 
 type TCPSocket struct {
@@ -34,11 +58,74 @@ type TCPSocket struct {
 	rx        ring
 	abortErr  error
 	closing   bool
+	cfg       TCPSocketConfig
+	// txStart is the sequence number of the first byte in tx. Data in tx
+	// is kept until acknowledged by the remote so that it can be retransmitted.
+	txStart seqs.Value
+	// Retransmission state. See RFC 6298.
+	rto            rtoEstimator
+	rtoDeadline    time.Time  // Expiry of the retransmission timer. Zero if timer is not running.
+	rttStart       time.Time  // Time at which segment being timed was sent. Zero if no RTT measurement in progress.
+	rttSeq         seqs.Value // Sequence number of segment being timed.
+	rtxNxt         seqs.Value // Next sequence number to retransmit.
+	retransmitting bool
+	retries        int // Consecutive retransmission timeouts, compared with cfg.MaxRetransmits.
+	// kaProbes is the amount of unanswered keepalive probes sent.
+	kaProbes int
+	// Persist timer state, runs while the remote advertises a zero window. See RFC 9293 section 3.8.6.1.
+	persistDeadline time.Time // Expiry of the persist timer. Zero if timer is not running.
+	persistShift    uint8     // Exponential backoff of the persist timer.
+	// ackDeadline is the expiry of the delayed ACK timer. Zero if timer is not running.
+	ackDeadline time.Time
+	// twDeadline is the expiry of the 2*MSL TIME-WAIT timer. Zero if timer is not running.
+	twDeadline time.Time
+	// listener is the listener that owns the socket. Nil for sockets created with NewTCPSocket.
+	listener *TCPListener
+	// notify guards the socket state shared by the user and the stack and wakes users blocked
+	// on the socket. It is a pointer so that it is preserved across connections and shared
+	// by all sockets of a listener.
+	notify *notifier
 }
 
 type TCPSocketConfig struct {
 	TxBufSize int
 	RxBufSize int
+	// Reassembly enables buffering of in-window out-of-order segments which are
+	// delivered in order once the missing data arrives. When disabled out-of-order
+	// segments are dropped and must be retransmitted by the remote.
+	Reassembly bool
+	// InitialRTO is the retransmission timeout used before a round trip time
+	// is measured. Defaults to 1 second as recommended by RFC 6298.
+	InitialRTO time.Duration
+	// MinRTO is the lower bound of the retransmission timeout. Defaults to 1 second.
+	MinRTO time.Duration
+	// MaxRetransmits is the amount of consecutive retransmission timeouts after which the
+	// connection is aborted with [ErrRetransmitTimeout]. Defaults to 8.
+	MaxRetransmits int
+	// CongestionControl is the congestion control algorithm used by the connection,
+	// i.e: [seqs.Reno] or [seqs.Cubic]. If nil data in flight is only limited by
+	// the remote's receive window. It must not be shared between sockets.
+	CongestionControl seqs.CongestionControl
+	// KeepAliveIdle is the time a connection must be idle before keepalive probes are
+	// sent to check the remote is still reachable. Zero disables keepalive. See RFC 9293 section 3.8.4.
+	KeepAliveIdle time.Duration
+	// KeepAliveInterval is the time between keepalive probes. Defaults to 75 seconds.
+	KeepAliveInterval time.Duration
+	// KeepAliveCount is the amount of unanswered keepalive probes after which the
+	// connection is aborted with [ErrKeepaliveTimeout]. Defaults to 9.
+	KeepAliveCount int
+	// MSL is the maximum segment lifetime. After an active close the connection remains in
+	// TIME-WAIT for 2*MSL, acknowledging retransmitted FINs, before the port is released.
+	// Defaults to 30 seconds. See RFC 9293 section 3.4.2.
+	MSL time.Duration
+	// DelayedACK is the maximum time the acknowledgement of received data is delayed so that it
+	// can be piggybacked on outgoing data or acknowledge a second full-sized segment. Zero disables
+	// delayed acknowledgements. Should be less than 500ms. See RFC 1122 section 4.2.3.2.
+	DelayedACK time.Duration
+	// NoDelay disables the Nagle algorithm. When Nagle is enabled data smaller than a
+	// full-sized segment is not sent while previously sent data is unacknowledged so
+	// that small writes are coalesced. See RFC 1122 section 4.2.3.4.
+	NoDelay bool
 }
 
 func NewTCPSocket(stack *PortStack, cfg TCPSocketConfig) (*TCPSocket, error) {
@@ -48,10 +135,30 @@ func NewTCPSocket(stack *PortStack, cfg TCPSocketConfig) (*TCPSocket, error) {
 	if cfg.TxBufSize == 0 {
 		cfg.TxBufSize = defaultSocketSize
 	}
+	if cfg.InitialRTO <= 0 {
+		cfg.InitialRTO = defaultInitialRTO
+	}
+	if cfg.MinRTO <= 0 {
+		cfg.MinRTO = defaultMinRTO
+	}
+	if cfg.MaxRetransmits <= 0 {
+		cfg.MaxRetransmits = defaultMaxRetransmits
+	}
+	if cfg.KeepAliveInterval <= 0 {
+		cfg.KeepAliveInterval = defaultKeepAliveInterval
+	}
+	if cfg.KeepAliveCount <= 0 {
+		cfg.KeepAliveCount = defaultKeepAliveCount
+	}
+	if cfg.MSL <= 0 {
+		cfg.MSL = defaultMSL
+	}
 	sock := &TCPSocket{
-		stack: stack,
-		tx:    ring{buf: make([]byte, cfg.TxBufSize)},
-		rx:    ring{buf: make([]byte, cfg.RxBufSize)},
+		stack:  stack,
+		tx:     ring{buf: make([]byte, cfg.TxBufSize)},
+		rx:     ring{buf: make([]byte, cfg.RxBufSize)},
+		cfg:    cfg,
+		notify: new(notifier),
 	}
 	return sock, nil
 }
@@ -66,48 +173,78 @@ func (sock *TCPSocket) Port() uint16 { return sock.localPort }
 
 // State returns the TCP state of the socket.
 func (sock *TCPSocket) State() seqs.State {
+	sock.notify.lock()
+	defer sock.notify.unlock()
+	return sock.state()
+}
+
+func (sock *TCPSocket) state() seqs.State {
 	state := sock.scb.State()
-	if sock.closing && !state.IsClosing() {
+	if sock.closing && !state.IsClosing() && state != seqs.StateClosed {
 		// User already called close but SCB still did not receive close call.
 		state = seqs.StateFinWait1
 	}
 	return state
 }
 
-// FlushOutputBuffer waits until the output buffer is empty or the socket is closed.
+// FlushOutputBuffer waits until all data in the output buffer has been sent and
+// acknowledged by the remote or the socket is closed.
 func (sock *TCPSocket) FlushOutputBuffer() error {
-	i := 0
-	for sock.tx.Buffered() > 0 && !sock.State().IsClosed() {
-		sleep := time.Nanosecond << i
-		time.Sleep(sleep)
-		if sleep < time.Second {
-			i++
-		}
-	}
+	sock.notify.lock()
+	defer sock.notify.unlock()
+	sock.notify.wait(nil, func() bool {
+		return sock.tx.Buffered() == 0 || sock.state().IsClosed()
+	})
 	return nil
 }
 
 // Write writes argument data to the socket's output buffer which is queued to be sent.
+// If the output buffer is full Write blocks until the remote acknowledges data and space is freed.
 func (sock *TCPSocket) Write(b []byte) (int, error) {
+	return sock.WriteDeadline(b, time.Time{})
+}
+
+// WriteDeadline writes argument data to the socket's output buffer. If the buffer is full
+// it waits until space is freed or the deadline is exceeded, in which case the amount of
+// data written and [os.ErrDeadlineExceeded] are returned.
+func (sock *TCPSocket) WriteDeadline(b []byte, deadline time.Time) (int, error) {
+	sock.notify.lock()
+	defer sock.notify.unlock()
+	return sock.writeWait(b, &deadline, nil)
+}
+
+// writeWait queues b in the output buffer, waiting for space to be freed until the deadline
+// is exceeded or closed returns true, in which case [net.ErrClosed] is returned. closed may be nil.
+// The caller must hold the socket lock.
+func (sock *TCPSocket) writeWait(b []byte, deadline *time.Time, closed func() bool) (n int, err error) {
+	for n < len(b) {
+		ok := sock.notify.wait(deadline, func() bool {
+			return sock.tx.Free() > 0 || sock.writeErr() != nil || (closed != nil && closed())
+		})
+		if closed != nil && closed() {
+			return n, net.ErrClosed
+		} else if err = sock.writeErr(); err != nil {
+			return n, err
+		} else if !ok {
+			return n, os.ErrDeadlineExceeded
+		}
+		ngot, _ := sock.tx.Write(b[n:min(len(b), n+sock.tx.Free())])
+		n += ngot
+		sock.stack.flagPendingTCP()
+	}
+	return n, nil
+}
+
+// writeErr returns the error returned by writes to the socket in its current state.
+func (sock *TCPSocket) writeErr() error {
 	if sock.abortErr != nil {
-		return 0, sock.abortErr
+		return sock.abortErr
 	}
-	state := sock.State()
+	state := sock.state()
 	if state.IsClosing() || state.IsClosed() {
-		return 0, net.ErrClosed
-	}
-	if len(b) == 0 {
-		return 0, nil
-	}
-	err := sock.stack.FlagPendingTCP(sock.localPort)
-	if err != nil {
-		return 0, err
-	}
-	n, err := sock.tx.Write(b)
-	if err != nil {
-		return 0, err
+		return net.ErrClosed
 	}
-	return n, nil
+	return nil
 }
 
 // Read reads data from the socket's input buffer. If the buffer is empty,
@@ -117,110 +254,246 @@ func (sock *TCPSocket) Read(b []byte) (int, error) {
 }
 
 // BufferedInput returns the number of bytes in the socket's input buffer.
-func (sock *TCPSocket) BufferedInput() int { return sock.rx.Buffered() }
+func (sock *TCPSocket) BufferedInput() int {
+	sock.notify.lock()
+	defer sock.notify.unlock()
+	return sock.rx.Buffered()
+}
 
 // Read reads data from the socket's input buffer. If the buffer is empty
 // it will wait until the deadline is met or data is available.
 func (sock *TCPSocket) ReadDeadline(b []byte, deadline time.Time) (int, error) {
+	sock.notify.lock()
+	defer sock.notify.unlock()
 	if sock.abortErr != nil {
 		return 0, sock.abortErr
 	}
-	state := sock.State()
+	state := sock.state()
 	if state.IsClosed() || state.IsClosing() {
 		return 0, net.ErrClosed
 	}
-	noDeadline := deadline.IsZero()
-	for sock.rx.Buffered() == 0 && sock.State() == seqs.StateEstablished && (noDeadline || time.Until(deadline) > 0) {
-		runtime.Gosched()
+	sock.notify.wait(&deadline, func() bool {
+		return sock.rx.Buffered() > 0 || sock.state() != seqs.StateEstablished
+	})
+	if sock.rx.Buffered() == 0 && sock.abortErr != nil {
+		return 0, sock.abortErr // Connection aborted while waiting for data.
 	}
 	n, err := sock.rx.Read(b)
 	return n, err
 }
 
+// DialTCP opens an active TCP connection to the given remote address. The next hop towards
+// remote is chosen with the PortStack's routing table and its hardware address is resolved
+// with ARP if not cached. The SYN is sent once resolution completes. If resolution fails the connection is aborted with [ErrHostUnreachable].
+func (sock *TCPSocket) DialTCP(localPort uint16, remote netip.AddrPort, iss seqs.Value) error {
+	nextHop := sock.stack.nextHop(remote.Addr())
+	if !nextHop.IsValid() {
+		return ErrHostUnreachable // No route to remote.
+	}
+	remoteMAC, ok := sock.stack.arpClient.Lookup(nextHop)
+	if !ok {
+		err := sock.stack.arpClient.BeginResolve(nextHop)
+		if err != nil {
+			return err
+		}
+	}
+	return sock.open(seqs.StateSynSent, localPort, iss, remoteMAC, remote)
+}
+
 // OpenDialTCP opens an active TCP connection to the given remote address.
+// If remoteMAC is zero the hardware address of the next hop towards remote, chosen with the
+// PortStack's routing table, is looked up in the ARP cache. A non-zero remoteMAC bypasses the
+// routing table: segments are sent to remoteMAC even if remote is reached through a gateway.
+// Use [TCPSocket.DialTCP] to route and resolve the next hop automatically.
+// If the socket is in TIME-WAIT the previous connection is released unless it has the same
+// local port and remote address, in which case an error is returned until TIME-WAIT expires.
 func (sock *TCPSocket) OpenDialTCP(localPort uint16, remoteMAC [6]byte, remote netip.AddrPort, iss seqs.Value) error {
+	if remoteMAC == ([6]byte{}) {
+		mac, ok := sock.stack.arpClient.Lookup(sock.stack.nextHop(remote.Addr()))
+		if !ok {
+			return errTCPUnknownHW
+		}
+		remoteMAC = mac
+	}
 	return sock.open(seqs.StateSynSent, localPort, iss, remoteMAC, remote)
 }
 
 // OpenListenTCP opens a passive TCP connection that listens on the given port.
-// OpenListenTCP only handles one connection at a time, so API may change in future to accomodate multiple connections.
+// OpenListenTCP only handles one connection at a time, use [TCPListener] to accept multiple connections.
+// Listening on the local port of a connection in TIME-WAIT returns an error until TIME-WAIT expires.
 func (sock *TCPSocket) OpenListenTCP(localPortNum uint16, iss seqs.Value) error {
 	return sock.open(seqs.StateListen, localPortNum, iss, [6]byte{}, netip.AddrPort{})
 }
 
 func (sock *TCPSocket) open(state seqs.State, localPortNum uint16, iss seqs.Value, remoteMAC [6]byte, remoteAddr netip.AddrPort) error {
+	sock.notify.lock()
+	timeWait := sock.scb.State() == seqs.StateTimeWait
+	sameConn := localPortNum == sock.localPort && (!remoteAddr.IsValid() || remoteAddr == sock.remote)
+	sock.notify.unlock()
+	if timeWait {
+		if sameConn {
+			return errTimeWait // Connection may still have duplicate segments in the network.
+		}
+		sock.stack.closeTCP(sock) // Release previous connection and its port.
+	}
+	sock.notify.lock()
+	err := sock.initState(localPortNum, iss, remoteMAC, remoteAddr)
+	if err == nil && state == seqs.StateSynSent {
+		err = sock.scb.Send(sock.synsentSegment())
+	}
+	sock.notify.unlock()
+	if err != nil {
+		return err
+	}
+	err = sock.stack.openTCP(localPortNum, remoteAddr, sock)
+	if err != nil {
+		return err
+	}
+	if state == seqs.StateSynSent {
+		sock.stack.flagPendingTCP()
+	}
+	return nil
+}
+
+// initState resets the connection state of the socket to start a new connection.
+// The socket awaits a SYN from the remote unless the remote address is set.
+func (sock *TCPSocket) initState(localPortNum uint16, iss seqs.Value, remoteMAC [6]byte, remoteAddr netip.AddrPort) error {
 	err := sock.scb.Open(iss, seqs.Size(len(sock.rx.buf)), seqs.StateSynSent)
 	if err != nil {
 		return err
 	}
 	sock.scb.SetLogger(sock.stack.logger)
+	sock.scb.SetReassembly(sock.cfg.Reassembly)
+	sock.scb.SetDelayedACK(sock.cfg.DelayedACK > 0)
+	sock.scb.SetMaxSegmentSize(seqs.DefaultMSS) // Until the remote's MSS option is received.
+	sock.scb.SetCongestionControl(sock.cfg.CongestionControl)
 	sock.remoteMAC = remoteMAC
 	sock.remote = remoteAddr
 	sock.localPort = localPortNum
 	sock.rx.Reset()
 	sock.tx.Reset()
-	err = sock.stack.OpenTCP(localPortNum, sock)
-	if err != nil {
-		return err
-	}
-	if state == seqs.StateSynSent {
-		err = sock.stack.FlagPendingTCP(localPortNum)
-		if err != nil {
-			sock.stack.CloseTCP(localPortNum)
-			return err
-		}
-		err = sock.scb.Send(sock.synsentSegment())
-	}
-	return err
+	sock.txStart = seqs.Add(iss, 1)
+	sock.abortErr = nil
+	sock.lastTx = time.Time{}
+	sock.rto.reset(sock.cfg.InitialRTO, sock.cfg.MinRTO)
+	sock.stopRetransmitTimer()
+	sock.retries = 0
+	sock.kaProbes = 0
+	sock.stopPersistTimer()
+	sock.ackDeadline = time.Time{}
+	sock.twDeadline = time.Time{}
+	return nil
 }
 
 func (sock *TCPSocket) Close() error {
-	toSend := sock.tx.Buffered()
+	sock.notify.lock()
+	if sock.listener != nil && sock.scb.State() == seqs.StateClosed {
+		// Connection already terminated, return socket to the listener's pool.
+		sock.listener.release(sock)
+		sock.notify.unlock()
+		return nil
+	}
+	toSend := sock.txUnsent()
 	if toSend == 0 {
 		err := sock.scb.Close()
 		if err != nil {
+			sock.notify.unlock()
 			return err
 		}
 	}
 	sock.closing = true
-	sock.stack.FlagPendingTCP(sock.localPort)
+	sock.notify.broadcast() // Wake users blocked on the socket.
+	sock.notify.unlock()
+	sock.stack.flagPendingTCP()
 	return nil
 }
 
+// isPendingHandling returns true if the socket has a segment to send or a timer has expired.
+// Running timers do not make the socket pending, see isTimerRunning.
 func (sock *TCPSocket) isPendingHandling() bool {
-	return sock.mustSendSyn() || sock.scb.HasPending() || sock.tx.Buffered() > 0 || sock.closing
+	sock.notify.lock()
+	defer sock.notify.unlock()
+	if _, ok := sock.scb.PendingRetransmit(); ok {
+		return true // Fast retransmit or SACK hole.
+	}
+	now := sock.stack.now()
+	return sock.mustSendSyn() || sock.scb.HasPending() || sock.txUnsent() > 0 || sock.closing || sock.retransmitting ||
+		(!sock.rtoDeadline.IsZero() && now.After(sock.rtoDeadline)) || sock.keepaliveDue(now) ||
+		(!sock.twDeadline.IsZero() && now.After(sock.twDeadline)) || (sock.scb.ACKDelayed() && !now.Before(sock.ackDeadline))
+}
+
+// isTimerRunning returns true if a timer is running whose expiry must be handled by the socket.
+// The PortStack keeps checking the socket for expired timers while it returns true.
+func (sock *TCPSocket) isTimerRunning() bool {
+	sock.notify.lock()
+	defer sock.notify.unlock()
+	return !sock.rtoDeadline.IsZero() || sock.keepaliveEnabled() || !sock.twDeadline.IsZero() || sock.scb.ACKDelayed()
 }
 
 func (sock *TCPSocket) recv(pkt *TCPPacket) (err error) {
+	sock.notify.lock()
+	defer sock.notify.unlock()
+	defer sock.notify.broadcast() // Data or acknowledgements may have been received.
 	prevState := sock.scb.State()
-	if prevState.IsClosed() {
+	if prevState == seqs.StateClosed {
 		return io.EOF
 	}
 
-	remotePort := sock.remote.Port()
-	if remotePort != 0 && pkt.TCP.SourcePort != remotePort {
+	if sock.remote.IsValid() && (pkt.TCP.SourcePort != sock.remote.Port() || pkt.IP.Source != sock.remote.Addr().As4()) {
 		return nil // This packet came from a different client to the one we are interacting with.
 	}
 	sock.lastRx = pkt.Rx
+	sock.kaProbes = 0
 	// By this point we know that the packet is valid and contains data, we process it.
 	payload := pkt.Payload()
 	segIncoming := pkt.TCP.Segment(len(payload))
+	opts, err := eth.DecodeTCPOptions(pkt.TCPOptions())
+	if err != nil {
+		sock.stack.debug("TCP:bad-options", slog.Uint64("port", uint64(sock.localPort)), slog.String("err", err.Error()))
+	}
+	segIncoming.SACK = opts.SACK
+	segIncoming.NumSACK = opts.NumSACK
+	segIncoming.TSVal = opts.TSVal
+	segIncoming.TSEcr = opts.TSEcr
+	segIncoming.HasTimestamps = opts.HasTimestamps
 
+	prevNxt := sock.scb.RecvNext()
+	prevUNA := sock.scb.SendUNA()
+	sock.scb.SetTime(sock.stack.now())
 	err = sock.scb.Recv(segIncoming)
+	if segIncoming.Flags.HasAny(seqs.FlagRST) && sock.scb.State() == seqs.StateClosed {
+		sock.stack.info("TCP:reset", slog.Uint64("port", uint64(sock.localPort)), slog.String("state", prevState.String()))
+		switch prevState {
+		case seqs.StateEstablished, seqs.StateFinWait1, seqs.StateFinWait2, seqs.StateCloseWait:
+			sock.abortErr = ErrConnectionReset // User is signalled reset. See RFC 9293 section 3.10.7.4.
+		}
+		return io.EOF // On EOF portStack will abort the connection.
+	}
+	if prevState == seqs.StateTimeWait && segIncoming.Flags.HasAny(seqs.FlagFIN) {
+		// Retransmitted FIN is acknowledged and the TIME-WAIT timer restarted. See RFC 9293 section 3.10.7.4.
+		sock.twDeadline = sock.stack.now().Add(2 * sock.cfg.MSL)
+	}
 	if err != nil {
 		return nil // Segment not admitted, yield to sender.
 	}
+	if sock.scb.ACKDelayed() && sock.ackDeadline.IsZero() {
+		sock.ackDeadline = pkt.Rx.Add(sock.cfg.DelayedACK)
+	}
+	if seqs.LessThan(prevUNA, sock.scb.SendUNA()) {
+		sock.onAck(sock.stack.now(), segIncoming.TSEcr)
+	}
 	if prevState != sock.scb.State() {
 		sock.stack.info("TCP:rx-statechange", slog.Uint64("port", uint64(sock.localPort)), slog.String("old", prevState.String()), slog.String("new", sock.scb.State().String()), slog.String("rxflags", segIncoming.Flags.String()))
 	}
-	if segIncoming.Flags.HasAny(seqs.FlagPSH) {
-		if len(payload) != int(segIncoming.DATALEN) {
-			return errors.New("segment data length does not match payload length")
-		}
-		_, err = sock.rx.Write(payload)
+	if segIncoming.DATALEN > 0 && !segIncoming.Flags.HasAny(seqs.FlagSYN) {
+		err = sock.bufferPayload(prevNxt, segIncoming, payload)
 		if err != nil {
 			return err
 		}
+		sock.scb.SetRecvWindow(seqs.Size(sock.rx.Free())) // Window shrinks until user reads data.
+	}
+	if segIncoming.Flags.HasAny(seqs.FlagSYN) {
+		sock.recvSynOptions(&opts)
 	}
 	if segIncoming.Flags.HasAny(seqs.FlagSYN) && !sock.remote.IsValid() {
 		// We have a client that wants to connect to us.
@@ -231,23 +504,88 @@ func (sock *TCPSocket) recv(pkt *TCPPacket) (err error) {
 	return err
 }
 
+// bufferPayload writes the payload of an admitted segment into the receive buffer at its
+// offset from prevNxt, the value of RCV.NXT before the segment was received. Data becomes
+// readable once RCV.NXT advances over it, which may be immediately or
+// after the missing data preceding an out-of-order segment arrives.
+func (sock *TCPSocket) bufferPayload(prevNxt seqs.Value, seg seqs.Segment, payload []byte) error {
+	if len(payload) != int(seg.DATALEN) {
+		return errors.New("segment data length does not match payload length")
+	}
+	offset := int(seqs.Sizeof(prevNxt, seg.SEQ))
+	if offset+len(payload) > sock.rx.Free() {
+		return errors.New("segment exceeds receive buffer")
+	}
+	sock.rx.writeAt(offset, payload)
+	advanced := seqs.Sizeof(prevNxt, sock.scb.RecvNext())
+	if seg.Flags.HasAny(seqs.FlagFIN) && advanced > 0 {
+		advanced-- // FIN occupies one sequence number but carries no data.
+	}
+	sock.rx.commit(int(advanced))
+	return nil
+}
+
 func (sock *TCPSocket) send(response []byte) (n int, err error) {
+	sock.notify.lock()
+	defer sock.notify.unlock()
 	if !sock.remote.IsValid() {
 		return 0, nil // No remote address yet, yield.
 	}
+	if sock.remoteMAC == ([6]byte{}) {
+		err = sock.resolveNextHop()
+		if err != nil || sock.remoteMAC == ([6]byte{}) {
+			return 0, err // Hold SYN until the next hop is resolved.
+		}
+	}
+	now := sock.stack.now()
+	if !sock.twDeadline.IsZero() && now.After(sock.twDeadline) {
+		sock.stack.debug("TCP:time-wait-expired", slog.Uint64("port", uint64(sock.localPort)))
+		return 0, io.EOF // On EOF portStack will release the port.
+	}
+	if !sock.rtoDeadline.IsZero() && now.After(sock.rtoDeadline) {
+		err = sock.handleRTO(now)
+		if err != nil {
+			return 0, err
+		}
+	}
+	sock.checkDelayedACK(now)
 	if sock.mustSendSyn() {
 		// Connection is still closed, we need to establish
-		return sock.handleInitSyn(response)
+		return sock.handleInitSyn(response, now)
+	}
+	if seq, ok := sock.scb.PendingRetransmit(); ok {
+		// Fast retransmit, see RFC 5681 section 3.2.
+		n, _, err = sock.retransmit(response, seq, now)
+		if n > 0 || err != nil {
+			return n, err
+		}
+	}
+	if sock.retransmitting {
+		n, err = sock.handleRetransmit(response, now)
+		if n > 0 || err != nil {
+			return n, err
+		}
+	}
+	// Advertise our receive window as the amount of space available in our receive buffer.
+	sock.scb.SetRecvWindow(seqs.Size(sock.rx.Free()))
+	if sock.keepaliveDue(now) {
+		return sock.handleKeepalive(response, now)
+	}
+	if sock.persistDue(now) {
+		return sock.handleWindowProbe(response, now)
+	}
+	maxPayload := sock.maxPayload(len(response))
+	available := min(sock.txUnsent(), maxPayload)
+	if !sock.cfg.NoDelay && available < maxPayload && sock.scb.SendUNA() != sock.scb.SendNext() {
+		available = 0 // Nagle: wait for acknowledgement or a full-sized segment.
 	}
-	available := min(sock.tx.Buffered(), len(response)-sizeTCPNoOptions)
 	seg, ok := sock.scb.PendingSegment(available)
 	if !ok {
 		// No pending control segment or data to send. Yield to handleUser.
 		return 0, nil
 	}
+	sock.fitOptions(&seg, maxPayload)
 
-	// Advertise our receive window as the amount of space available in our receive buffer.
-	sock.scb.SetRecvWindow(seqs.Size(sock.rx.Free()))
 	prevState := sock.scb.State()
 	err = sock.scb.Send(seg)
 	if err != nil {
@@ -255,22 +593,156 @@ func (sock *TCPSocket) send(response []byte) (n int, err error) {
 	}
 
 	// If we have user data to send we send it, else we send the control segment.
-	var payload []byte
-	if available > 0 {
-		payload = response[sizeTCPNoOptions : sizeTCPNoOptions+seg.DATALEN]
-		n, err = sock.tx.Read(payload)
-		if err != nil && err != io.EOF || n != int(seg.DATALEN) {
+	if seg.DATALEN > 0 {
+		hdrlen := sock.headerSize(seg)
+		n = sock.tx.readAt(response[hdrlen:hdrlen+int(seg.DATALEN)], sock.txOffset(seg.SEQ))
+		if n != int(seg.DATALEN) {
 			panic("bug in handleUser") // This is a bug in ring buffer or a race condition.
 		}
 	}
-	sock.setSrcDest(&sock.pkt)
-	sock.pkt.CalculateHeaders(seg, payload)
-	sock.pkt.PutHeaders(response)
+	n, err = sock.putSegment(response, seg)
+	if err != nil {
+		return 0, err
+	}
+	sock.onSend(seg, now, false)
 	if prevState != sock.scb.State() {
+		sock.notify.broadcast()
 		sock.stack.info("TCP:tx-statechange", slog.Uint64("port", uint64(sock.localPort)), slog.String("old", prevState.String()), slog.String("new", sock.scb.State().String()), slog.String("txflags", seg.Flags.String()))
 	}
 	err = sock.stateCheck()
-	return sizeTCPNoOptions + n, err
+	return n, err
+}
+
+// resolveNextHop sets the remote hardware address of a connection opened with DialTCP once
+// the next hop's address is resolved. It aborts the connection if resolution failed.
+func (sock *TCPSocket) resolveNextHop() error {
+	nextHop := sock.stack.nextHop(sock.remote.Addr())
+	mac, ok := sock.stack.arpClient.Lookup(nextHop)
+	if ok {
+		sock.remoteMAC = mac
+		return nil
+	} else if !sock.stack.arpClient.isResolving(nextHop) {
+		sock.stack.info("TCP:host-unreachable", slog.Uint64("port", uint64(sock.localPort)), slog.String("nexthop", nextHop.String()))
+		sock.abortErr = ErrHostUnreachable
+		return io.EOF // On EOF portStack will abort the connection.
+	}
+	return nil
+}
+
+// putSegment writes the Ethernet, IPv4 and TCP headers of seg along with its TCP options into
+// response and returns the length of the packet. The segment's payload must be written
+// to response beforehand at offset headerSize(seg).
+func (sock *TCPSocket) putSegment(response []byte, seg seqs.Segment) (n int, err error) {
+	opts := sock.segmentOptions(seg)
+	hdrlen := sizeTCPNoOptions + opts.Size()
+	payload := response[hdrlen : hdrlen+int(seg.DATALEN)]
+	sock.setSrcDest(&sock.pkt)
+	err = sock.pkt.CalculateHeadersWithOptions(seg, &opts, payload)
+	if err != nil {
+		return 0, err
+	}
+	err = sock.pkt.PutHeadersWithOptions(response)
+	if err != nil {
+		return 0, err
+	}
+	return hdrlen + len(payload), nil
+}
+
+// fitOptions shortens the payload of seg so that the payload and TCP options
+// do not exceed maxPayload bytes.
+func (sock *TCPSocket) fitOptions(seg *seqs.Segment, maxPayload int) {
+	optlen := sock.headerSize(*seg) - sizeTCPNoOptions
+	if int(seg.DATALEN)+optlen <= maxPayload {
+		return
+	}
+	seg.DATALEN = seqs.Size(max(maxPayload-optlen, 0))
+	if seg.DATALEN == 0 {
+		seg.Flags &^= seqs.FlagPSH
+	}
+}
+
+// segmentOptions returns the TCP options sent along with seg.
+func (sock *TCPSocket) segmentOptions(seg seqs.Segment) (opts eth.TCPOptions) {
+	// Options are offered on active open and only sent in a SYN-ACK if remote offered them.
+	activeOpen := seg.Flags&(seqs.FlagSYN|seqs.FlagACK) == seqs.FlagSYN
+	if seg.HasTimestamps || activeOpen {
+		opts.TSVal = sock.tsval(sock.stack.now())
+		opts.TSEcr = seg.TSEcr
+		opts.HasTimestamps = true
+	}
+	if !seg.Flags.HasAny(seqs.FlagSYN) {
+		// Send as many SACK blocks as fit in the options area.
+		maxSACK := (eth.MaxSizeTCPOptions - opts.Size() - 4) / 8
+		opts.SACK = seg.SACK
+		opts.NumSACK = uint8(min(int(seg.NumSACK), maxSACK))
+		return opts
+	}
+	opts.MSS = sock.localMSS()
+	_, _, wscale := sock.scb.WindowScale()
+	if activeOpen || wscale {
+		opts.WindowScale = sock.recvWindowShift()
+		opts.HasWindowScale = true
+	}
+	opts.SACKPermitted = activeOpen || sock.scb.SACK()
+	return opts
+}
+
+// headerSize returns the size of the headers and options preceding the payload of seg.
+func (sock *TCPSocket) headerSize(seg seqs.Segment) int {
+	opts := sock.segmentOptions(seg)
+	return sizeTCPNoOptions + opts.Size()
+}
+
+// maxPayload returns the maximum amount of data that can be sent in a single segment
+// written to a buffer of length bufLen.
+func (sock *TCPSocket) maxPayload(bufLen int) int {
+	return min(bufLen-sizeTCPNoOptions, int(sock.scb.MaxSegmentSize()))
+}
+
+// localMSS returns the maximum segment size we can receive as limited by the PortStack MTU.
+// It is advertised to the remote in the MSS option of SYN segments.
+func (sock *TCPSocket) localMSS() uint16 {
+	return sock.stack.MTU() - sizeTCPNoOptions
+}
+
+// recvSynOptions processes the TCP options of a SYN segment received from the remote.
+// The sender maximum segment size is set to the remote's MSS option or the default
+// MSS if absent, limited by the size of the segments we can send. See RFC 9293 section 3.7.1.
+// Window scaling, SACK and timestamps are enabled if the remote sent their options.
+func (sock *TCPSocket) recvSynOptions(opts *eth.TCPOptions) {
+	mss := seqs.Size(seqs.DefaultMSS)
+	if opts.MSS != 0 {
+		mss = seqs.Size(opts.MSS)
+	}
+	if local := seqs.Size(sock.localMSS()); mss > local {
+		mss = local
+	}
+	sock.scb.SetMaxSegmentSize(mss)
+	if opts.HasWindowScale {
+		// Both ends have sent the window scale option, see RFC 7323 section 2.2.
+		sndShift := opts.WindowScale
+		if sndShift > seqs.MaxWindowShift {
+			sndShift = seqs.MaxWindowShift
+		}
+		sock.scb.SetWindowScale(sndShift, sock.recvWindowShift())
+	}
+	sock.scb.SetSACK(opts.SACKPermitted)
+	sock.scb.SetTimestamps(opts.HasTimestamps)
+}
+
+// tsval returns the value of the timestamp clock sent in the timestamps option.
+// The clock ticks every millisecond. See RFC 7323 section 5.4.
+func (sock *TCPSocket) tsval(now time.Time) uint32 {
+	return uint32(now.UnixMilli())
+}
+
+// recvWindowShift returns the window scale shift count needed to advertise the
+// whole receive buffer to the remote.
+func (sock *TCPSocket) recvWindowShift() (shift uint8) {
+	for shift < seqs.MaxWindowShift && len(sock.rx.buf)>>shift > math.MaxUint16 {
+		shift++
+	}
+	return shift
 }
 
 func (sock *TCPSocket) setSrcDest(pkt *TCPPacket) {
@@ -283,12 +755,246 @@ func (sock *TCPSocket) setSrcDest(pkt *TCPPacket) {
 	pkt.Eth.Destination = sock.remoteMAC
 }
 
-func (sock *TCPSocket) handleInitSyn(response []byte) (n int, err error) {
+func (sock *TCPSocket) handleInitSyn(response []byte, now time.Time) (n int, err error) {
 	// Uninitialized TCB, we start the handshake.
-	sock.setSrcDest(&sock.pkt)
-	sock.pkt.CalculateHeaders(sock.synsentSegment(), nil)
-	sock.pkt.PutHeaders(response)
-	return sizeTCPNoOptions, nil
+	seg := sock.synsentSegment()
+	n, err = sock.putSegment(response, seg)
+	if err != nil {
+		return 0, err
+	}
+	sock.onSend(seg, now, sock.retransmitting)
+	sock.retransmitting = false
+	return n, nil
+}
+
+// handleRetransmit writes a segment retransmitting unacknowledged sequence space starting at rtxNxt.
+// It returns 0 if there is nothing left to retransmit.
+func (sock *TCPSocket) handleRetransmit(response []byte, now time.Time) (n int, err error) {
+	n, seg, err := sock.retransmit(response, sock.rtxNxt, now)
+	if n == 0 {
+		sock.retransmitting = false
+		return 0, err
+	}
+	sock.rtxNxt = seqs.Add(seg.SEQ, seg.LEN())
+	if sock.rtxNxt == sock.scb.SendNext() {
+		sock.retransmitting = false
+	}
+	return n, err
+}
+
+// retransmit writes a segment retransmitting unacknowledged sequence space starting at seq.
+// It returns 0 if there is nothing to retransmit at seq.
+func (sock *TCPSocket) retransmit(response []byte, seq seqs.Value, now time.Time) (n int, seg seqs.Segment, err error) {
+	maxPayload := sock.maxPayload(len(response))
+	sock.scb.SetRecvWindow(seqs.Size(sock.rx.Free()))
+	seg, ok := sock.scb.RetransmitSegment(seq, maxPayload)
+	if !ok {
+		return 0, seg, nil
+	}
+	sock.fitOptions(&seg, maxPayload)
+	err = sock.scb.Send(seg)
+	if err != nil {
+		return 0, seg, err
+	}
+	hdrlen := sock.headerSize(seg)
+	n = sock.tx.readAt(response[hdrlen:hdrlen+int(seg.DATALEN)], sock.txOffset(seg.SEQ))
+	if n != int(seg.DATALEN) {
+		panic("bug in retransmit") // Unacknowledged data must be kept in tx.
+	}
+	n, err = sock.putSegment(response, seg)
+	if err != nil {
+		return 0, seg, err
+	}
+	if !sock.rttStart.IsZero() && seqs.InWindow(sock.rttSeq, seg.SEQ, seg.LEN()) {
+		sock.rttStart = time.Time{} // Karn's algorithm: do not time retransmitted segments.
+	}
+	sock.onSend(seg, now, true)
+	sock.stack.debug("TCP:retransmit", slog.Uint64("port", uint64(sock.localPort)), slog.Uint64("seq", uint64(seg.SEQ)), slog.Uint64("len", uint64(seg.LEN())))
+	return n, seg, sock.stateCheck()
+}
+
+// handleRTO is called on expiry of the retransmission timer. It backs off the timer and
+// flags all unacknowledged sequence space for retransmission. See RFC 6298 section 5.
+// If the maximum amount of retransmissions is exceeded the connection is aborted.
+func (sock *TCPSocket) handleRTO(now time.Time) error {
+	sock.retries++
+	if sock.retries > sock.cfg.MaxRetransmits {
+		sock.stack.info("TCP:rto-abort", slog.Uint64("port", uint64(sock.localPort)), slog.Int("retries", sock.retries-1))
+		sock.abortErr = ErrRetransmitTimeout
+		return io.EOF // On EOF portStack will abort the connection.
+	}
+	sock.scb.RetransmitTimeout()
+	sock.rto.backoff()
+	sock.rtoDeadline = now.Add(sock.rto.RTO())
+	sock.rttStart = time.Time{} // Karn's algorithm: do not time retransmitted segments.
+	sock.rtxNxt = sock.scb.SendUNA()
+	sock.retransmitting = true
+	sock.stack.debug("TCP:rto", slog.Uint64("port", uint64(sock.localPort)), slog.Duration("rto", sock.rto.RTO()))
+	return nil
+}
+
+// keepaliveEnabled checks if keepalive is enabled and the connection is synchronized.
+func (sock *TCPSocket) keepaliveEnabled() bool {
+	state := sock.scb.State()
+	return sock.cfg.KeepAliveIdle > 0 && (state == seqs.StateEstablished || state == seqs.StateCloseWait)
+}
+
+// keepaliveDue checks if a keepalive probe must be sent. Probes are only sent
+// when there is no data in flight or waiting to be sent.
+func (sock *TCPSocket) keepaliveDue(now time.Time) bool {
+	if !sock.keepaliveEnabled() || sock.scb.SendUNA() != sock.scb.SendNext() || sock.txUnsent() > 0 {
+		return false
+	}
+	deadline := sock.lastRx.Add(sock.cfg.KeepAliveIdle + time.Duration(sock.kaProbes)*sock.cfg.KeepAliveInterval)
+	return !now.Before(deadline)
+}
+
+// handleKeepalive writes a keepalive probe to response or aborts the connection
+// after KeepAliveCount unanswered probes.
+func (sock *TCPSocket) handleKeepalive(response []byte, now time.Time) (n int, err error) {
+	if sock.kaProbes >= sock.cfg.KeepAliveCount {
+		sock.stack.info("TCP:keepalive-abort", slog.Uint64("port", uint64(sock.localPort)), slog.Int("probes", sock.kaProbes))
+		sock.abortErr = ErrKeepaliveTimeout
+		return 0, io.EOF // On EOF portStack will abort the connection.
+	}
+	seg, ok := sock.scb.KeepaliveSegment()
+	if !ok {
+		return 0, nil
+	}
+	n, err = sock.putSegment(response, seg)
+	if err != nil {
+		return 0, err
+	}
+	sock.kaProbes++
+	sock.lastTx = now
+	sock.stack.debug("TCP:keepalive", slog.Uint64("port", uint64(sock.localPort)), slog.Int("probe", sock.kaProbes))
+	return n, nil
+}
+
+// checkDelayedACK queues the acknowledgement of received data once the delayed ACK timer expires.
+func (sock *TCPSocket) checkDelayedACK(now time.Time) {
+	if !sock.scb.ACKDelayed() {
+		sock.ackDeadline = time.Time{} // Acknowledged by a segment sent or timer not running.
+	} else if !now.Before(sock.ackDeadline) {
+		sock.scb.FlushDelayedACK()
+		sock.ackDeadline = time.Time{}
+	}
+}
+
+// persistDue starts, stops or checks the expiry of the persist timer. The timer runs while
+// the remote advertises a zero window and there is data waiting to be sent with none in flight.
+func (sock *TCPSocket) persistDue(now time.Time) bool {
+	state := sock.scb.State()
+	zeroWindow := sock.scb.SendWindow() == 0 && sock.scb.SendUNA() == sock.scb.SendNext() &&
+		sock.txUnsent() > 0 && (state == seqs.StateEstablished || state == seqs.StateCloseWait)
+	if !zeroWindow {
+		sock.stopPersistTimer()
+		return false
+	} else if sock.persistDeadline.IsZero() {
+		sock.persistDeadline = now.Add(sock.persistInterval())
+		return false
+	}
+	return !now.Before(sock.persistDeadline)
+}
+
+// handleWindowProbe writes a zero window probe to response and restarts the persist
+// timer with exponential backoff. The probe is answered with the remote's current window.
+func (sock *TCPSocket) handleWindowProbe(response []byte, now time.Time) (n int, err error) {
+	seg, ok := sock.scb.WindowProbeSegment()
+	if !ok {
+		return 0, nil
+	}
+	n, err = sock.putSegment(response, seg)
+	if err != nil {
+		return 0, err
+	}
+	if sock.persistInterval() < maxRTO {
+		sock.persistShift++
+	}
+	sock.persistDeadline = now.Add(sock.persistInterval())
+	sock.lastTx = now
+	sock.stack.debug("TCP:window-probe", slog.Uint64("port", uint64(sock.localPort)), slog.Duration("next", sock.persistInterval()))
+	return n, nil
+}
+
+// persistInterval returns the time between zero window probes which is the RTO
+// doubled on every unanswered probe and bounded by the maximum RTO.
+func (sock *TCPSocket) persistInterval() time.Duration {
+	interval := sock.rto.RTO() << sock.persistShift
+	if interval > maxRTO {
+		interval = maxRTO
+	}
+	return interval
+}
+
+func (sock *TCPSocket) stopPersistTimer() {
+	sock.persistDeadline = time.Time{}
+	sock.persistShift = 0
+}
+
+// onSend updates retransmission state after a segment is written to the network.
+func (sock *TCPSocket) onSend(seg seqs.Segment, now time.Time, retransmission bool) {
+	sock.lastTx = now
+	if seg.LEN() == 0 {
+		return // Segments that occupy no sequence space are not retransmitted.
+	}
+	if sock.rtoDeadline.IsZero() {
+		sock.rtoDeadline = now.Add(sock.rto.RTO())
+	}
+	if !retransmission && sock.rttStart.IsZero() {
+		sock.rttStart = now
+		sock.rttSeq = seg.SEQ
+	}
+}
+
+// onAck updates retransmission state and discards acknowledged data from the
+// output buffer after SND.UNA advances. tsecr is the timestamp echo reply of the
+// acknowledgement which is used to measure the round trip time when timestamps are enabled.
+func (sock *TCPSocket) onAck(now time.Time, tsecr uint32) {
+	una := sock.scb.SendUNA()
+	if seqs.LessThan(sock.txStart, una) {
+		acked := min(int(seqs.Sizeof(sock.txStart, una)), sock.tx.Buffered())
+		sock.tx.discard(acked)
+		sock.txStart = seqs.Add(sock.txStart, seqs.Size(acked))
+	}
+	if sock.scb.Timestamps() {
+		// RTTM: Every acknowledgement of new data yields an RTT sample, see RFC 7323 section 4.
+		if tsecr != 0 {
+			sock.rto.sample(time.Duration(sock.tsval(now)-tsecr) * time.Millisecond)
+		}
+	} else if !sock.rttStart.IsZero() && seqs.LessThan(sock.rttSeq, una) {
+		sock.rto.sample(now.Sub(sock.rttStart))
+		sock.rttStart = time.Time{}
+	}
+	sock.retries = 0
+	if sock.retransmitting && seqs.LessThan(sock.rtxNxt, una) {
+		sock.rtxNxt = una
+	}
+	if una == sock.scb.SendNext() {
+		sock.stopRetransmitTimer() // All data acknowledged.
+	} else {
+		sock.rtoDeadline = now.Add(sock.rto.RTO())
+	}
+}
+
+func (sock *TCPSocket) stopRetransmitTimer() {
+	sock.rtoDeadline = time.Time{}
+	sock.rttStart = time.Time{}
+	sock.retransmitting = false
+}
+
+// txOffset returns the offset of seq from the start of the output buffer.
+func (sock *TCPSocket) txOffset(seq seqs.Value) int {
+	return int(seqs.Sizeof(sock.txStart, seq))
+}
+
+// txUnsent returns the amount of data in the output buffer that has not yet been sent.
+func (sock *TCPSocket) txUnsent() int {
+	nxt := sock.scb.SendNext()
+	if seqs.LessThan(nxt, sock.txStart) {
+		return sock.tx.Buffered() // SYN not yet sent.
+	}
+	return max(0, sock.tx.Buffered()-sock.txOffset(nxt))
 }
 
 func (sock *TCPSocket) awaitingSyn() bool {
@@ -296,14 +1002,18 @@ func (sock *TCPSocket) awaitingSyn() bool {
 }
 
 func (sock *TCPSocket) mustSendSyn() bool {
-	return sock.awaitingSyn() && time.Since(sock.lastTx) > 3*time.Second
+	return sock.awaitingSyn() && (sock.lastTx.IsZero() || sock.retransmitting)
 }
 
 func (sock *TCPSocket) deleteState() {
 	*sock = TCPSocket{
-		stack: sock.stack,
-		rx:    ring{buf: sock.rx.buf},
-		tx:    ring{buf: sock.tx.buf},
+		stack:    sock.stack,
+		rx:       ring{buf: sock.rx.buf},
+		tx:       ring{buf: sock.tx.buf},
+		cfg:      sock.cfg,
+		abortErr: sock.abortErr,
+		listener: sock.listener,
+		notify:   sock.notify,
 	}
 }
 
@@ -312,21 +1022,24 @@ func (sock *TCPSocket) synsentSegment() seqs.Segment {
 		SEQ:   sock.scb.ISS(),
 		ACK:   0,
 		Flags: seqs.FlagSYN,
-		WND:   sock.scb.RecvWindow(),
+		WND:   seqs.Size(min(int(sock.scb.RecvWindow()), math.MaxUint16)), // SYN window is never scaled.
 	}
 }
 
 func (sock *TCPSocket) stateCheck() (portStackErr error) {
-	state := sock.State()
-	txEmpty := sock.tx.Buffered() == 0
+	state := sock.state()
+	txEmpty := sock.txUnsent() == 0
 	// Close checks:
 	if sock.closing && txEmpty && sock.scb.State() == seqs.StateEstablished { // Get RAW state of SCB.
 		sock.scb.Close()
 		sock.stack.debug("TCP:delayed-close", slog.Uint64("port", uint64(sock.localPort)))
 	}
+	if state == seqs.StateTimeWait && sock.twDeadline.IsZero() {
+		sock.twDeadline = sock.stack.now().Add(2 * sock.cfg.MSL)
+	}
 	if sock.scb.HasPending() {
 		portStackErr = ErrFlagPending // Flag to PortStack that we have pending data to send.
-	} else if state.IsClosed() {
+	} else if state == seqs.StateClosed {
 		portStackErr = io.EOF // On EOF portStack will abort the connection.
 	}
 	return portStackErr
@@ -336,5 +1049,11 @@ func (sock *TCPSocket) stateCheck() (portStackErr error) {
 // on EOF returned by Handle/RecvEth. See TCPSocket.stateCheck for information on when
 // a connection is aborted.
 func (t *TCPSocket) abort() {
+	t.notify.lock()
+	defer t.notify.unlock()
+	if t.listener != nil {
+		t.listener.connAborted(t)
+	}
 	t.deleteState()
+	t.notify.broadcast()
 }
@@ -0,0 +1,423 @@
+package stacks
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"net/netip"
+	"os"
+	"time"
+
+	"github.com/soypat/seqs/eth"
+)
+
+var (
+	_ iudphandler    = (*UDPSocket)(nil)
+	_ net.PacketConn = (*UDPSocket)(nil)
+)
+
+const (
+	defaultUDPQueueSize = 4
+	sizeUDPNoOptions    = eth.SizeEthernetHeader + eth.SizeIPv4Header + eth.SizeUDPHeader
+)
+
+var (
+	errUDPAddr         = errors.New("udp address must be IPv4")
+	errUDPNotUDPAddr   = errors.New("address is not a *net.UDPAddr")
+	errUDPBadQueueSize = errors.New("udp queue size must be positive")
+)
+
+// UDPSocketConfig configures a UDPSocket.
+type UDPSocketConfig struct {
+	// RxQueueSize is the amount of received datagrams buffered until read.
+	// Datagrams received while the queue is full are dropped. Defaults to 4.
+	RxQueueSize int
+	// TxQueueSize is the amount of datagrams buffered until sent. Defaults to 4.
+	TxQueueSize int
+	// MaxDatagramSize is the maximum payload size of a datagram.
+	// Defaults to the largest payload that fits in the PortStack's MTU.
+	MaxDatagramSize int
+}
+
+// UDPSocket sends and receives UDP datagrams on a local port of a PortStack.
+// Each datagram is addressed individually with [UDPSocket.WriteToUDPAddrPort] and
+// carries its source address when read with [UDPSocket.ReadFromUDPAddrPort].
+// Received datagrams are queued until read. UDPSocket implements [net.PacketConn].
+//
+// The destination hardware address of outgoing datagrams is the broadcast address for
+// 255.255.255.255, the source of the last datagram received from the destination's
+// IP address or the hardware address of the next hop in the PortStack's ARP cache.
+// The next hop is chosen with the PortStack's routing table, see [PortStack.AddRoute].
+// If the next hop's hardware address is not cached it is resolved with ARP and the datagram
+// is sent once resolution completes. Datagrams are dropped if resolution fails.
+type UDPSocket struct {
+	stack     *PortStack
+	localPort uint16
+	rx        udpQueue
+	tx        udpQueue
+	// lastRemote and lastRemoteMAC are the addresses of the sender of the last datagram received.
+	lastRemote    netip.Addr
+	lastRemoteMAC [6]byte
+	ipID          uint16
+	readDeadline  time.Time
+	writeDeadline time.Time
+	// notify guards the socket state and wakes users blocked on the socket.
+	notify *notifier
+}
+
+// NewUDPSocket creates a UDPSocket and allocates its datagram queues.
+func NewUDPSocket(stack *PortStack, cfg UDPSocketConfig) (*UDPSocket, error) {
+	if cfg.RxQueueSize == 0 {
+		cfg.RxQueueSize = defaultUDPQueueSize
+	}
+	if cfg.TxQueueSize == 0 {
+		cfg.TxQueueSize = defaultUDPQueueSize
+	}
+	if cfg.MaxDatagramSize <= 0 {
+		cfg.MaxDatagramSize = int(stack.MTU()) - sizeUDPNoOptions
+	}
+	if cfg.RxQueueSize < 0 || cfg.TxQueueSize < 0 {
+		return nil, errUDPBadQueueSize
+	} else if cfg.MaxDatagramSize+sizeUDPNoOptions > int(stack.MTU()) {
+		return nil, errPacketExceedsMTU
+	}
+	sock := &UDPSocket{
+		stack:  stack,
+		rx:     newUDPQueue(cfg.RxQueueSize, cfg.MaxDatagramSize),
+		tx:     newUDPQueue(cfg.TxQueueSize, cfg.MaxDatagramSize),
+		notify: new(notifier),
+	}
+	return sock, nil
+}
+
+// PortStack returns the PortStack that this socket is attached to.
+func (sock *UDPSocket) PortStack() *PortStack { return sock.stack }
+
+// Port returns the local port of the socket. Zero if the socket is not open.
+func (sock *UDPSocket) Port() uint16 {
+	sock.notify.lock()
+	defer sock.notify.unlock()
+	return sock.localPort
+}
+
+// OpenUDP opens the local port to send and receive datagrams.
+func (sock *UDPSocket) OpenUDP(localPort uint16) error {
+	sock.notify.lock()
+	defer sock.notify.unlock()
+	if sock.localPort != 0 {
+		return errPortNoneAvail
+	}
+	err := sock.stack.OpenUDP(localPort, sock)
+	if err != nil {
+		return err
+	}
+	sock.rx.reset()
+	sock.tx.reset()
+	sock.lastRemote = netip.Addr{}
+	sock.localPort = localPort
+	return nil
+}
+
+// ReadFromUDPAddrPort reads a datagram into b and returns its size and source address.
+// If b is smaller than the datagram the excess bytes are discarded. ReadFromUDPAddrPort
+// blocks until a datagram is received or the read deadline is exceeded.
+func (sock *UDPSocket) ReadFromUDPAddrPort(b []byte) (int, netip.AddrPort, error) {
+	sock.notify.lock()
+	defer sock.notify.unlock()
+	sock.notify.wait(&sock.readDeadline, func() bool {
+		return sock.rx.len() > 0 || sock.localPort == 0
+	})
+	switch {
+	case sock.rx.len() == 0 && sock.localPort == 0:
+		return 0, netip.AddrPort{}, net.ErrClosed
+	case sock.rx.len() == 0:
+		return 0, netip.AddrPort{}, os.ErrDeadlineExceeded
+	}
+	dg := sock.rx.front()
+	n := copy(b, dg.payload)
+	addr := dg.addr
+	sock.rx.pop()
+	return n, addr, nil
+}
+
+// WriteToUDPAddrPort queues b to be sent as a single datagram to addr. It blocks until
+// there is space in the output queue or the write deadline is exceeded. If the hardware
+// address of the next hop towards addr is not cached its resolution is started and the
+// datagram is sent once resolved.
+func (sock *UDPSocket) WriteToUDPAddrPort(b []byte, addr netip.AddrPort) (int, error) {
+	sock.notify.lock()
+	defer sock.notify.unlock()
+	switch {
+	case sock.localPort == 0:
+		return 0, net.ErrClosed
+	case !addr.Addr().Is4() || addr.Port() == 0:
+		return 0, errUDPAddr
+	case len(b) > sock.tx.maxPayload():
+		return 0, errPacketExceedsMTU
+	}
+	mac, ok := sock.hardwareAddr(addr.Addr())
+	if !ok {
+		nextHop := sock.stack.nextHop(addr.Addr())
+		if !nextHop.IsValid() {
+			return 0, ErrHostUnreachable // No route to addr.
+		}
+		// Datagram is queued with a zero hardware address which is set by send once resolved.
+		err := sock.stack.arpClient.BeginResolve(nextHop)
+		if err != nil {
+			return 0, err
+		}
+	}
+	ok = sock.notify.wait(&sock.writeDeadline, func() bool {
+		return !sock.tx.full() || sock.localPort == 0
+	})
+	if sock.localPort == 0 {
+		return 0, net.ErrClosed
+	} else if !ok {
+		return 0, os.ErrDeadlineExceeded
+	}
+	sock.tx.push(addr, mac, b)
+	sock.stack.flagPendingUDP()
+	return len(b), nil
+}
+
+// ReadFrom implements [net.PacketConn]. The returned address is a [*net.UDPAddr].
+func (sock *UDPSocket) ReadFrom(b []byte) (int, net.Addr, error) {
+	n, addr, err := sock.ReadFromUDPAddrPort(b)
+	if err != nil {
+		return n, nil, err
+	}
+	return n, net.UDPAddrFromAddrPort(addr), nil
+}
+
+// WriteTo implements [net.PacketConn]. addr must be a [*net.UDPAddr].
+func (sock *UDPSocket) WriteTo(b []byte, addr net.Addr) (int, error) {
+	uaddr, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return 0, errUDPNotUDPAddr
+	}
+	return sock.WriteToUDPAddrPort(b, uaddr.AddrPort())
+}
+
+// Close closes the local port. Queued datagrams are discarded.
+func (sock *UDPSocket) Close() error {
+	sock.notify.lock()
+	defer sock.notify.unlock()
+	if sock.localPort == 0 {
+		return net.ErrClosed
+	}
+	err := sock.stack.CloseUDP(sock.localPort)
+	sock.reset()
+	return err
+}
+
+// LocalAddr returns the local address of the socket as a [*net.UDPAddr].
+func (sock *UDPSocket) LocalAddr() net.Addr {
+	return net.UDPAddrFromAddrPort(netip.AddrPortFrom(sock.stack.Addr(), sock.Port()))
+}
+
+// SetDeadline sets the read and write deadlines. A zero value disables the deadlines.
+// Blocked read and write calls are woken up and observe the new deadlines.
+func (sock *UDPSocket) SetDeadline(t time.Time) error {
+	sock.setDeadlines(&t, &t)
+	return nil
+}
+
+// SetReadDeadline sets the deadline for read calls. A zero value disables the deadline.
+// A blocked read call is woken up and observes the new deadline.
+func (sock *UDPSocket) SetReadDeadline(t time.Time) error {
+	sock.setDeadlines(&t, nil)
+	return nil
+}
+
+// SetWriteDeadline sets the deadline for write calls. A zero value disables the deadline.
+// A blocked write call is woken up and observes the new deadline.
+func (sock *UDPSocket) SetWriteDeadline(t time.Time) error {
+	sock.setDeadlines(nil, &t)
+	return nil
+}
+
+// setDeadlines sets the non-nil deadlines and wakes waiters so that they re-evaluate their deadline.
+func (sock *UDPSocket) setDeadlines(read, write *time.Time) {
+	sock.notify.lock()
+	defer sock.notify.unlock()
+	if read != nil {
+		sock.readDeadline = *read
+	}
+	if write != nil {
+		sock.writeDeadline = *write
+	}
+	sock.notify.broadcast()
+}
+
+func (sock *UDPSocket) recv(pkt *UDPPacket) error {
+	sock.notify.lock()
+	defer sock.notify.unlock()
+	if sock.localPort == 0 {
+		return io.EOF
+	}
+	payload := pkt.Payload()
+	if payload == nil {
+		return errBadUDPLength
+	}
+	remote := netip.AddrPortFrom(netip.AddrFrom4(pkt.IP.Source), pkt.UDP.SourcePort)
+	sock.lastRemote = remote.Addr()
+	sock.lastRemoteMAC = pkt.Eth.Source
+	if sock.rx.full() || len(payload) > sock.rx.maxPayload() {
+		sock.stack.debug("UDP:rx-drop", slog.Uint64("port", uint64(sock.localPort)), slog.Int("plen", len(payload)))
+		return nil
+	}
+	sock.rx.push(remote, pkt.Eth.Source, payload)
+	sock.notify.broadcast()
+	return nil
+}
+
+func (sock *UDPSocket) send(dst []byte) (n int, err error) {
+	sock.notify.lock()
+	defer sock.notify.unlock()
+	if sock.localPort == 0 {
+		return 0, io.EOF
+	} else if sock.tx.len() == 0 {
+		return 0, nil
+	}
+	const ipLenInWords = 5
+	dg := sock.tx.front()
+	if dg.mac == ([6]byte{}) && !sock.resolveNextHop(dg) {
+		return 0, nil
+	}
+	if len(dst) < sizeUDPNoOptions+len(dg.payload) {
+		return 0, io.ErrShortBuffer
+	}
+	sock.ipID = prand16(sock.ipID + 1)
+	pkt := UDPPacket{
+		Eth: eth.EthernetHeader{
+			Destination:     dg.mac,
+			Source:          sock.stack.MACAs6(),
+			SizeOrEtherType: uint16(eth.EtherTypeIPv4),
+		},
+		IP: eth.IPv4Header{
+			VersionAndIHL: ipLenInWords,
+			TotalLength:   4*ipLenInWords + eth.SizeUDPHeader + uint16(len(dg.payload)),
+			ID:            sock.ipID,
+			TTL:           64,
+			Protocol:      17,
+			Source:        sock.stack.ip,
+			Destination:   dg.addr.Addr().As4(),
+		},
+		UDP: eth.UDPHeader{
+			SourcePort:      sock.localPort,
+			DestinationPort: dg.addr.Port(),
+			Length:          eth.SizeUDPHeader + uint16(len(dg.payload)),
+		},
+	}
+	pkt.IP.Checksum = pkt.IP.CalculateChecksum()
+	pkt.UDP.Checksum = pkt.UDP.CalculateChecksumIPv4(&pkt.IP, dg.payload)
+	pkt.PutHeaders(dst)
+	n = sizeUDPNoOptions + copy(dst[sizeUDPNoOptions:], dg.payload)
+	sock.tx.pop()
+	sock.notify.broadcast()
+	if sock.tx.len() > 0 {
+		return n, ErrFlagPending // More datagrams to send.
+	}
+	return n, nil
+}
+
+// resolveNextHop sets the hardware address of dg once the next hop's address is resolved.
+// It returns true if dg can be sent. If resolution failed dg is dropped.
+func (sock *UDPSocket) resolveNextHop(dg *udpDatagram) bool {
+	nextHop := sock.stack.nextHop(dg.addr.Addr())
+	mac, ok := sock.stack.arpClient.Lookup(nextHop)
+	if ok {
+		dg.mac = mac
+	} else if !sock.stack.arpClient.isResolving(nextHop) {
+		sock.stack.debug("UDP:host-unreachable", slog.Uint64("port", uint64(sock.localPort)), slog.String("nexthop", nextHop.String()))
+		sock.tx.pop()
+		sock.notify.broadcast()
+	}
+	return ok
+}
+
+func (sock *UDPSocket) isPendingHandling() bool {
+	sock.notify.lock()
+	defer sock.notify.unlock()
+	return sock.localPort != 0 && sock.tx.len() > 0
+}
+
+func (sock *UDPSocket) abort() {
+	sock.notify.lock()
+	defer sock.notify.unlock()
+	sock.reset()
+}
+
+// reset closes the socket, discards queued datagrams and wakes blocked users.
+func (sock *UDPSocket) reset() {
+	sock.localPort = 0
+	sock.rx.reset()
+	sock.tx.reset()
+	sock.notify.broadcast()
+}
+
+// hardwareAddr returns the destination hardware address of datagrams sent to addr.
+func (sock *UDPSocket) hardwareAddr(addr netip.Addr) (mac [6]byte, ok bool) {
+	if addr == netip.AddrFrom4([4]byte{255, 255, 255, 255}) {
+		return eth.BroadcastHW6(), true
+	} else if addr == sock.lastRemote {
+		return sock.lastRemoteMAC, true
+	}
+	return sock.stack.arpClient.Lookup(sock.stack.nextHop(addr))
+}
+
+// udpDatagram is an entry of a udpQueue.
+type udpDatagram struct {
+	addr netip.AddrPort
+	// mac is zero for outgoing datagrams whose next hop is being resolved.
+	mac     [6]byte
+	payload []byte
+}
+
+// udpQueue is a fixed capacity FIFO queue of datagrams with preallocated payload buffers.
+type udpQueue struct {
+	dgrams []udpDatagram
+	bufs   []byte
+	off    int
+	n      int
+}
+
+func newUDPQueue(size, maxPayload int) udpQueue {
+	q := udpQueue{
+		dgrams: make([]udpDatagram, size),
+		bufs:   make([]byte, size*maxPayload),
+	}
+	for i := range q.dgrams {
+		q.dgrams[i].payload = q.bufs[i*maxPayload : i*maxPayload : (i+1)*maxPayload]
+	}
+	return q
+}
+
+func (q *udpQueue) len() int { return q.n }
+
+func (q *udpQueue) full() bool { return q.n == len(q.dgrams) }
+
+func (q *udpQueue) maxPayload() int { return len(q.bufs) / len(q.dgrams) }
+
+// front returns the oldest datagram in the queue. The queue must not be empty.
+func (q *udpQueue) front() *udpDatagram { return &q.dgrams[q.off] }
+
+// push copies a datagram to the end of the queue. The queue must not be full.
+func (q *udpQueue) push(addr netip.AddrPort, mac [6]byte, payload []byte) {
+	dg := &q.dgrams[(q.off+q.n)%len(q.dgrams)]
+	dg.addr = addr
+	dg.mac = mac
+	dg.payload = append(dg.payload[:0], payload...)
+	q.n++
+}
+
+func (q *udpQueue) pop() {
+	q.off = (q.off + 1) % len(q.dgrams)
+	q.n--
+}
+
+func (q *udpQueue) reset() {
+	q.off = 0
+	q.n = 0
+}
@@ -1,10 +1,15 @@
 package stacks_test
 
 import (
+	"bytes"
+	"context"
 	"encoding/hex"
 	"errors"
+	"io"
 	"log/slog"
 	"math"
+	"net"
+	"net/http"
 	"net/netip"
 	"os"
 	"strconv"
@@ -130,6 +135,105 @@ func TestARP(t *testing.T) {
 	}
 }
 
+func TestARPCache(t *testing.T) {
+	Stacks := createPortStacks(t, 3)
+	sender := Stacks[0]
+	egr := NewExchanger(Stacks...)
+	// Multiple resolutions in progress at the same time.
+	for _, target := range Stacks[1:] {
+		err := sender.ARP().BeginResolve(target.Addr())
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	egr.DoExchanges(t, 4)
+	for i, target := range Stacks[1:] {
+		mac, ok := sender.ARP().Lookup(target.Addr())
+		if !ok || mac != target.MACAs6() {
+			t.Errorf("target%d: got %v, %v want %v", i, mac, ok, target.MACAs6())
+		}
+		// Targets learn the sender's address from its request.
+		mac, ok = target.ARP().Lookup(sender.Addr())
+		if !ok || mac != sender.MACAs6() {
+			t.Errorf("target%d did not learn sender address: got %v, %v", i, mac, ok)
+		}
+	}
+	// Resolving a cached address sends no request.
+	sender.ARP().BeginResolve(Stacks[1].Addr())
+	if _, n := egr.DoExchanges(t, 1); n != 0 {
+		t.Errorf("expected no request for cached address, sent %d bytes", n)
+	}
+	// Dial looks up the remote's hardware address in the cache.
+	client, err := stacks.NewTCPSocket(sender, stacks.TCPSocketConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = client.OpenDialTCP(1025, [6]byte{}, netip.AddrPortFrom(netip.AddrFrom4([4]byte{192, 168, 1, 99}), 80), 100)
+	if err == nil {
+		t.Fatal("expected error dialing unresolved address")
+	}
+	server, err := stacks.NewTCPSocket(Stacks[2], stacks.TCPSocketConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = server.OpenListenTCP(80, 300)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = client.OpenDialTCP(1025, [6]byte{}, netip.AddrPortFrom(Stacks[2].Addr(), 80), 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	egr.DoExchanges(t, exchangesToEstablish)
+	if client.State() != seqs.StateEstablished || server.State() != seqs.StateEstablished {
+		t.Fatalf("not established: client=%s server=%s", client.State(), server.State())
+	}
+}
+
+func TestARPResolveProbeAnnounce(t *testing.T) {
+	Stacks := createPortStacks(t, 2)
+	client, owner := Stacks[0], Stacks[1]
+	egr := NewExchanger(Stacks...)
+
+	// Resolution of an address with no reply blocks until the context is done.
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Millisecond)
+	defer cancel()
+	_, err := client.ARP().Resolve(ctx, netip.AddrFrom4([4]byte{192, 168, 1, 99}))
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected context deadline exceeded, got %v", err)
+	}
+
+	// Probing an address in use detects the conflict.
+	done := make(chan error)
+	go func() { done <- client.ARP().Probe(context.Background(), owner.Addr()) }()
+	var probeErr error
+	for deadline := time.Now().Add(3 * time.Second); time.Now().Before(deadline); {
+		egr.DoExchanges(t, 1)
+		select {
+		case probeErr = <-done:
+			deadline = time.Time{}
+		case <-time.After(time.Millisecond):
+		}
+	}
+	if !errors.Is(probeErr, stacks.ErrAddrConflict) {
+		t.Fatalf("expected address conflict, got %v", probeErr)
+	}
+	// Announcement is a broadcast request with our address as sender and target.
+	err = owner.ARP().Announce()
+	if err != nil {
+		t.Fatal(err)
+	}
+	egr.HandleTx(t)
+	pkt := egr.getPayload(1)
+	if len(pkt) != eth.SizeEthernetHeader+eth.SizeARPv4Header {
+		t.Fatalf("expected announcement, got %d bytes", len(pkt))
+	}
+	ahdr := eth.DecodeARPv4Header(pkt[eth.SizeEthernetHeader:])
+	if ahdr.Operation != 1 || ahdr.ProtoSender != owner.Addr().As4() || ahdr.ProtoTarget != owner.Addr().As4() {
+		t.Errorf("bad announcement: %+v", ahdr)
+	}
+}
+
 func TestTCPEstablish(t *testing.T) {
 	client, server := createTCPClientServerPair(t)
 	// 3 way handshake needs 3 exchanges to complete.
@@ -291,8 +395,9 @@ func TestTCPClose_noPendingData(t *testing.T) {
 	doExpect(t, seqs.StateFinWait1, seqs.StateCloseWait, seqs.FlagACK) // do[2] Server sends ACK of client FIN
 	doExpect(t, seqs.StateFinWait2, seqs.StateCloseWait, 0)            // do[3] client receives ACK of FIN, goes into finwait2
 	doExpect(t, seqs.StateFinWait2, seqs.StateLastAck, finack)         // do[4] Server sends out FIN|ACK and enters LastAck state.
-	doExpect(t, seqs.StateTimeWait, seqs.StateClosed, 0)               // do[5] Client receives FIN, prepares to send ACK and enters TimeWait state.
-	doExpect(t, seqs.StateClosed, seqs.StateClosed, seqs.FlagACK)      // do[6] Client sends ACK and enters Closed state.
+	doExpect(t, seqs.StateTimeWait, seqs.StateLastAck, 0)              // do[5] Client receives FIN, prepares to send ACK and enters TimeWait state.
+	doExpect(t, seqs.StateTimeWait, seqs.StateLastAck, seqs.FlagACK)   // do[6] Client sends ACK and remains in TimeWait for 2 MSL.
+	doExpect(t, seqs.StateTimeWait, seqs.StateClosed, 0)               // do[7] Server receives ACK of its FIN and closes.
 }
 
 func TestTCPSocketOpenOfClosedPort(t *testing.T) {
@@ -309,8 +414,8 @@ func TestTCPSocketOpenOfClosedPort(t *testing.T) {
 	}
 	client.Close()
 	egr.DoExchanges(t, exchangesToClose)
-	if client.State() != seqs.StateClosed || server.State() != seqs.StateClosed {
-		t.Fatalf("not established: client=%s server=%s", client.State(), server.State())
+	if client.State() != seqs.StateTimeWait || server.State() != seqs.StateClosed {
+		t.Fatalf("not closed: client=%s server=%s", client.State(), server.State())
 	}
 
 	saddrport := netip.AddrPortFrom(sstack.Addr(), server.Port()+newPortoffset)
@@ -330,210 +435,1971 @@ func TestTCPSocketOpenOfClosedPort(t *testing.T) {
 	testSocketDuplex(t, client, server, egr, 128)
 }
 
-func testSocketDuplex(t *testing.T, client, server *stacks.TCPSocket, egr *Exchanger, messages int) {
-	if client.State() != seqs.StateEstablished || server.State() != seqs.StateEstablished {
-		panic("not established")
+func TestTCPDial(t *testing.T) {
+	Stacks := createPortStacks(t, 2)
+	cstack, sstack := Stacks[0], Stacks[1]
+	server, err := stacks.NewTCPSocket(sstack, stacks.TCPSocketConfig{})
+	if err != nil {
+		t.Fatal(err)
 	}
-	// Send data from client to server multiple times.
-	for i := 0; i < messages; i++ {
-		istr := strconv.Itoa(i)
-		cdata := "hello server " + istr
-		sdata := "hello client " + istr
-
-		socketSendString(client, cdata)
-		socketSendString(server, sdata)
-		tx, bytes := egr.DoExchanges(t, 2)
-		if client.State() != seqs.StateEstablished || server.State() != seqs.StateEstablished {
-			t.Fatalf("not established: client=%s server=%s", client.State(), server.State())
-		}
-		_, _ = tx, bytes
-		// t.Logf("tx=%d bytes=%d", tx, bytes)
-		clientstr := socketReadAllString(client)
-		serverstr := socketReadAllString(server)
-		if clientstr != sdata {
-			t.Errorf("client: got %q want %q", clientstr, sdata)
-		}
-		if serverstr != cdata {
-			t.Errorf("server: got %q want %q", serverstr, cdata)
-		}
+	err = server.OpenListenTCP(80, 300)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := stacks.NewTCPSocket(cstack, stacks.TCPSocketConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = client.DialTCP(1025, netip.AddrPortFrom(sstack.Addr(), 80), 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	egr := NewExchanger(Stacks...)
+	// SYN is held until the server's hardware address is resolved.
+	_, n := egr.DoExchanges(t, 1)
+	if n != eth.SizeEthernetHeader+eth.SizeARPv4Header {
+		t.Fatalf("expected only ARP request to be sent, sent %d bytes", n)
+	}
+	egr.DoExchanges(t, 1+exchangesToEstablish)
+	if client.State() != seqs.StateEstablished || server.State() != seqs.StateEstablished {
+		t.Fatalf("not established: client=%s server=%s", client.State(), server.State())
 	}
+	testSocketDuplex(t, client, server, egr, 2)
 }
 
-func TestPortStackTCPDecoding(t *testing.T) {
-	const dataport = 1234
-	packets := []string{
-		"28cdc1054d3ed85ed34303eb08004500003c76eb400040063f76c0a80192c0a80178ee1604d2a0ceb98a00000000a002faf06e800000020405b40402080a14ccf8250000000001030307",
-		"28cdc101137c88aedd0a709208004500002db03a4000400675590a0000be0a00007ac7ce04d22a67581700000d535018fa4bffff000068656c6c6f",
+func TestPortStackRoutes(t *testing.T) {
+	Stacks := createPortStacks(t, 2)
+	cstack, gateway := Stacks[0], Stacks[1]
+	remote := netip.AddrPortFrom(netip.AddrFrom4([4]byte{10, 0, 0, 5}), 80)
+	client, err := stacks.NewTCPSocket(cstack, stacks.TCPSocketConfig{})
+	if err != nil {
+		t.Fatal(err)
 	}
-	for i, data := range packets {
-		data, _ := hex.DecodeString(data)
-		ehdr := eth.DecodeEthernetHeader(data)
-		ps := stacks.NewPortStack(stacks.PortStackConfig{
-			MaxOpenPortsTCP: 1,
-			MTU:             2048,
-			MAC:             ehdr.Destination,
-		})
-		sock, err := stacks.NewTCPSocket(ps, stacks.TCPSocketConfig{})
-		if err != nil {
-			t.Fatal(i, err)
-		}
-		err = ps.OpenTCP(dataport, sock)
+	// Routing table with only the local network, remote is unreachable.
+	err = cstack.AddRoute(stacks.Route{Prefix: netip.MustParsePrefix("192.168.1.0/24")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = client.DialTCP(1025, remote, 100)
+	if !errors.Is(err, stacks.ErrHostUnreachable) {
+		t.Fatalf("expected host unreachable, got %v", err)
+	}
+	// Default route with higher metric loses against the more specific route.
+	routes := []stacks.Route{
+		{Prefix: netip.MustParsePrefix("0.0.0.0/0"), Gateway: netip.MustParseAddr("192.168.1.254"), Metric: 10},
+		{Prefix: netip.MustParsePrefix("10.0.0.0/8"), Gateway: netip.MustParseAddr("192.168.1.253"), Metric: 10},
+		{Prefix: netip.MustParsePrefix("10.0.0.0/8"), Gateway: gateway.Addr(), Metric: 1},
+	}
+	for _, r := range routes {
+		err = cstack.AddRoute(r)
 		if err != nil {
-			t.Fatal(i, err)
-		}
-		err = ps.RecvEth(data)
-		if err != nil && !errors.Is(err, stacks.ErrDroppedPacket) {
-			t.Fatal(i, err)
+			t.Fatal(err)
 		}
 	}
-}
-
-type Exchanger struct {
-	Stacks   []*stacks.PortStack
-	pipesN   []int
-	pipes    [][2048]byte
-	segments []seqs.Segment
-	ex       int
-	loglevel slog.Level
-}
-
-func NewExchanger(stacks ...*stacks.PortStack) *Exchanger {
-	egr := &Exchanger{
-		Stacks: stacks,
-		pipesN: make([]int, len(stacks)),
-		pipes:  make([][2048]byte, len(stacks)),
-		ex:     -1,
+	if got := cstack.Routes(nil); len(got) != 4 {
+		t.Fatalf("expected 4 routes, got %v", got)
 	}
-	return egr
-}
-
-func (egr *Exchanger) isdebug() bool { return egr.loglevel <= slog.LevelDebug }
-func (egr *Exchanger) isinfo() bool  { return egr.loglevel <= slog.LevelInfo }
-
-// LastSegment returns the last TCP segment sent over the stack.
-func (egr *Exchanger) LastSegment() seqs.Segment {
-	if len(egr.segments) == 0 {
-		return seqs.Segment{}
+	err = client.DialTCP(1025, remote, 100)
+	if err != nil {
+		t.Fatal(err)
 	}
-	return egr.segments[len(egr.segments)-1]
-}
-
-func (egr *Exchanger) getPayload(istack int) []byte {
-	return egr.pipes[istack][:egr.pipesN[istack]]
-}
-
-func (egr *Exchanger) zeroPayload(istack int) {
-	egr.pipesN[istack] = 0
-	egr.pipes[istack] = [2048]byte{}
-}
-
-func (egr *Exchanger) HandleTx(t *testing.T) (pkts, bytesSent int) {
-	egr.ex++
-	t.Helper()
-	var err error
-	for istack := 0; istack < len(egr.Stacks); istack++ {
-		// This first for loop generates packets "in-flight" contained in `pipes` data structure.
-		egr.pipesN[istack], err = egr.Stacks[istack].HandleEth(egr.pipes[istack][:])
-		if (err != nil && !isDroppedPacket(err)) || egr.pipesN[istack] < 0 {
-			t.Errorf("ex[%d] send[%d]: %s", egr.ex, istack, err)
-			return pkts, bytesSent
-		} else if isDroppedPacket(err) && egr.isdebug() {
-			t.Logf("ex[%d] send[%d]: %s", egr.ex, istack, err)
-		}
-		if egr.pipesN[istack] > 0 {
-			pkts++
-			pkt, err := stacks.ParseTCPPacket(egr.getPayload(istack))
-			if err == nil {
-				seg := pkt.TCP.Segment(len(pkt.Payload()))
-				egr.segments = append(egr.segments, seg)
-				if egr.isdebug() {
-					t.Logf("ex[%d] send[%d]: %+v", egr.ex, istack, seg)
-				}
-			}
-		}
-		bytesSent += egr.pipesN[istack]
+	egr := NewExchanger(Stacks...)
+	egr.DoExchanges(t, 2) // ARP request and reply for the gateway.
+	egr.HandleTx(t)
+	pkt, err := stacks.ParseTCPPacket(egr.getPayload(0))
+	if err != nil {
+		t.Fatal(err)
 	}
-	return pkts, bytesSent
-}
-
-func (egr *Exchanger) HandleRx(t *testing.T) {
-	var err error
-	for isend := 0; isend < len(egr.Stacks); isend++ {
-		// We deliver each in-flight packet to all stacks, except the one that sent it.
-		payload := egr.getPayload(isend)
-		if len(payload) == 0 {
-			continue
-		}
-		for irecv := 0; irecv < len(egr.Stacks); irecv++ {
-			if irecv == isend {
-				continue // Don't deliver to self.
-			}
-			err = egr.Stacks[irecv].RecvEth(payload)
-			if err != nil && !isDroppedPacket(err) {
-				t.Errorf("ex[%d] recv[%d]: %s", egr.ex, irecv, err)
-			} else if isDroppedPacket(err) && egr.isdebug() {
-				t.Logf("ex[%d] recv[%d]: %s", egr.ex, irecv, err)
-			}
-		}
-		egr.zeroPayload(isend)
+	if pkt.Eth.Destination != gateway.MACAs6() || pkt.IP.Destination != remote.Addr().As4() || !pkt.TCP.Flags().HasAny(seqs.FlagSYN) {
+		t.Errorf("SYN not sent through gateway: eth.dst=%v ip.dst=%v flags=%s", pkt.Eth.Destination, pkt.IP.Destination, pkt.TCP.Flags())
+	}
+	err = cstack.RemoveRoute(netip.MustParsePrefix("10.0.0.0/8"), gateway.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := cstack.Routes(nil); len(got) != 3 {
+		t.Errorf("expected 3 routes after removal, got %v", got)
 	}
 }
 
-// DoExchanges exchanges packets between stacks until no more data is being sent or maxExchanges is reached.
-// By convention client (initiator) is the first stack and server (listener) is the second when dealing with pairs.
-func (egr *Exchanger) DoExchanges(t *testing.T, maxExchanges int) (exDone, bytesSent int) {
-	t.Helper()
-	for ; exDone < maxExchanges; exDone++ {
-		pkts, bytes := egr.HandleTx(t)
-		bytesSent += bytes
-		if pkts == 0 {
-			break // No more data being sent.
-		}
-		egr.HandleRx(t)
+func TestICMPPing(t *testing.T) {
+	Stacks := createPortStacks(t, 2)
+	pinger, target := Stacks[0], Stacks[1]
+	icmp := pinger.ICMP()
+	payload := []byte("ping payload")
+	err := icmp.BeginPing(target.Addr(), payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = icmp.PingResult(); err == nil {
+		t.Fatal("expected pending ping result")
+	}
+	egr := NewExchanger(Stacks...)
+	// Echo request is held until the target's hardware address is resolved.
+	_, n := egr.DoExchanges(t, 1)
+	if n != eth.SizeEthernetHeader+eth.SizeARPv4Header {
+		t.Fatalf("expected only ARP request to be sent, sent %d bytes", n)
+	}
+	egr.DoExchanges(t, 1)  // ARP reply.
+	egr.DoExchanges(t, 1)  // Echo request.
+	_, n = egr.HandleTx(t) // Echo reply.
+	wantLen := eth.SizeEthernetHeader + eth.SizeIPv4Header + eth.SizeICMPv4Header + len(payload)
+	if n != wantLen {
+		t.Fatalf("expected echo reply of %d bytes, sent %d bytes", wantLen, n)
+	}
+	reply := egr.getPayload(1)
+	ihdr, _ := eth.DecodeIPv4Header(reply[eth.SizeEthernetHeader:])
+	hdr := eth.DecodeICMPv4Header(reply[eth.SizeEthernetHeader+eth.SizeIPv4Header:])
+	data := reply[eth.SizeEthernetHeader+eth.SizeIPv4Header+eth.SizeICMPv4Header:]
+	if ihdr.Protocol != 1 || ihdr.Source != target.Addr().As4() || ihdr.Destination != pinger.Addr().As4() {
+		t.Errorf("bad echo reply IP header %+v", ihdr)
+	}
+	if hdr.Type != eth.ICMPv4EchoReply || hdr.CalculateChecksum(data) != hdr.Checksum || !bytes.Equal(data, payload) {
+		t.Errorf("bad echo reply %+v with data %q", hdr, data)
+	}
+	egr.HandleRx(t)
+	rtt, err := icmp.PingResult()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rtt < 0 {
+		t.Errorf("negative round trip time %s", rtt)
+	}
+	if target.IsPendingHandling() || pinger.IsPendingHandling() {
+		t.Error("stacks should not be pending handling after ping")
 	}
-	return exDone, bytesSent
-}
 
-func isDroppedPacket(err error) bool {
-	return err != nil && (errors.Is(err, stacks.ErrDroppedPacket) || strings.HasPrefix(err.Error(), "drop"))
+	// Host does not respond to ARP, blocking ping times out.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = icmp.Ping(ctx, netip.AddrFrom4([4]byte{192, 168, 1, 99}), payload)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected deadline exceeded, got %v", err)
+	}
 }
 
-func createTCPClientServerPair(t *testing.T) (client, server *stacks.TCPSocket) {
-	t.Helper()
+func TestTCPListener(t *testing.T) {
 	const (
+		listenPort = 80
 		clientPort = 1025
-		clientISS  = 100
-		clientWND  = 1000
-
-		serverPort = 80
-		serverISS  = 300
-		serverWND  = 1300
+		rto        = 5 * time.Millisecond
 	)
-	Stacks := createPortStacks(t, 2)
-	clientStack := Stacks[0]
-	serverStack := Stacks[1]
-
-	// Configure server
-	serverIP := netip.AddrPortFrom(serverStack.Addr(), serverPort)
-
-	serverTCP, err := stacks.NewTCPSocket(serverStack, stacks.TCPSocketConfig{
-		TxBufSize: 2048,
-		RxBufSize: 2048,
+	Stacks := createPortStacks(t, 3)
+	sstack := stacks.NewPortStack(stacks.PortStackConfig{
+		MAC:             Stacks[0].MACAs6(),
+		MaxOpenPortsTCP: 3, // Listening port and a port for each connection.
+		MTU:             2048,
+	})
+	sstack.SetAddr(Stacks[0].Addr())
+	Stacks[0] = sstack
+	listener, err := stacks.NewTCPListener(sstack, stacks.TCPListenerConfig{
+		MaxConnections: 2,
+		Backlog:        1,
 	})
 	if err != nil {
 		t.Fatal(err)
 	}
-	err = serverTCP.OpenListenTCP(serverIP.Port(), serverISS)
-	// serverTCP, err := stacks.ListenTCP(serverStack, serverIP.Port(), serverISS, serverWND)
+	err = listener.Listen(listenPort, 300)
 	if err != nil {
 		t.Fatal(err)
 	}
+	var clients []*stacks.TCPSocket
+	for i, cstack := range Stacks[1:] {
+		client, err := stacks.NewTCPSocket(cstack, stacks.TCPSocketConfig{InitialRTO: rto, MinRTO: rto})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = client.OpenDialTCP(clientPort, sstack.MACAs6(), netip.AddrPortFrom(sstack.Addr(), listenPort), seqs.Value(100*i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		clients = append(clients, client)
+	}
+	egr := NewExchanger(Stacks...)
+	egr.DoExchanges(t, exchangesToEstablish)
+	// Backlog admits a single connection, the other SYN is dropped.
+	if clients[0].State() != seqs.StateEstablished || clients[1].State() != seqs.StateSynSent {
+		t.Fatalf("backlog: got client states %s, %s", clients[0].State(), clients[1].State())
+	}
+	conn0, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Accepting frees the backlog and the retransmitted SYN is admitted.
+	time.Sleep(2 * rto)
+	egr.DoExchanges(t, exchangesToEstablish)
+	if clients[1].State() != seqs.StateEstablished {
+		t.Fatalf("second client not established: %s", clients[1].State())
+	}
+	conn1, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conn0 == conn1 || conn0.Port() != listenPort || conn1.Port() != listenPort {
+		t.Fatal("accepted sockets must be distinct and on the listening port")
+	}
+	// Data is demultiplexed to each connection by remote address.
+	for i, conn := range []*stacks.TCPSocket{conn0, conn1} {
+		istr := strconv.Itoa(i)
+		socketSendString(clients[i], "hello server "+istr)
+		socketSendString(conn, "hello client "+istr)
+	}
+	egr.DoExchanges(t, 4)
+	for i, conn := range []*stacks.TCPSocket{conn0, conn1} {
+		istr := strconv.Itoa(i)
+		if got := socketReadAllString(conn); got != "hello server "+istr {
+			t.Errorf("conn%d: got %q", i, got)
+		}
+		if got := socketReadAllString(clients[i]); got != "hello client "+istr {
+			t.Errorf("client%d: got %q", i, got)
+		}
+	}
+
+	// Closed connections return their socket to the pool.
+	clients[0].Close()
+	egr.DoExchanges(t, 2)
+	if conn0.State() != seqs.StateCloseWait {
+		t.Fatalf("remote close: got conn state %s", conn0.State())
+	}
+	err = conn0.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	egr.DoExchanges(t, exchangesToClose)
+	if conn0.State() != seqs.StateClosed || clients[0].State() != seqs.StateTimeWait {
+		t.Fatalf("not closed: conn=%s client=%s", conn0.State(), clients[0].State())
+	}
+	err = clients[0].OpenDialTCP(clientPort+1, sstack.MACAs6(), netip.AddrPortFrom(sstack.Addr(), listenPort), 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	egr.DoExchanges(t, exchangesToEstablish)
+	if clients[0].State() != seqs.StateEstablished {
+		t.Fatalf("reconnect not established: %s", clients[0].State())
+	}
+	conn2, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conn2 != conn0 {
+		t.Error("expected socket to be reused from pool")
+	}
+
+	// Closing the listener does not affect accepted connections.
+	listener.Close()
+	socketSendString(clients[1], "still here")
+	egr.DoExchanges(t, 2)
+	if got := socketReadAllString(conn1); got != "still here" {
+		t.Errorf("after listener close: got %q", got)
+	}
+	_, err = listener.Accept()
+	if !errors.Is(err, net.ErrClosed) {
+		t.Errorf("got accept error %v, want %v", err, net.ErrClosed)
+	}
+}
+
+func TestTCPSharedLocalPort(t *testing.T) {
+	const (
+		localPort  = 1025
+		serverPort = 80
+	)
+	Stacks := createPortStacks(t, 3)
+	cstack := stacks.NewPortStack(stacks.PortStackConfig{
+		MAC:             Stacks[0].MACAs6(),
+		MaxOpenPortsTCP: 2,
+		MTU:             2048,
+	})
+	cstack.SetAddr(Stacks[0].Addr())
+	Stacks[0] = cstack
+	// Two connections from the same local port to different servers.
+	var clients, servers []*stacks.TCPSocket
+	for i, sstack := range Stacks[1:] {
+		server, err := stacks.NewTCPSocket(sstack, stacks.TCPSocketConfig{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = server.OpenListenTCP(serverPort, 300)
+		if err != nil {
+			t.Fatal(err)
+		}
+		client, err := stacks.NewTCPSocket(cstack, stacks.TCPSocketConfig{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = client.OpenDialTCP(localPort, sstack.MACAs6(), netip.AddrPortFrom(sstack.Addr(), serverPort), seqs.Value(100*i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		clients = append(clients, client)
+		servers = append(servers, server)
+	}
+	// Same 4-tuple can't be opened twice.
+	dup, _ := stacks.NewTCPSocket(cstack, stacks.TCPSocketConfig{})
+	err := dup.OpenDialTCP(localPort, Stacks[1].MACAs6(), netip.AddrPortFrom(Stacks[1].Addr(), serverPort), 1000)
+	if err == nil {
+		t.Error("expected error opening duplicate connection")
+	}
+
+	egr := NewExchanger(Stacks...)
+	egr.DoExchanges(t, 2*exchangesToEstablish) // Client stack sends a single packet per exchange.
+	for i := range clients {
+		if clients[i].State() != seqs.StateEstablished || servers[i].State() != seqs.StateEstablished {
+			t.Fatalf("conn%d not established: client=%s server=%s", i, clients[i].State(), servers[i].State())
+		}
+		socketSendString(clients[i], "hello server "+strconv.Itoa(i))
+	}
+	egr.DoExchanges(t, 4)
+	for i := range servers {
+		if got := socketReadAllString(servers[i]); got != "hello server "+strconv.Itoa(i) {
+			t.Errorf("server%d: got %q", i, got)
+		}
+	}
+}
+
+func TestTCPRemoteAddrMismatch(t *testing.T) {
+	client, server := createTCPClientServerPair(t)
+	cstack, sstack := client.PortStack(), server.PortStack()
+	egr := NewExchanger(cstack, sstack)
+	egr.DoExchanges(t, exchangesToEstablish)
+	if server.State() != seqs.StateEstablished {
+		t.Fatalf("not established: %s", server.State())
+	}
+	const data = "hello"
+	socketSendString(client, data)
+	var buf [2048]byte
+	n, err := cstack.HandleEth(buf[:])
+	if err != nil || n == 0 {
+		t.Fatal("data not sent", err)
+	}
+	original := append([]byte{}, buf[:n]...)
+	// Same segment and ports sent from a different host must not reach the connection.
+	pkt, err := stacks.ParseTCPPacket(original)
+	if err != nil {
+		t.Fatal(err)
+	}
+	forged := append([]byte{}, original...)
+	pkt.IP.Source = [4]byte{192, 168, 1, 99}
+	pkt.IP.Checksum = pkt.IP.CalculateChecksum()
+	pkt.TCP.Checksum = pkt.TCP.CalculateChecksumIPv4(&pkt.IP, pkt.TCPOptions(), pkt.Payload())
+	pkt.IP.Put(forged[eth.SizeEthernetHeader:])
+	pkt.TCP.Put(forged[eth.SizeEthernetHeader+eth.SizeIPv4Header:])
+	err = sstack.RecvEth(forged)
+	if err != nil && !isDroppedPacket(err) {
+		t.Fatal(err)
+	}
+	if server.BufferedInput() != 0 {
+		t.Fatalf("segment from different host received: %q", socketReadAllString(server))
+	}
+	err = sstack.RecvEth(original)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := socketReadAllString(server); got != data {
+		t.Errorf("got %q, want %q", got, data)
+	}
+}
+
+func TestTCPConn(t *testing.T) {
+	const bufSize = 64
+	csock, ssock := createTCPClientServerPairWithConfig(t, stacks.TCPSocketConfig{TxBufSize: bufSize, RxBufSize: bufSize})
+	client, server := stacks.NewTCPConn(csock), stacks.NewTCPConn(ssock)
+	egr := NewExchanger(csock.PortStack(), ssock.PortStack())
+	egr.DoExchanges(t, exchangesToEstablish)
+	if csock.State() != seqs.StateEstablished || ssock.State() != seqs.StateEstablished {
+		t.Fatal("not established")
+	}
+	if client.LocalAddr().String() != server.RemoteAddr().String() || client.RemoteAddr().String() != server.LocalAddr().String() {
+		t.Errorf("address mismatch: client %s->%s, server %s->%s", client.LocalAddr(), client.RemoteAddr(), server.LocalAddr(), server.RemoteAddr())
+	}
+
+	// Read with no data times out.
+	var buf [bufSize]byte
+	server.SetReadDeadline(time.Now().Add(time.Millisecond))
+	n, err := server.Read(buf[:])
+	var netErr net.Error
+	if n != 0 || !errors.As(err, &netErr) || !netErr.Timeout() {
+		t.Fatalf("expected timeout error, got n=%d err=%v", n, err)
+	}
+	server.SetReadDeadline(time.Time{})
+
+	// Setting a deadline wakes up a blocked Read.
+	readErr := make(chan error)
+	go func() {
+		var buf [bufSize]byte
+		_, err := server.Read(buf[:])
+		readErr <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	server.SetReadDeadline(time.Now())
+	select {
+	case err := <-readErr:
+		if !errors.Is(err, os.ErrDeadlineExceeded) {
+			t.Fatalf("expected deadline exceeded, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("blocked read not woken up by deadline")
+	}
+	server.SetReadDeadline(time.Time{})
+
+	const data = "hello net.Conn"
+	n, err = client.Write([]byte(data))
+	if err != nil || n != len(data) {
+		t.Fatalf("write: n=%d err=%v", n, err)
+	}
+	egr.DoExchanges(t, 2)
+	n, err = server.Read(buf[:])
+	if err != nil || string(buf[:n]) != data {
+		t.Fatalf("read: got %q err=%v", buf[:n], err)
+	}
+
+	// Write larger than the output buffer blocks until the deadline.
+	client.SetWriteDeadline(time.Now().Add(time.Millisecond))
+	n, err = client.Write(make([]byte, 2*bufSize))
+	if n != bufSize || !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("expected partial write to time out, got n=%d err=%v", n, err)
+	}
+	server.SetReadDeadline(time.Now().Add(time.Second)) // Fail instead of blocking forever.
+	for total := 0; total < bufSize; total += n {
+		egr.DoExchanges(t, 2)
+		n, err = server.Read(buf[:])
+		if err != nil {
+			t.Fatalf("read after %d bytes: %v", total, err)
+		}
+	}
+
+	// Remote close results in EOF.
+	err = client.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	egr.DoExchanges(t, 2)
+	_, err = server.Read(buf[:])
+	if err != io.EOF {
+		t.Fatalf("expected EOF, got %v", err)
+	}
+	if _, err = client.Write([]byte(data)); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("write after close: got %v", err)
+	}
+}
+
+func TestTCPNetListener(t *testing.T) {
+	const listenPort = 80
+	Stacks := createPortStacks(t, 2)
+	sstack := stacks.NewPortStack(stacks.PortStackConfig{
+		MAC:             Stacks[0].MACAs6(),
+		MaxOpenPortsTCP: 2,
+		MTU:             2048,
+	})
+	sstack.SetAddr(Stacks[0].Addr())
+	Stacks[0] = sstack
+	listener, err := stacks.NewTCPListener(sstack, stacks.TCPListenerConfig{MaxConnections: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = listener.Listen(listenPort, 300)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nl := listener.NetListener()
+	if nl.Addr().String() != netip.AddrPortFrom(sstack.Addr(), listenPort).String() {
+		t.Errorf("listener address: got %s", nl.Addr())
+	}
+	client, err := stacks.NewTCPSocket(Stacks[1], stacks.TCPSocketConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = client.OpenDialTCP(1025, sstack.MACAs6(), netip.AddrPortFrom(sstack.Addr(), listenPort), 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	egr := NewExchanger(Stacks...)
+	egr.DoExchanges(t, exchangesToEstablish)
+	conn, err := nl.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conn.RemoteAddr().String() != netip.AddrPortFrom(Stacks[1].Addr(), 1025).String() {
+		t.Errorf("remote address: got %s", conn.RemoteAddr())
+	}
+	const data = "hello client"
+	_, err = conn.Write([]byte(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	egr.DoExchanges(t, 2)
+	if got := socketReadAllString(client); got != data {
+		t.Errorf("client: got %q", got)
+	}
+	err = nl.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = nl.Accept()
+	if !errors.Is(err, net.ErrClosed) {
+		t.Errorf("accept on closed listener: got %v", err)
+	}
+}
+
+func TestTCPConnHTTP(t *testing.T) {
+	const (
+		listenPort = 80
+		body       = "hello from seqs"
+	)
+	Stacks := createPortStacks(t, 2)
+	sstack := stacks.NewPortStack(stacks.PortStackConfig{
+		MAC:             Stacks[0].MACAs6(),
+		MaxOpenPortsTCP: 2,
+		MTU:             2048,
+	})
+	sstack.SetAddr(Stacks[0].Addr())
+	Stacks[0] = sstack
+	listener, err := stacks.NewTCPListener(sstack, stacks.TCPListenerConfig{MaxConnections: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = listener.Listen(listenPort, 300)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nl := listener.NetListener()
+	csock, err := stacks.NewTCPSocket(Stacks[1], stacks.TCPSocketConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverAddr := netip.AddrPortFrom(sstack.Addr(), listenPort)
+	err = csock.OpenDialTCP(1025, sstack.MACAs6(), serverAddr, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := stacks.NewTCPConn(csock)
+
+	// Packets are exchanged in the background while the HTTP client and server block on the connections.
+	egr := NewExchanger(Stacks...)
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			if n, _ := egr.DoExchanges(t, 1); n == 0 {
+				time.Sleep(time.Millisecond)
+			}
+		}
+	}()
+	defer func() {
+		close(stop)
+		<-stopped
+	}()
+
+	go http.Serve(nl, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, body)
+	}))
+	defer nl.Close()
+	client := &http.Client{
+		Timeout: 5 * time.Second,
+		Transport: &http.Transport{
+			DisableKeepAlives: true,
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return conn, nil
+			},
+		},
+	}
+	resp, err := client.Get("http://" + serverAddr.String() + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK || string(got) != body {
+		t.Errorf("got status %d body %q", resp.StatusCode, got)
+	}
+}
+
+func TestTCPSocketBlockingRead(t *testing.T) {
+	client, server := createTCPClientServerPair(t)
+	egr := NewExchanger(client.PortStack(), server.PortStack())
+	egr.DoExchanges(t, exchangesToEstablish)
+	if client.State() != seqs.StateEstablished || server.State() != seqs.StateEstablished {
+		t.Fatal("not established")
+	}
+	type result struct {
+		data string
+		err  error
+	}
+	done := make(chan result)
+	go func() {
+		var buf [64]byte
+		n, err := client.Read(buf[:])
+		done <- result{data: string(buf[:n]), err: err}
+	}()
+	select {
+	case <-done:
+		t.Fatal("read returned before data was received")
+	case <-time.After(10 * time.Millisecond):
+	}
+	// Reader is woken up by the stack once data is received.
+	const data = "hello blocked reader"
+	socketSendString(server, data)
+	egr.DoExchanges(t, 1)
+	select {
+	case got := <-done:
+		if got.err != nil || got.data != data {
+			t.Errorf("got %q, %v", got.data, got.err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("reader not woken up")
+	}
+
+	// Blocked flush returns once all data is acknowledged.
+	socketSendString(client, data)
+	flushed := make(chan error)
+	go func() { flushed <- client.FlushOutputBuffer() }()
+	egr.DoExchanges(t, 2)
+	select {
+	case err := <-flushed:
+		if err != nil {
+			t.Error(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("flush not woken up")
+	}
+
+	// Write larger than the output buffer blocks until the remote acknowledges data.
+	const bigSize = 3000
+	wrote := make(chan error)
+	go func() {
+		n, err := client.Write(make([]byte, bigSize))
+		if err == nil && n != bigSize {
+			err = io.ErrShortWrite
+		}
+		wrote <- err
+	}()
+	var buf [1024]byte
+	received := -len(data) // Flushed data is still in the server's input buffer.
+	for deadline := time.Now().Add(time.Second); received < bigSize && time.Now().Before(deadline); {
+		egr.DoExchanges(t, 1)
+		for server.BufferedInput() > 0 {
+			n, _ := server.Read(buf[:])
+			received += n
+		}
+	}
+	if received != bigSize {
+		t.Fatalf("received %d bytes, want %d", received, bigSize)
+	}
+	select {
+	case err := <-wrote:
+		if err != nil {
+			t.Error(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("writer not woken up")
+	}
+}
+
+func TestUDPSocket(t *testing.T) {
+	const (
+		clientPort = 1025
+		serverPort = 53
+	)
+	Stacks := createPortStacks(t, 2)
+	cstack, sstack := Stacks[0], Stacks[1]
+	client, err := stacks.NewUDPSocket(cstack, stacks.UDPSocketConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := stacks.NewUDPSocket(sstack, stacks.UDPSocketConfig{RxQueueSize: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = client.OpenUDP(clientPort); err != nil {
+		t.Fatal(err)
+	}
+	if err = server.OpenUDP(serverPort); err != nil {
+		t.Fatal(err)
+	}
+	serverAddr := netip.AddrPortFrom(sstack.Addr(), serverPort)
+	egr := NewExchanger(Stacks...)
+
+	// Datagram to an unresolved address is sent once the server's hardware address is resolved.
+	_, err = client.WriteToUDPAddrPort([]byte("hello"), serverAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	egr.DoExchanges(t, 3)
+	var buf [64]byte
+	n, from, err := server.ReadFromUDPAddrPort(buf[:])
+	if err != nil || string(buf[:n]) != "hello" {
+		t.Fatalf("server: got %q, %v", buf[:n], err)
+	}
+	if from != netip.AddrPortFrom(cstack.Addr(), clientPort) {
+		t.Errorf("server: got source %s", from)
+	}
+
+	// Datagrams exceeding the server's receive queue are dropped.
+	for i := 0; i < 3; i++ {
+		_, err = client.WriteToUDPAddrPort([]byte("hello server "+strconv.Itoa(i)), serverAddr)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	egr.DoExchanges(t, 3)
+	for i := 0; i < 2; i++ {
+		n, from, err := server.ReadFromUDPAddrPort(buf[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := string(buf[:n]); got != "hello server "+strconv.Itoa(i) {
+			t.Errorf("server: got %q", got)
+		}
+		if from != netip.AddrPortFrom(cstack.Addr(), clientPort) {
+			t.Errorf("server: got source %s", from)
+		}
+	}
+	server.SetReadDeadline(time.Now().Add(time.Millisecond))
+	_, _, err = server.ReadFromUDPAddrPort(buf[:])
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("expected deadline exceeded, got %v", err)
+	}
+
+	// Setting a deadline wakes up a blocked read.
+	server.SetReadDeadline(time.Time{})
+	readErr := make(chan error)
+	go func() {
+		var buf [64]byte
+		_, _, err := server.ReadFromUDPAddrPort(buf[:])
+		readErr <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	server.SetReadDeadline(time.Now())
+	select {
+	case err := <-readErr:
+		if !errors.Is(err, os.ErrDeadlineExceeded) {
+			t.Fatalf("expected deadline exceeded, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("blocked read not woken up by deadline")
+	}
+	server.SetReadDeadline(time.Time{})
+
+	// Server replies using the hardware address of the received datagrams.
+	var pc net.PacketConn = server
+	_, err = pc.WriteTo([]byte("hello client"), net.UDPAddrFromAddrPort(netip.AddrPortFrom(cstack.Addr(), clientPort)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	egr.DoExchanges(t, 1)
+	n, fromAddr, err := client.ReadFrom(buf[:])
+	if err != nil || string(buf[:n]) != "hello client" {
+		t.Fatalf("client: got %q, %v", buf[:n], err)
+	}
+	if fromAddr.String() != serverAddr.String() {
+		t.Errorf("client: got source %s", fromAddr)
+	}
+
+	err = client.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = client.ReadFrom(buf[:]); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("read on closed socket: got %v", err)
+	}
+	if err = client.OpenUDP(clientPort); err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+}
+
+func testSocketDuplex(t *testing.T, client, server *stacks.TCPSocket, egr *Exchanger, messages int) {
+	if client.State() != seqs.StateEstablished || server.State() != seqs.StateEstablished {
+		panic("not established")
+	}
+	// Send data from client to server multiple times.
+	for i := 0; i < messages; i++ {
+		istr := strconv.Itoa(i)
+		cdata := "hello server " + istr
+		sdata := "hello client " + istr
+
+		socketSendString(client, cdata)
+		socketSendString(server, sdata)
+		tx, bytes := egr.DoExchanges(t, 2)
+		if client.State() != seqs.StateEstablished || server.State() != seqs.StateEstablished {
+			t.Fatalf("not established: client=%s server=%s", client.State(), server.State())
+		}
+		_, _ = tx, bytes
+		// t.Logf("tx=%d bytes=%d", tx, bytes)
+		clientstr := socketReadAllString(client)
+		serverstr := socketReadAllString(server)
+		if clientstr != sdata {
+			t.Errorf("client: got %q want %q", clientstr, sdata)
+		}
+		if serverstr != cdata {
+			t.Errorf("server: got %q want %q", serverstr, cdata)
+		}
+	}
+}
+
+func TestTCPReassembly(t *testing.T) {
+	client, server := createTCPClientServerPairWithConfig(t, stacks.TCPSocketConfig{
+		TxBufSize:  2048,
+		RxBufSize:  2048,
+		Reassembly: true,
+		NoDelay:    true, // Send small segments back to back.
+	})
+	cstack, sstack := client.PortStack(), server.PortStack()
+	egr := NewExchanger(cstack, sstack)
+	egr.DoExchanges(t, exchangesToEstablish)
+	if client.State() != seqs.StateEstablished || server.State() != seqs.StateEstablished {
+		t.Fatalf("not established: client=%s server=%s", client.State(), server.State())
+	}
+
+	// Client sends two segments which arrive at the server in reverse order.
+	const data1, data2 = "hello ", "world"
+	var pkt1, pkt2 [2048]byte
+	socketSendString(client, data1)
+	n1, err := cstack.HandleEth(pkt1[:])
+	if err != nil || n1 == 0 {
+		t.Fatal("client did not send first segment", err)
+	}
+	socketSendString(client, data2)
+	n2, err := cstack.HandleEth(pkt2[:])
+	if err != nil || n2 == 0 {
+		t.Fatal("client did not send second segment", err)
+	}
+
+	err = sstack.RecvEth(pkt2[:n2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if server.BufferedInput() != 0 {
+		t.Fatal("out-of-order data readable before gap is filled")
+	}
+	err = sstack.RecvEth(pkt1[:n1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := socketReadAllString(server)
+	if got != data1+data2 {
+		t.Errorf("server: got %q want %q", got, data1+data2)
+	}
+	// Server ACKs all data.
+	egr.DoExchanges(t, 2)
+	if client.State() != seqs.StateEstablished || server.State() != seqs.StateEstablished {
+		t.Fatalf("not established: client=%s server=%s", client.State(), server.State())
+	}
+
+	// Server reads all in-order data while out-of-order data is held, then the gap is filled.
+	segData := [3]string{"de", "XY", "fg"}
+	var pkts [3][2048]byte
+	var npkts [3]int
+	for i := range segData {
+		socketSendString(client, segData[i])
+		npkts[i], err = cstack.HandleEth(pkts[i][:])
+		if err != nil || npkts[i] == 0 {
+			t.Fatal("client did not send segment", i, err)
+		}
+	}
+	for _, i := range []int{0, 2} {
+		err = sstack.RecvEth(pkts[i][:npkts[i]])
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := socketReadAllString(server); got != segData[0] {
+		t.Errorf("server: got %q want %q", got, segData[0])
+	}
+	err = sstack.RecvEth(pkts[1][:npkts[1]])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := socketReadAllString(server); got != segData[1]+segData[2] {
+		t.Errorf("server: got %q want %q", got, segData[1]+segData[2])
+	}
+	egr.DoExchanges(t, 2)
+	testSocketDuplex(t, client, server, egr, 8)
+}
+
+func TestTCPRetransmit(t *testing.T) {
+	const rto = 10 * time.Millisecond
+	client, server := createTCPClientServerPairWithConfig(t, stacks.TCPSocketConfig{
+		TxBufSize:  2048,
+		RxBufSize:  2048,
+		InitialRTO: rto,
+		MinRTO:     rto,
+	})
+	cstack := client.PortStack()
+	egr := NewExchanger(cstack, server.PortStack())
+	egr.DoExchanges(t, exchangesToEstablish)
+	if client.State() != seqs.StateEstablished || server.State() != seqs.StateEstablished {
+		t.Fatalf("not established: client=%s server=%s", client.State(), server.State())
+	}
+
+	// Client sends data which is lost.
+	const data = "hello world"
+	var lost [2048]byte
+	socketSendString(client, data)
+	n, err := cstack.HandleEth(lost[:])
+	if err != nil || n == 0 {
+		t.Fatal("client did not send segment", err)
+	}
+	_, bytes := egr.DoExchanges(t, 1)
+	if bytes != 0 {
+		t.Fatal("data retransmitted before RTO expired")
+	}
+
+	time.Sleep(2 * rto)
+	egr.DoExchanges(t, 2)
+	got := socketReadAllString(server)
+	if got != data {
+		t.Errorf("server: got %q want %q", got, data)
+	}
+	egr.DoExchanges(t, 1)
+	if seg := egr.LastSegment(); seg.DATALEN != 0 {
+		t.Errorf("unexpected data sent after retransmitted data was acknowledged: %+v", seg)
+	}
+	testSocketDuplex(t, client, server, egr, 8)
+}
+
+func TestTCPRetransmitTimeout(t *testing.T) {
+	const rto = time.Millisecond
+	const maxRetransmits = 3
+	client, server := createTCPClientServerPairWithConfig(t, stacks.TCPSocketConfig{
+		TxBufSize:      2048,
+		RxBufSize:      2048,
+		InitialRTO:     rto,
+		MinRTO:         rto,
+		MaxRetransmits: maxRetransmits,
+	})
+	cstack := client.PortStack()
+	egr := NewExchanger(cstack, server.PortStack())
+	egr.DoExchanges(t, exchangesToEstablish)
+	if client.State() != seqs.StateEstablished || server.State() != seqs.StateEstablished {
+		t.Fatalf("not established: client=%s server=%s", client.State(), server.State())
+	}
+
+	// Remote stops responding, all packets sent by the client are lost.
+	socketSendString(client, "hello world")
+	var buf [2048]byte
+	sent := 0
+	deadline := time.Now().Add(time.Second)
+	for !client.State().IsClosed() && time.Now().Before(deadline) {
+		n, err := cstack.HandleEth(buf[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n > 0 {
+			sent++
+		}
+		time.Sleep(rto)
+	}
+	if !client.State().IsClosed() {
+		t.Fatal("connection not aborted after max retransmissions")
+	}
+	if sent != maxRetransmits+1 {
+		t.Errorf("got %d segments sent, want %d", sent, maxRetransmits+1)
+	}
+	_, err := client.Write([]byte("data"))
+	if !errors.Is(err, stacks.ErrRetransmitTimeout) {
+		t.Errorf("got write error %v, want %v", err, stacks.ErrRetransmitTimeout)
+	}
+}
+
+func TestTCPFastRetransmit(t *testing.T) {
+	client, server := createTCPClientServerPairWithConfig(t, stacks.TCPSocketConfig{
+		TxBufSize:  2048,
+		RxBufSize:  2048,
+		Reassembly: true,
+		NoDelay:    true,      // Send small segments back to back.
+		InitialRTO: time.Hour, // Retransmission must not rely on the timer.
+		MinRTO:     time.Hour,
+	})
+	cstack, sstack := client.PortStack(), server.PortStack()
+	egr := NewExchanger(cstack, sstack)
+	egr.DoExchanges(t, exchangesToEstablish)
+	if client.State() != seqs.StateEstablished || server.State() != seqs.StateEstablished {
+		t.Fatalf("not established: client=%s server=%s", client.State(), server.State())
+	}
+
+	// Client sends 4 segments, the first of which is lost.
+	const data = "0123456789"
+	var buf [2048]byte
+	for i := 0; i < 4; i++ {
+		socketSendString(client, data)
+		n, err := cstack.HandleEth(buf[:])
+		if err != nil || n == 0 {
+			t.Fatal("client did not send segment", i, err)
+		}
+		if i == 0 {
+			continue
+		}
+		err = sstack.RecvEth(buf[:n])
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Server responds to each out-of-order segment with a duplicate ACK.
+		n, err = sstack.HandleEth(buf[:])
+		if err != nil || n == 0 {
+			t.Fatal("server did not send duplicate ACK", i, err)
+		}
+		err = cstack.RecvEth(buf[:n])
+		if err != nil && !isDroppedPacket(err) {
+			t.Fatal(err)
+		}
+	}
+	// Client retransmits the lost segment immediately after the third duplicate ACK.
+	egr.DoExchanges(t, 2)
+	got := socketReadAllString(server)
+	if got != data+data+data+data {
+		t.Errorf("server: got %q want %q", got, data+data+data+data)
+	}
+}
+
+func TestTCPSACK(t *testing.T) {
+	client, server := createTCPClientServerPairWithConfig(t, stacks.TCPSocketConfig{
+		TxBufSize:  2048,
+		RxBufSize:  2048,
+		Reassembly: true,
+		NoDelay:    true,      // Send small segments back to back.
+		InitialRTO: time.Hour, // Retransmission must not rely on the timer.
+		MinRTO:     time.Hour,
+	})
+	cstack, sstack := client.PortStack(), server.PortStack()
+	var buf [2048]byte
+	n, err := cstack.HandleEth(buf[:])
+	if err != nil || n == 0 {
+		t.Fatal("SYN not sent", err)
+	}
+	pkt, err := stacks.ParseTCPPacket(buf[:n])
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts, err := eth.DecodeTCPOptions(pkt.TCPOptions())
+	if err != nil || !opts.SACKPermitted {
+		t.Fatalf("SYN does not offer SACK: %s %v", opts.String(), err)
+	}
+	err = sstack.RecvEth(buf[:n])
+	if err != nil {
+		t.Fatal(err)
+	}
+	egr := NewExchanger(cstack, sstack)
+	egr.DoExchanges(t, exchangesToEstablish)
+	if client.State() != seqs.StateEstablished || server.State() != seqs.StateEstablished {
+		t.Fatalf("not established: client=%s server=%s", client.State(), server.State())
+	}
+
+	// Client sends 5 segments, the first and third of which are lost.
+	const data = "0123456789"
+	var firstSeq seqs.Value
+	for i := 0; i < 5; i++ {
+		socketSendString(client, data)
+		n, err := cstack.HandleEth(buf[:])
+		if err != nil || n == 0 {
+			t.Fatal("client did not send segment", i, err)
+		}
+		if i == 0 {
+			pkt, _ := stacks.ParseTCPPacket(buf[:n])
+			firstSeq = pkt.TCP.Seq
+		}
+		if i == 0 || i == 2 {
+			continue
+		}
+		err = sstack.RecvEth(buf[:n])
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Server responds to each out-of-order segment with a duplicate ACK carrying SACK blocks.
+		n, err = sstack.HandleEth(buf[:])
+		if err != nil || n == 0 {
+			t.Fatal("server did not send duplicate ACK", i, err)
+		}
+		pkt, _ := stacks.ParseTCPPacket(buf[:n])
+		opts, err := eth.DecodeTCPOptions(pkt.TCPOptions())
+		if err != nil || opts.NumSACK == 0 {
+			t.Fatalf("duplicate ACK without SACK blocks: %s %v", opts.String(), err)
+		}
+		err = cstack.RecvEth(buf[:n])
+		if err != nil && !isDroppedPacket(err) {
+			t.Fatal(err)
+		}
+	}
+	// Client retransmits only the two lost segments.
+	for i, wantSeq := range []seqs.Value{firstSeq, firstSeq + 2*seqs.Value(len(data))} {
+		n, err := cstack.HandleEth(buf[:])
+		if err != nil || n == 0 {
+			t.Fatal("client did not retransmit", i, err)
+		}
+		pkt, _ := stacks.ParseTCPPacket(buf[:n])
+		if pkt.TCP.Seq != wantSeq || string(pkt.Payload()) != data {
+			t.Fatalf("retransmit %d: got seq=%d payload=%q, want seq=%d payload=%q", i, pkt.TCP.Seq, pkt.Payload(), wantSeq, data)
+		}
+		err = sstack.RecvEth(buf[:n])
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	egr.DoExchanges(t, 2)
+	got := socketReadAllString(server)
+	if got != strings.Repeat(data, 5) {
+		t.Errorf("server: got %q want %q", got, strings.Repeat(data, 5))
+	}
+}
+
+func TestTCPTimestamps(t *testing.T) {
+	client, server := createTCPClientServerPair(t)
+	cstack, sstack := client.PortStack(), server.PortStack()
+	// Handshake: SYN offers timestamps, SYN-ACK and ACK echo the remote's timestamp.
+	var buf [2048]byte
+	var prevTSVal uint32
+	for i, stack := range []*stacks.PortStack{cstack, sstack, cstack} {
+		n, err := stack.HandleEth(buf[:])
+		if err != nil || n == 0 {
+			t.Fatal("handshake segment not sent", i, err)
+		}
+		pkt, err := stacks.ParseTCPPacket(buf[:n])
+		if err != nil {
+			t.Fatal(err)
+		}
+		opts, err := eth.DecodeTCPOptions(pkt.TCPOptions())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !opts.HasTimestamps || opts.TSVal == 0 || (i > 0 && opts.TSEcr != prevTSVal) {
+			t.Fatalf("handshake segment %d: want timestamps echoing %d, got %s", i, prevTSVal, opts.String())
+		}
+		prevTSVal = opts.TSVal
+		if stack == cstack {
+			err = sstack.RecvEth(buf[:n])
+		} else {
+			err = cstack.RecvEth(buf[:n])
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if client.State() != seqs.StateEstablished || server.State() != seqs.StateEstablished {
+		t.Fatalf("not established: client=%s server=%s", client.State(), server.State())
+	}
+	egr := NewExchanger(cstack, sstack)
+	testSocketDuplex(t, client, server, egr, 8)
+}
+
+func TestTCPKeepalive(t *testing.T) {
+	const idle, interval, count = 20 * time.Millisecond, time.Millisecond, 3
+	client, server := createTCPClientServerPairWithConfig(t, stacks.TCPSocketConfig{
+		TxBufSize:         2048,
+		RxBufSize:         2048,
+		KeepAliveIdle:     idle,
+		KeepAliveInterval: interval,
+		KeepAliveCount:    count,
+	})
+	cstack := client.PortStack()
+	egr := NewExchanger(cstack, server.PortStack())
+	egr.DoExchanges(t, exchangesToEstablish)
+	if client.State() != seqs.StateEstablished || server.State() != seqs.StateEstablished {
+		t.Fatalf("not established: client=%s server=%s", client.State(), server.State())
+	}
+	if cstack.IsPendingHandling() {
+		t.Error("stack pending before keepalive probe is due")
+	}
+
+	// Idle connection is kept alive by probes answered by the remote.
+	for i := 0; i < 3; i++ {
+		time.Sleep(idle)
+		_, bytes := egr.DoExchanges(t, 2)
+		if bytes == 0 {
+			t.Fatal("no keepalive probe sent")
+		}
+	}
+	if client.State() != seqs.StateEstablished || server.State() != seqs.StateEstablished {
+		t.Fatalf("connection not kept alive: client=%s server=%s", client.State(), server.State())
+	}
+	testSocketDuplex(t, client, server, egr, 4)
+	egr.DoExchanges(t, 2) // Flush pending ACKs.
+
+	// Remote stops responding, the client aborts after unanswered probes.
+	var buf [2048]byte
+	probes := 0
+	deadline := time.Now().Add(time.Second)
+	for !client.State().IsClosed() && time.Now().Before(deadline) {
+		n, err := cstack.HandleEth(buf[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n > 0 {
+			probes++
+		}
+		time.Sleep(interval)
+	}
+	if !client.State().IsClosed() {
+		t.Fatal("connection not aborted after unanswered keepalive probes")
+	}
+	if probes != count {
+		t.Errorf("got %d probes sent, want %d", probes, count)
+	}
+	_, err := client.Write([]byte("data"))
+	if !errors.Is(err, stacks.ErrKeepaliveTimeout) {
+		t.Errorf("got write error %v, want %v", err, stacks.ErrKeepaliveTimeout)
+	}
+}
+
+func TestTCPZeroWindow(t *testing.T) {
+	const bufSize = 512
+	client, server := createTCPClientServerPairWithConfig(t, stacks.TCPSocketConfig{
+		TxBufSize:  2048,
+		RxBufSize:  bufSize,
+		InitialRTO: time.Millisecond,
+		MinRTO:     time.Millisecond,
+	})
+	egr := NewExchanger(client.PortStack(), server.PortStack())
+	egr.DoExchanges(t, exchangesToEstablish)
+	if client.State() != seqs.StateEstablished || server.State() != seqs.StateEstablished {
+		t.Fatalf("not established: client=%s server=%s", client.State(), server.State())
+	}
+
+	// Server stops reading, client fills the server's receive buffer.
+	data := strings.Repeat("0123456789abcdef", 3*bufSize/16)
+	socketSendString(client, data)
+	egr.DoExchanges(t, 16)
+	if server.BufferedInput() != bufSize {
+		t.Fatalf("got %d bytes buffered by server, want %d", server.BufferedInput(), bufSize)
+	}
+
+	// Client probes zero window with exponential backoff.
+	probes := 0
+	deadline := time.Now().Add(50 * time.Millisecond)
+	for time.Now().Before(deadline) {
+		egr.HandleTx(t)
+		if len(egr.getPayload(0)) > 0 {
+			seg := egr.LastSegment()
+			if len(egr.getPayload(1)) > 0 {
+				seg = egr.segments[len(egr.segments)-2]
+			}
+			if seg.DATALEN != 0 {
+				t.Fatalf("client sent data on zero window: %+v", seg)
+			}
+			probes++
+		}
+		egr.HandleRx(t)
+		time.Sleep(time.Millisecond)
+	}
+	if probes < 2 {
+		t.Fatalf("got %d zero window probes, want at least 2", probes)
+	} else if probes > 10 {
+		t.Errorf("got %d zero window probes, want exponential backoff", probes)
+	}
+
+	// Server reads without sending a window update, next probe reopens the window.
+	var got strings.Builder
+	got.WriteString(socketReadAllString(server))
+	deadline = time.Now().Add(time.Second)
+	for got.Len() < len(data) && time.Now().Before(deadline) {
+		egr.DoExchanges(t, 2)
+		got.WriteString(socketReadAllString(server))
+		time.Sleep(time.Millisecond)
+	}
+	if got.String() != data {
+		t.Fatalf("got %d bytes, want %d", got.Len(), len(data))
+	}
+}
+
+func TestTCPNagleDelayedACK(t *testing.T) {
+	const ackDelay = 5 * time.Millisecond
+	client, server := createTCPClientServerPairWithConfig(t, stacks.TCPSocketConfig{
+		TxBufSize:  2048,
+		RxBufSize:  2048,
+		DelayedACK: ackDelay,
+	})
+	egr := NewExchanger(client.PortStack(), server.PortStack())
+	egr.DoExchanges(t, exchangesToEstablish)
+	if client.State() != seqs.StateEstablished || server.State() != seqs.StateEstablished {
+		t.Fatalf("not established: client=%s server=%s", client.State(), server.State())
+	}
+	sent := func() (client, server int) {
+		egr.HandleTx(t)
+		client, server = len(egr.getPayload(0)), len(egr.getPayload(1))
+		egr.HandleRx(t)
+		return client, server
+	}
+
+	socketSendString(client, "a")
+	if c, _ := sent(); c == 0 {
+		t.Fatal("first write not sent")
+	}
+	// Small writes are held by Nagle while data is in flight and the server delays its ACK.
+	socketSendString(client, "b")
+	socketSendString(client, "c")
+	if c, s := sent(); c != 0 || s != 0 {
+		t.Fatalf("expected no segments while data in flight and ACK delayed, got client=%d server=%d", c, s)
+	}
+	time.Sleep(ackDelay)
+	if _, s := sent(); s == 0 {
+		t.Fatal("delayed ACK not sent after timeout")
+	}
+	if seg := egr.LastSegment(); seg.Flags != seqs.FlagACK || seg.DATALEN != 0 {
+		t.Fatalf("expected pure ACK, got %+v", seg)
+	}
+	// Acknowledgement releases the coalesced writes in a single segment.
+	if c, _ := sent(); c == 0 {
+		t.Fatal("coalesced writes not sent")
+	}
+	if seg := egr.LastSegment(); seg.DATALEN != 2 {
+		t.Fatalf("expected writes coalesced into one segment, got %+v", seg)
+	}
+	if got := socketReadAllString(server); got != "abc" {
+		t.Fatalf("got %q, want %q", got, "abc")
+	}
+}
+
+func TestTCPReset(t *testing.T) {
+	client, server := createTCPClientServerPair(t)
+	cstack := client.PortStack()
+	egr := NewExchanger(cstack, server.PortStack())
+	egr.DoExchanges(t, exchangesToEstablish)
+	if client.State() != seqs.StateEstablished || server.State() != seqs.StateEstablished {
+		t.Fatalf("not established: client=%s server=%s", client.State(), server.State())
+	}
+	// Keep a server packet to forge RSTs from.
+	socketSendString(server, "x")
+	egr.HandleTx(t)
+	serverPkt, err := stacks.ParseTCPPacket(append([]byte{}, egr.getPayload(1)...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	egr.HandleRx(t)
+	egr.DoExchanges(t, 2)
+	rcvNxt := seqs.Add(serverPkt.TCP.Segment(1).SEQ, 1)
+	var buf [2048]byte
+	sendRST := func(seq seqs.Value) {
+		t.Helper()
+		pkt := serverPkt
+		pkt.CalculateHeaders(seqs.Segment{SEQ: seq, Flags: seqs.FlagRST}, nil)
+		pkt.PutHeaders(buf[:])
+		err := cstack.RecvEth(buf[:eth.SizeEthernetHeader+eth.SizeIPv4Header+eth.SizeTCPHeader])
+		if err != nil && !isDroppedPacket(err) {
+			t.Fatal(err)
+		}
+	}
+
+	// RST outside of the receive window is silently discarded.
+	sendRST(rcvNxt - 100)
+	if n, _ := cstack.HandleEth(buf[:]); n != 0 || client.State() != seqs.StateEstablished {
+		t.Fatalf("out of window RST: got %d bytes sent, state=%s", n, client.State())
+	}
+	// In-window RST that does not match RCV.NXT is answered with a challenge ACK.
+	sendRST(rcvNxt + 10)
+	n, err := cstack.HandleEth(buf[:])
+	if err != nil || n == 0 {
+		t.Fatal("challenge ACK not sent", err)
+	}
+	ack, err := stacks.ParseTCPPacket(buf[:n])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if seg := ack.TCP.Segment(0); seg.Flags != seqs.FlagACK || seg.ACK != rcvNxt || client.State() != seqs.StateEstablished {
+		t.Fatalf("challenge ACK: got %+v state=%s", seg, client.State())
+	}
+	// RST matching RCV.NXT resets the connection.
+	sendRST(rcvNxt)
+	if client.State() != seqs.StateClosed {
+		t.Fatalf("RST did not close connection: state=%s", client.State())
+	}
+	_, err = client.Read(buf[:])
+	if !errors.Is(err, stacks.ErrConnectionReset) {
+		t.Errorf("got read error %v, want %v", err, stacks.ErrConnectionReset)
+	}
+	_, err = client.Write([]byte("data"))
+	if !errors.Is(err, stacks.ErrConnectionReset) {
+		t.Errorf("got write error %v, want %v", err, stacks.ErrConnectionReset)
+	}
+}
+
+func TestPortStackReject(t *testing.T) {
+	client, server := createTCPClientServerPair(t)
+	cstack, sstack := client.PortStack(), server.PortStack()
+	// Close the server port so that the client's SYN is refused.
+	err := sstack.CloseTCP(server.Port())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf [2048]byte
+	n, err := cstack.HandleEth(buf[:])
+	if err != nil || n == 0 {
+		t.Fatal("SYN not sent", err)
+	}
+	syn := append([]byte{}, buf[:n]...)
+	err = sstack.RecvEth(syn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err = sstack.HandleEth(buf[:])
+	if err != nil || n == 0 {
+		t.Fatal("RST not sent", err)
+	}
+	rst, err := stacks.ParseTCPPacket(buf[:n])
+	if err != nil {
+		t.Fatal(err)
+	}
+	seg := rst.TCP.Segment(0)
+	if seg.Flags != seqs.FlagRST|seqs.FlagACK || seg.SEQ != 0 || seg.ACK != 101 {
+		t.Errorf("SYN to closed port: got reply %+v, want RST|ACK with SEQ=0 ACK=101", seg)
+	}
+	if rst.TCP.SourcePort != 80 || rst.TCP.DestinationPort != client.Port() ||
+		rst.IP.Destination != cstack.Addr().As4() || rst.Eth.Destination != cstack.MACAs6() {
+		t.Errorf("RST addressed incorrectly: %s", rst.String())
+	}
+	if crc := rst.TCP.CalculateChecksumIPv4(&rst.IP, nil, nil); crc != rst.TCP.Checksum {
+		t.Errorf("RST checksum mismatch: got %#04x, want %#04x", rst.TCP.Checksum, crc)
+	}
+
+	// A segment with ACK set is answered with a RST with SEQ=SEG.ACK.
+	pkt, err := stacks.ParseTCPPacket(syn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkt.CalculateHeaders(seqs.Segment{SEQ: 101, ACK: 1234, WND: 1000, Flags: seqs.FlagACK}, nil)
+	pkt.PutHeaders(buf[:])
+	const sizeSeg = eth.SizeEthernetHeader + eth.SizeIPv4Header + eth.SizeTCPHeader
+	err = sstack.RecvEth(buf[:sizeSeg])
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, _ = sstack.HandleEth(buf[:])
+	rst, err = stacks.ParseTCPPacket(buf[:n])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if seg := rst.TCP.Segment(0); seg.Flags != seqs.FlagRST || seg.SEQ != 1234 {
+		t.Errorf("ACK to closed port: got reply %+v, want RST with SEQ=1234", seg)
+	}
+
+	// Incoming resets are never answered.
+	pkt.CalculateHeaders(seqs.Segment{SEQ: 101, Flags: seqs.FlagRST}, nil)
+	pkt.PutHeaders(buf[:])
+	err = sstack.RecvEth(buf[:sizeSeg])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sstack.IsPendingHandling() {
+		t.Error("reply pending after RST to closed port")
+	}
+
+	// Responses are rate limited. Two responses were already sent.
+	const rateLimit = 16
+	sent := 2
+	for i := 0; i < 2*rateLimit; i++ {
+		err = sstack.RecvEth(syn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		n, _ = sstack.HandleEth(buf[:])
+		if n > 0 {
+			sent++
+		}
+	}
+	if sent != rateLimit {
+		t.Errorf("rate limit: sent %d responses, want %d", sent, rateLimit)
+	}
+}
+
+func TestPortStackRejectUDP(t *testing.T) {
+	const (
+		srcPort = 1025
+		dstPort = 53
+	)
+	stack := stacks.NewPortStack(stacks.PortStackConfig{
+		MAC:                 [6]byte{1, 1},
+		MaxOpenPortsUDP:     1,
+		MTU:                 2048,
+		ICMPPortUnreachable: true,
+	})
+	stack.SetAddr(netip.AddrFrom4([4]byte{192, 168, 1, 1}))
+	payload := []byte("query")
+	ehdr := eth.EthernetHeader{
+		Destination:     stack.MACAs6(),
+		Source:          [6]byte{2, 1},
+		SizeOrEtherType: uint16(eth.EtherTypeIPv4),
+	}
+	ihdr := eth.IPv4Header{
+		VersionAndIHL: 5,
+		TotalLength:   eth.SizeIPv4Header + eth.SizeUDPHeader + uint16(len(payload)),
+		TTL:           64,
+		Protocol:      17,
+		Source:        [4]byte{192, 168, 1, 2},
+		Destination:   stack.Addr().As4(),
+	}
+	ihdr.Checksum = ihdr.CalculateChecksum()
+	uhdr := eth.UDPHeader{
+		SourcePort:      srcPort,
+		DestinationPort: dstPort,
+		Length:          eth.SizeUDPHeader + uint16(len(payload)),
+	}
+	uhdr.Checksum = uhdr.CalculateChecksumIPv4(&ihdr, payload)
+	var frame [eth.SizeEthernetHeader + eth.SizeIPv4Header + eth.SizeUDPHeader + 5]byte
+	ehdr.Put(frame[:])
+	ihdr.Put(frame[eth.SizeEthernetHeader:])
+	uhdr.Put(frame[eth.SizeEthernetHeader+eth.SizeIPv4Header:])
+	copy(frame[eth.SizeEthernetHeader+eth.SizeIPv4Header+eth.SizeUDPHeader:], payload)
+
+	err := stack.RecvEth(frame[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf [2048]byte
+	n, err := stack.HandleEth(buf[:])
+	if err != nil || n == 0 {
+		t.Fatal("ICMP not sent", err)
+	}
+	const icmpOff = eth.SizeEthernetHeader + eth.SizeIPv4Header
+	rip, _ := eth.DecodeIPv4Header(buf[eth.SizeEthernetHeader:])
+	icmp := eth.DecodeICMPv4Header(buf[icmpOff:])
+	original := buf[icmpOff+eth.SizeICMPv4Header : n]
+	switch {
+	case rip.Protocol != 1 || rip.Destination != ihdr.Source || int(rip.TotalLength) != n-eth.SizeEthernetHeader:
+		t.Errorf("bad ICMP IP header: %s", rip.String())
+	case icmp.Type != eth.ICMPv4DestinationUnreachable || icmp.Code != eth.ICMPv4CodePortUnreachable:
+		t.Errorf("got %s, want port unreachable", icmp.String())
+	case icmp.Checksum != icmp.CalculateChecksum(original):
+		t.Errorf("ICMP checksum mismatch")
+	case !bytes.Equal(original, frame[eth.SizeEthernetHeader:icmpOff+eth.SizeUDPHeader]):
+		t.Errorf("ICMP message does not contain original IP header and datagram: %x", original)
+	}
+}
+
+func TestTCPTimeWait(t *testing.T) {
+	const msl = 5 * time.Millisecond
+	client, server := createTCPClientServerPairWithConfig(t, stacks.TCPSocketConfig{
+		TxBufSize: 2048,
+		RxBufSize: 2048,
+		MSL:       msl,
+	})
+	cstack, sstack := client.PortStack(), server.PortStack()
+	egr := NewExchanger(cstack, sstack)
+	egr.DoExchanges(t, exchangesToEstablish)
+	if client.State() != seqs.StateEstablished || server.State() != seqs.StateEstablished {
+		t.Fatalf("not established: client=%s server=%s", client.State(), server.State())
+	}
+	remote := netip.AddrPortFrom(sstack.Addr(), server.Port())
+	localPort := client.Port()
+	client.Close()
+	var fin []byte
+	for i := 0; i < exchangesToClose; i++ {
+		egr.HandleTx(t)
+		if egr.LastSegment().Flags.HasAny(seqs.FlagFIN) && len(egr.getPayload(1)) > 0 {
+			fin = append([]byte{}, egr.getPayload(1)...) // Keep server FIN to retransmit it.
+		}
+		egr.HandleRx(t)
+	}
+	if client.State() != seqs.StateTimeWait || server.State() != seqs.StateClosed {
+		t.Fatalf("not closed: client=%s server=%s", client.State(), server.State())
+	} else if fin == nil {
+		t.Fatal("server did not send FIN")
+	}
+
+	// Retransmitted FIN is acknowledged in TIME-WAIT.
+	err := cstack.RecvEth(fin)
+	if err != nil && !isDroppedPacket(err) {
+		t.Fatal(err)
+	}
+	var buf [2048]byte
+	n, err := cstack.HandleEth(buf[:])
+	if err != nil {
+		t.Fatal(err)
+	} else if n == 0 {
+		t.Fatal("retransmitted FIN not acknowledged")
+	}
+	pkt, err := stacks.ParseTCPPacket(buf[:n])
+	if err != nil {
+		t.Fatal(err)
+	}
+	finSeg := pkt.TCP.Segment(0)
+	if finSeg.Flags != seqs.FlagACK || client.State() != seqs.StateTimeWait {
+		t.Fatalf("got flags=%s state=%s, want ACK in TimeWait", finSeg.Flags, client.State())
+	}
+
+	// Connection can't be reopened with same 4-tuple during TIME-WAIT.
+	err = client.OpenDialTCP(localPort, sstack.MACAs6(), remote, 1337)
+	if err == nil {
+		t.Fatal("expected error reopening connection in TIME-WAIT")
+	}
+
+	// Port is released after 2*MSL and the 4-tuple may be reused.
+	time.Sleep(2 * msl)
+	_, err = cstack.HandleEth(buf[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if client.State() != seqs.StateClosed {
+		t.Fatalf("TIME-WAIT did not expire: client=%s", client.State())
+	}
+	err = client.OpenDialTCP(localPort, sstack.MACAs6(), remote, 1337)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = server.OpenListenTCP(remote.Port(), 1437)
+	if err != nil {
+		t.Fatal(err)
+	}
+	egr.DoExchanges(t, exchangesToEstablish)
+	testSocketDuplex(t, client, server, egr, 4)
+}
 
-	// Configure client.
-	clientTCP, err := stacks.NewTCPSocket(clientStack, stacks.TCPSocketConfig{
+func TestTCPPacketOptions(t *testing.T) {
+	const payload = "hello"
+	opts := eth.TCPOptions{MSS: 1460, HasWindowScale: true, WindowScale: 7, SACKPermitted: true}
+	seg := seqs.Segment{SEQ: 100, ACK: 300, WND: 1024, Flags: seqs.FlagACK | seqs.FlagPSH, DATALEN: seqs.Size(len(payload))}
+	var pkt stacks.TCPPacket
+	pkt.Eth.Source = [6]byte{1}
+	pkt.IP.Source = [4]byte{192, 168, 1, 1}
+	pkt.IP.Destination = [4]byte{192, 168, 1, 2}
+	pkt.TCP.SourcePort = 80
+	pkt.TCP.DestinationPort = 1234
+	err := pkt.CalculateHeadersWithOptions(seg, &opts, []byte(payload))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf [256]byte
+	err = pkt.PutHeadersWithOptions(buf[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := copy(buf[eth.SizeEthernetHeader+eth.SizeIPv4Header+eth.SizeTCPHeader+opts.Size():], payload)
+	got, err := stacks.ParseTCPPacket(buf[:eth.SizeEthernetHeader+eth.SizeIPv4Header+eth.SizeTCPHeader+opts.Size()+n])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got.Payload()) != payload {
+		t.Errorf("got payload %q, want %q", got.Payload(), payload)
+	}
+	if gotSeg := got.TCP.Segment(len(got.Payload())); gotSeg != seg {
+		t.Errorf("got segment %+v, want %+v", gotSeg, seg)
+	}
+	gotOpts, err := eth.DecodeTCPOptions(got.TCPOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gotOpts != opts {
+		t.Errorf("got options %+v, want %+v", gotOpts, opts)
+	}
+	if crc := got.TCP.CalculateChecksumIPv4(&got.IP, got.TCPOptions(), got.Payload()); crc != got.TCP.Checksum {
+		t.Errorf("bad checksum: got %#x, want %#x", got.TCP.Checksum, crc)
+	}
+}
+
+func TestTCPMSS(t *testing.T) {
+	const serverMTU = 600
+	const serverPort = 80
+	Stacks := createPortStacks(t, 2)
+	cstack := Stacks[0]
+	sstack := stacks.NewPortStack(stacks.PortStackConfig{
+		MAC:             Stacks[1].MACAs6(),
+		MaxOpenPortsTCP: 1,
+		MTU:             serverMTU,
+	})
+	sstack.SetAddr(Stacks[1].Addr())
+	cfg := stacks.TCPSocketConfig{TxBufSize: 4096, RxBufSize: 4096}
+	server, err := stacks.NewTCPSocket(sstack, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = server.OpenListenTCP(serverPort, 300)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := stacks.NewTCPSocket(cstack, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = client.OpenDialTCP(1025, sstack.MACAs6(), netip.AddrPortFrom(sstack.Addr(), serverPort), 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = cstack.FlagPendingTCP(1025)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Both SYN and SYN-ACK advertise the MSS allowed by their stack's MTU.
+	var buf [2048]byte
+	wantMSS := []uint16{cstack.MTU() - 54, serverMTU - 54}
+	for i, stack := range []*stacks.PortStack{cstack, sstack} {
+		n, err := stack.HandleEth(buf[:])
+		if err != nil || n == 0 {
+			t.Fatal("SYN not sent", i, err)
+		}
+		pkt, err := stacks.ParseTCPPacket(buf[:n])
+		if err != nil {
+			t.Fatal(err)
+		}
+		opts, err := eth.DecodeTCPOptions(pkt.TCPOptions())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !pkt.TCP.Flags().HasAny(seqs.FlagSYN) || opts.MSS != wantMSS[i] {
+			t.Fatalf("stack %d: want SYN with MSS %d, got %s %s", i, wantMSS[i], pkt.TCP.Flags(), opts.String())
+		}
+		if i == 1 {
+			err = cstack.RecvEth(buf[:n])
+		} else {
+			err = sstack.RecvEth(buf[:n])
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	egr := NewExchanger(cstack, sstack)
+	egr.DoExchanges(t, 1)
+	if client.State() != seqs.StateEstablished || server.State() != seqs.StateEstablished {
+		t.Fatalf("not established: client=%s server=%s", client.State(), server.State())
+	}
+
+	// Client data is segmented so that the server's MTU is not exceeded.
+	data := strings.Repeat("0123456789", 200)
+	socketSendString(client, data)
+	egr.segments = egr.segments[:0]
+	egr.DoExchanges(t, 16)
+	got := socketReadAllString(server)
+	if got != data {
+		t.Errorf("server: got %d bytes, want %d", len(got), len(data))
+	}
+	for _, seg := range egr.segments {
+		if seg.DATALEN > serverMTU-54 {
+			t.Errorf("segment exceeds MSS: %+v", seg)
+		}
+	}
+}
+
+func TestTCPWindowScale(t *testing.T) {
+	const bufSize = 1 << 18
+	client, server := createTCPClientServerPairWithConfig(t, stacks.TCPSocketConfig{
+		TxBufSize: bufSize,
+		RxBufSize: bufSize,
+	})
+	cstack, sstack := client.PortStack(), server.PortStack()
+	// Both SYN and SYN-ACK offer a shift count that allows advertising the whole buffer.
+	var buf [2048]byte
+	for i, stack := range []*stacks.PortStack{cstack, sstack} {
+		n, err := stack.HandleEth(buf[:])
+		if err != nil || n == 0 {
+			t.Fatal("SYN not sent", i, err)
+		}
+		pkt, err := stacks.ParseTCPPacket(buf[:n])
+		if err != nil {
+			t.Fatal(err)
+		}
+		opts, err := eth.DecodeTCPOptions(pkt.TCPOptions())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !opts.HasWindowScale || opts.WindowScale != 3 {
+			t.Fatalf("stack %d: want window scale 3, got %s", i, opts.String())
+		}
+		if i == 0 {
+			err = sstack.RecvEth(buf[:n])
+		} else {
+			err = cstack.RecvEth(buf[:n])
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	egr := NewExchanger(cstack, sstack)
+	egr.DoExchanges(t, 1)
+	if client.State() != seqs.StateEstablished || server.State() != seqs.StateEstablished {
+		t.Fatalf("not established: client=%s server=%s", client.State(), server.State())
+	}
+
+	// More than 2**16 bytes are sent without the server reading data.
+	data := strings.Repeat("0123456789", 10000)
+	socketSendString(client, data)
+	egr.DoExchanges(t, 2*len(data)/1000)
+	got := socketReadAllString(server)
+	if got != data {
+		t.Errorf("server: got %d bytes, want %d", len(got), len(data))
+	}
+}
+
+func TestPortStackTCPDecoding(t *testing.T) {
+	const dataport = 1234
+	packets := []string{
+		"28cdc1054d3ed85ed34303eb08004500003c76eb400040063f76c0a80192c0a80178ee1604d2a0ceb98a00000000a002faf06e800000020405b40402080a14ccf8250000000001030307",
+		"28cdc101137c88aedd0a709208004500002db03a4000400675590a0000be0a00007ac7ce04d22a67581700000d535018fa4bffff000068656c6c6f",
+	}
+	for i, data := range packets {
+		data, _ := hex.DecodeString(data)
+		ehdr := eth.DecodeEthernetHeader(data)
+		ps := stacks.NewPortStack(stacks.PortStackConfig{
+			MaxOpenPortsTCP: 1,
+			MTU:             2048,
+			MAC:             ehdr.Destination,
+		})
+		sock, err := stacks.NewTCPSocket(ps, stacks.TCPSocketConfig{})
+		if err != nil {
+			t.Fatal(i, err)
+		}
+		err = ps.OpenTCP(dataport, sock)
+		if err != nil {
+			t.Fatal(i, err)
+		}
+		err = ps.RecvEth(data)
+		if err != nil && !errors.Is(err, stacks.ErrDroppedPacket) {
+			t.Fatal(i, err)
+		}
+	}
+}
+
+type Exchanger struct {
+	Stacks   []*stacks.PortStack
+	pipesN   []int
+	pipes    [][2048]byte
+	segments []seqs.Segment
+	ex       int
+	loglevel slog.Level
+}
+
+func NewExchanger(stacks ...*stacks.PortStack) *Exchanger {
+	egr := &Exchanger{
+		Stacks: stacks,
+		pipesN: make([]int, len(stacks)),
+		pipes:  make([][2048]byte, len(stacks)),
+		ex:     -1,
+	}
+	return egr
+}
+
+func (egr *Exchanger) isdebug() bool { return egr.loglevel <= slog.LevelDebug }
+func (egr *Exchanger) isinfo() bool  { return egr.loglevel <= slog.LevelInfo }
+
+// LastSegment returns the last TCP segment sent over the stack.
+func (egr *Exchanger) LastSegment() seqs.Segment {
+	if len(egr.segments) == 0 {
+		return seqs.Segment{}
+	}
+	return egr.segments[len(egr.segments)-1]
+}
+
+func (egr *Exchanger) getPayload(istack int) []byte {
+	return egr.pipes[istack][:egr.pipesN[istack]]
+}
+
+func (egr *Exchanger) zeroPayload(istack int) {
+	egr.pipesN[istack] = 0
+	egr.pipes[istack] = [2048]byte{}
+}
+
+func (egr *Exchanger) HandleTx(t *testing.T) (pkts, bytesSent int) {
+	egr.ex++
+	t.Helper()
+	var err error
+	for istack := 0; istack < len(egr.Stacks); istack++ {
+		// This first for loop generates packets "in-flight" contained in `pipes` data structure.
+		egr.pipesN[istack], err = egr.Stacks[istack].HandleEth(egr.pipes[istack][:])
+		if (err != nil && !isDroppedPacket(err)) || egr.pipesN[istack] < 0 {
+			t.Errorf("ex[%d] send[%d]: %s", egr.ex, istack, err)
+			return pkts, bytesSent
+		} else if isDroppedPacket(err) && egr.isdebug() {
+			t.Logf("ex[%d] send[%d]: %s", egr.ex, istack, err)
+		}
+		if egr.pipesN[istack] > 0 {
+			pkts++
+			pkt, err := stacks.ParseTCPPacket(egr.getPayload(istack))
+			if err == nil {
+				seg := pkt.TCP.Segment(len(pkt.Payload()))
+				egr.segments = append(egr.segments, seg)
+				if egr.isdebug() {
+					t.Logf("ex[%d] send[%d]: %+v", egr.ex, istack, seg)
+				}
+			}
+		}
+		bytesSent += egr.pipesN[istack]
+	}
+	return pkts, bytesSent
+}
+
+func (egr *Exchanger) HandleRx(t *testing.T) {
+	var err error
+	for isend := 0; isend < len(egr.Stacks); isend++ {
+		// We deliver each in-flight packet to all stacks, except the one that sent it.
+		payload := egr.getPayload(isend)
+		if len(payload) == 0 {
+			continue
+		}
+		for irecv := 0; irecv < len(egr.Stacks); irecv++ {
+			if irecv == isend {
+				continue // Don't deliver to self.
+			}
+			err = egr.Stacks[irecv].RecvEth(payload)
+			if err != nil && !isDroppedPacket(err) {
+				t.Errorf("ex[%d] recv[%d]: %s", egr.ex, irecv, err)
+			} else if isDroppedPacket(err) && egr.isdebug() {
+				t.Logf("ex[%d] recv[%d]: %s", egr.ex, irecv, err)
+			}
+		}
+		egr.zeroPayload(isend)
+	}
+}
+
+// DoExchanges exchanges packets between stacks until no more data is being sent or maxExchanges is reached.
+// By convention client (initiator) is the first stack and server (listener) is the second when dealing with pairs.
+func (egr *Exchanger) DoExchanges(t *testing.T, maxExchanges int) (exDone, bytesSent int) {
+	t.Helper()
+	for ; exDone < maxExchanges; exDone++ {
+		pkts, bytes := egr.HandleTx(t)
+		bytesSent += bytes
+		if pkts == 0 {
+			break // No more data being sent.
+		}
+		egr.HandleRx(t)
+	}
+	return exDone, bytesSent
+}
+
+func isDroppedPacket(err error) bool {
+	return err != nil && (errors.Is(err, stacks.ErrDroppedPacket) || strings.HasPrefix(err.Error(), "drop"))
+}
+
+func createTCPClientServerPair(t *testing.T) (client, server *stacks.TCPSocket) {
+	t.Helper()
+	return createTCPClientServerPairWithConfig(t, stacks.TCPSocketConfig{
 		TxBufSize: 2048,
 		RxBufSize: 2048,
 	})
+}
+
+func createTCPClientServerPairWithConfig(t *testing.T, cfg stacks.TCPSocketConfig) (client, server *stacks.TCPSocket) {
+	t.Helper()
+	const (
+		clientPort = 1025
+		clientISS  = 100
+		clientWND  = 1000
+
+		serverPort = 80
+		serverISS  = 300
+		serverWND  = 1300
+	)
+	Stacks := createPortStacks(t, 2)
+	clientStack := Stacks[0]
+	serverStack := Stacks[1]
+
+	// Configure server
+	serverIP := netip.AddrPortFrom(serverStack.Addr(), serverPort)
+
+	serverTCP, err := stacks.NewTCPSocket(serverStack, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = serverTCP.OpenListenTCP(serverIP.Port(), serverISS)
+	// serverTCP, err := stacks.ListenTCP(serverStack, serverIP.Port(), serverISS, serverWND)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Configure client.
+	clientTCP, err := stacks.NewTCPSocket(clientStack, cfg)
 	if err != nil {
 		t.Fatal(err)
 	}
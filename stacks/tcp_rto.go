@@ -0,0 +1,87 @@
+package stacks
+
+import "time"
+
+const (
+	// defaultInitialRTO is the RTO used before a round trip time sample is taken. See RFC 6298 section 2.1.
+	defaultInitialRTO = time.Second
+	// defaultMinRTO is the lower bound of the RTO. See RFC 6298 section 2.4.
+	defaultMinRTO = time.Second
+	// maxRTO is the upper bound of the RTO. See RFC 6298 section 2.5.
+	maxRTO = 60 * time.Second
+	// defaultMaxRetransmits is the amount of consecutive retransmission timeouts after which the connection is aborted.
+	defaultMaxRetransmits = 8
+	// rtoGranularity is the clock granularity G used in the RTO calculation.
+	rtoGranularity = time.Millisecond
+)
+
+// rtoEstimator calculates the retransmission timeout (RTO) of a TCP connection
+// from round trip time (RTT) measurements as described in RFC 6298.
+type rtoEstimator struct {
+	srtt    time.Duration // Smoothed round trip time.
+	rttvar  time.Duration // Round trip time variation.
+	rto     time.Duration
+	initial time.Duration
+	min     time.Duration
+	sampled bool // Set after first RTT measurement.
+}
+
+// reset sets the estimator to its initial state with no RTT measurements.
+func (e *rtoEstimator) reset(initial, min time.Duration) {
+	*e = rtoEstimator{
+		rto:     initial,
+		initial: initial,
+		min:     min,
+	}
+}
+
+// RTO returns the current retransmission timeout.
+func (e *rtoEstimator) RTO() time.Duration { return e.rto }
+
+// SRTT returns the smoothed round trip time. Returns 0 if no measurement has been taken.
+func (e *rtoEstimator) SRTT() time.Duration { return e.srtt }
+
+// sample updates the RTO from a round trip time measurement. Per Karn's algorithm
+// the caller must not take samples from retransmitted segments.
+func (e *rtoEstimator) sample(rtt time.Duration) {
+	if rtt < 0 {
+		return
+	}
+	if !e.sampled {
+		// RFC 6298 section 2.2: First RTT measurement.
+		e.srtt = rtt
+		e.rttvar = rtt / 2
+		e.sampled = true
+	} else {
+		// RFC 6298 section 2.3: Subsequent measurements with alpha=1/8 and beta=1/4.
+		delta := e.srtt - rtt
+		if delta < 0 {
+			delta = -delta
+		}
+		e.rttvar = (3*e.rttvar + delta) / 4
+		e.srtt = (7*e.srtt + rtt) / 8
+	}
+	e.rto = e.srtt + maxDuration(rtoGranularity, 4*e.rttvar)
+	e.clamp()
+}
+
+// backoff doubles the RTO after a retransmission timeout. See RFC 6298 section 5.5.
+func (e *rtoEstimator) backoff() {
+	e.rto *= 2
+	e.clamp()
+}
+
+func (e *rtoEstimator) clamp() {
+	if e.rto < e.min {
+		e.rto = e.min
+	} else if e.rto > maxRTO {
+		e.rto = maxRTO
+	}
+}
+
+func maxDuration(a, b time.Duration) time.Duration {
+	if a > b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,58 @@
+package seqs
+
+// SetTimestamps enables or disables the timestamps option. Timestamps must only be enabled
+// if both SYN segments carried the timestamps option, see RFC 7323 section 3.2. When enabled
+// outgoing segments echo the most recent timestamp received (TS.Recent) in TSEcr and incoming
+// segments are checked by the PAWS algorithm of RFC 7323 section 5 to reject old duplicates.
+//
+// The ControlBlock has no clock so the TSVal of outgoing segments must be set by the caller.
+func (tcb *ControlBlock) SetTimestamps(enabled bool) {
+	tcb.tsOK = enabled
+}
+
+// Timestamps returns true if the timestamps option is enabled.
+func (tcb *ControlBlock) Timestamps() bool { return tcb.tsOK }
+
+// TSRecent returns the most recent timestamp received from remote that is echoed in outgoing segments.
+func (tcb *ControlBlock) TSRecent() uint32 { return tcb.tsRecent }
+
+// putTimestamps sets the timestamp echo reply of an outgoing segment. RST segments do not carry timestamps.
+func (tcb *ControlBlock) putTimestamps(seg *Segment) {
+	if !tcb.tsOK || seg.Flags.HasAny(FlagRST) {
+		return
+	}
+	seg.HasTimestamps = true
+	if seg.Flags.HasAny(FlagACK) {
+		seg.TSEcr = tcb.tsRecent
+	}
+}
+
+// rejectOld checks an incoming segment with the PAWS algorithm. Segments without timestamps
+// and segments with a timestamp older than TS.Recent are not acceptable. See RFC 7323 section 5.3.
+// The check is not performed for SYN and RST segments.
+func (tcb *ControlBlock) rejectOld(seg Segment) error {
+	if !tcb.tsOK || seg.Flags.HasAny(FlagSYN|FlagRST) {
+		return nil
+	} else if !seg.HasTimestamps {
+		return errNoTimestamps
+	} else if tsLessThan(seg.TSVal, tcb.tsRecent) {
+		return errPAWS
+	}
+	return nil
+}
+
+// rcvTimestamps updates TS.Recent with the timestamp of an acceptable incoming segment.
+// Timestamps are only recorded from segments that begin at or before the last
+// acknowledgement sent so that the timestamp echoed is that of the oldest
+// unacknowledged segment. See RFC 7323 section 4.3.
+func (tcb *ControlBlock) rcvTimestamps(seg Segment) {
+	if !seg.HasTimestamps {
+		return
+	}
+	if seg.Flags.HasAny(FlagSYN) || (!tsLessThan(seg.TSVal, tcb.tsRecent) && LessThanEq(seg.SEQ, tcb.lastACKSent)) {
+		tcb.tsRecent = seg.TSVal
+	}
+}
+
+// tsLessThan compares timestamps with modulo 2**32 arithmetic.
+func tsLessThan(a, b uint32) bool { return int32(a-b) < 0 }